@@ -23,9 +23,31 @@ SOFTWARE.
 package gateway
 
 import (
+	"context"
+	"errors"
 	"github.com/scionproto/scion/go/lib/addr"
+	"io"
 )
 
+// AdapterID identifies an adapter, data packets are exchanged between the adapters with the same ID on both ends
+type AdapterID uint8
+
+// DefaultAdapterID is the ID of the adapter set with SetAdapter,
+// it is the only adapter reachable by remotes speaking a protocol version without adapter IDs
+const DefaultAdapterID AdapterID = 0
+
+var adapterIDsNotNegotiatedError = errors.New("remote only exchanges data with the default adapter")
+
+// AdapterConf configures one of the adapters of the gateway, which are created by the embedding program
+type AdapterConf struct {
+	// ID must match the ID of the corresponding adapter on remote gateways
+	ID AdapterID
+	// Type selects the kind of adapter (e.g., ip)
+	Type string
+	// ConfPath is the path of the configuration file of the adapter
+	ConfPath string `yaml:"confPath"`
+}
+
 type Adapter interface {
 	// ProcessCtrlMsg allows the adapter to receive ctrl messages (see Message)
 	ProcessCtrlMsg(Message, addr.IA)
@@ -38,3 +60,121 @@ type Adapter interface {
 	// ProcessEgressPkt shall process packets coming from the local network and dispatch them to remote gateways
 	ProcessEgressPkt([]byte, func(string) (PeerWriter, error))
 }
+
+// PeerRemovalHandler is implemented by adapters that need to know when a peer is removed (e.g., to withdraw routes)
+type PeerRemovalHandler interface {
+	PeerRemoved(addr.IA)
+}
+
+// Reconfigurable is implemented by adapters that can apply a new configuration while running (see Gateway.Reload)
+type Reconfigurable interface {
+	Reconfigure([]byte) error
+}
+
+// adapterEntry is an adapter added to the gateway with its workers
+type adapterEntry struct {
+	id            AdapterID
+	adapter       Adapter
+	egressWorker  *egressWorker
+	ingressWorker *ingressWorker
+}
+
+// adapterMsg scopes a ctrl message to the adapter with the same ID on the remote
+type adapterMsg struct {
+	ID  AdapterID
+	Msg Message
+	// frame is Msg already encoded, if set
+	frame []byte
+}
+
+func (m *adapterMsg) encode(e *MsgEncoder) error {
+	frame := m.frame
+	if frame == nil {
+		var err error
+		if frame, err = encodeMsg(m.Msg); err != nil {
+			return err
+		}
+	}
+	e.PutUint8(uint8(m.ID))
+	e.PutBytes(frame)
+	return nil
+}
+
+func (m *adapterMsg) decode(version uint8, d *MsgDecoder) error {
+	m.ID = AdapterID(d.GetUint8())
+	frame := d.GetBytes()
+	if d.Err() != nil {
+		return d.Err()
+	}
+	var err error
+	m.Msg, err = decodeFrame(frame)
+	return err
+}
+
+// adapterPeerWriter scopes the data, ctrl messages, and calls written to a peer to an adapter
+type adapterPeerWriter struct {
+	*peer
+	id AdapterID
+}
+
+func (w adapterPeerWriter) CtrlWriter() io.Writer {
+	return adapterCtrlWriter{peer: w.peer, id: w.id}
+}
+
+func (w adapterPeerWriter) DataWriter() io.Writer {
+	return adapterDataWriter{peer: w.peer, id: w.id}
+}
+
+func (w adapterPeerWriter) WriteMsgReliable(ctx context.Context, msg Message) error {
+	scoped, err := w.peer.scopeToAdapter(w.id, msg)
+	if err != nil {
+		return err
+	}
+	return w.peer.WriteMsgReliable(ctx, scoped)
+}
+
+func (w adapterPeerWriter) Call(ctx context.Context, req Message) (Message, error) {
+	scoped, err := w.peer.scopeToAdapter(w.id, req)
+	if err != nil {
+		return nil, err
+	}
+	return w.peer.Call(ctx, scoped)
+}
+
+// adapterCtrlWriter writes the ctrl messages of an adapter to a peer, each Write is expected to be a whole frame
+type adapterCtrlWriter struct {
+	peer *peer
+	id   AdapterID
+}
+
+// maxMsgLen lets frames through whole, they are fragmented once scoped to the adapter
+func (w adapterCtrlWriter) maxMsgLen() int {
+	return msgHdrLen + maxMsgPayload
+}
+
+func (w adapterCtrlWriter) Write(frame []byte) (int, error) {
+	econn := w.peer.getEgressCtrlEConn()
+	if econn == nil {
+		return -1, cryptoHandshakeError
+	}
+	if !w.peer.usesAdapterIDs() {
+		if w.id != DefaultAdapterID {
+			return -1, adapterIDsNotNegotiatedError
+		}
+		return len(frame), writeFrame(frame, econn, econn.maxMsgLen())
+	}
+	if err := writeMsg(&adapterMsg{ID: w.id, frame: frame}, econn); err != nil {
+		return -1, err
+	}
+	return len(frame), nil
+}
+
+// adapterDataWriter writes the data packets of an adapter to a peer
+type adapterDataWriter struct {
+	peer *peer
+	id   AdapterID
+}
+
+func (w adapterDataWriter) Write(b []byte) (int, error) {
+	return w.peer.writeData(w.id, b)
+}
@@ -0,0 +1,126 @@
+/*
+Copyright (c) 2020, ETH and Andrea Tulimiero
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package gateway
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// newTestAdapterPair starts two gateways with a second adapter of ID 1 besides the default one,
+// it returns the gateways and their adapters of ID 1
+func newTestAdapterPair(t *testing.T) (*testGateway, *testGateway, *testAdapter, *testAdapter) {
+	const addrA, addrB = "1-ff00:0:1,[127.0.0.1]:30041", "1-ff00:0:2,[127.0.0.2]:30041"
+	d, sd := newTestTestbed()
+	extraA, extraB := newTestAdapter("1-ff00:0:2"), newTestAdapter("1-ff00:0:1")
+	a := newTestGatewayWithAdapters(t, d, sd, testGatewayConf(addrA, addrB), "1-ff00:0:2",
+		map[AdapterID]Adapter{1: extraA})
+	b := newTestGatewayWithAdapters(t, d, sd, testGatewayConf(addrB, addrA), "1-ff00:0:1",
+		map[AdapterID]Adapter{1: extraB})
+	a.adapter.waitHandshake(t, b.conf.Address.IA)
+	b.adapter.waitHandshake(t, a.conf.Address.IA)
+	return a, b, extraA, extraB
+}
+
+// expectNothing fails the test if the adapter receives a packet or a ctrl message within a short time
+func (a *testAdapter) expectNothing(t *testing.T) {
+	t.Helper()
+	select {
+	case b := <-a.received:
+		t.Errorf("unexpected packet: %q", b)
+	case msg := <-a.ctrlMsgs:
+		t.Errorf("unexpected ctrl message: %T", msg)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestAdapterDataMultiplexing(t *testing.T) {
+	a, b, extraA, extraB := newTestAdapterPair(t)
+	extraA.ProcessEgressPkt([]byte("one"), func(IA string) (PeerWriter, error) {
+		return a.getAdapterPeerWriter(IA, 1)
+	})
+	if actual := string(extraB.waitReceived(t)); actual != "one" {
+		t.Errorf("expected = %q, actual = %q", "one", actual)
+	}
+	b.adapter.expectNothing(t)
+
+	a.ProcessEgressPkt([]byte("zero"))
+	if actual := string(b.adapter.waitReceived(t)); actual != "zero" {
+		t.Errorf("expected = %q, actual = %q", "zero", actual)
+	}
+	extraB.expectNothing(t)
+}
+
+func TestAdapterCtrlScoping(t *testing.T) {
+	a, b, _, extraB := newTestAdapterPair(t)
+	w, err := a.getAdapterPeerWriter("1-ff00:0:2", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), testEventTimeout)
+	defer cancel()
+	if err := w.WriteMsgReliable(ctx, &keepAliveMsg{Seq: 7}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case msg := <-extraB.ctrlMsgs:
+		if k, ok := msg.(*keepAliveMsg); !ok || k.Seq != 7 {
+			t.Errorf("unexpected ctrl message: %#v", msg)
+		}
+	case <-time.After(testEventTimeout):
+		t.Fatal("no ctrl message received")
+	}
+	b.adapter.expectNothing(t)
+}
+
+func TestAdapterIDsNotNegotiated(t *testing.T) {
+	a, b, _, extraB := newTestAdapterPair(t)
+	pa, err := a.getPeer("1-ff00:0:2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pb, err := b.getPeer("1-ff00:0:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Both ends speak a version without adapter IDs
+	pa.setUsesAdapterIDs(false)
+	pb.setUsesAdapterIDs(false)
+
+	w, err := a.getAdapterPeerWriter("1-ff00:0:2", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.DataWriter().Write([]byte("one")); err != adapterIDsNotNegotiatedError {
+		t.Errorf("expected = %v, actual = %v", adapterIDsNotNegotiatedError, err)
+	}
+	if _, err := w.CtrlWriter().Write([]byte("frame")); err != adapterIDsNotNegotiatedError {
+		t.Errorf("expected = %v, actual = %v", adapterIDsNotNegotiatedError, err)
+	}
+	a.ProcessEgressPkt([]byte("zero"))
+	if actual := string(b.adapter.waitReceived(t)); actual != "zero" {
+		t.Errorf("expected = %q, actual = %q", "zero", actual)
+	}
+	extraB.expectNothing(t)
+}
@@ -0,0 +1,91 @@
+/*
+Copyright (c) 2020, ETH and Andrea Tulimiero
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package ipadapter
+
+import (
+	"bytes"
+	"github.com/andreatulimiero/seg/gateway"
+	"github.com/scionproto/scion/go/lib/snet"
+	"net"
+	"reflect"
+	"testing"
+)
+
+// frameReader returns the frames written to it, one per ReadFrom
+type frameReader struct {
+	bytes.Buffer
+}
+
+func (r *frameReader) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, err := r.Read(b)
+	return n, &snet.UDPAddr{}, err
+}
+
+func TestCodecsRoundTrip(t *testing.T) {
+	msgs := []gateway.Message{
+		&ConfMsg{Net: net.IPNet{IP: net.IP{192, 168, 1, 0}, Mask: net.CIDRMask(24, 32)}},
+		&ConfMsg{Net: net.IPNet{IP: net.ParseIP("fd00::"), Mask: net.CIDRMask(64, 128)}},
+		&SubnetsRequestMsg{},
+		&SubnetsResponseMsg{Subnets: []net.IPNet{
+			{IP: net.IP{10, 0, 0, 0}, Mask: net.CIDRMask(8, 32)},
+			{IP: net.ParseIP("fd00:1::"), Mask: net.CIDRMask(48, 128)},
+		}},
+	}
+	for _, msg := range msgs {
+		r := &frameReader{}
+		if err := gateway.WriteMsg(msg, r); err != nil {
+			t.Fatalf("WriteMsg(%T) failed: %s", msg, err)
+		}
+		decoded, _, err := gateway.ReadMsg(r)
+		if err != nil {
+			t.Fatalf("ReadMsg(%T) failed: %s", msg, err)
+		}
+		if !reflect.DeepEqual(decoded, msg) {
+			t.Errorf("%T round trip: expected = %+v, actual = %+v", msg, msg, decoded)
+		}
+	}
+}
+
+func TestCodecsTruncated(t *testing.T) {
+	msgs := []gateway.Message{
+		&ConfMsg{Net: net.IPNet{IP: net.IP{192, 168, 1, 0}, Mask: net.CIDRMask(24, 32)}},
+		&SubnetsResponseMsg{Subnets: []net.IPNet{{IP: net.IP{10, 0, 0, 0}, Mask: net.CIDRMask(8, 32)}}},
+	}
+	for _, msg := range msgs {
+		w := &frameReader{}
+		if err := gateway.WriteMsg(msg, w); err != nil {
+			t.Fatalf("WriteMsg(%T) failed: %s", msg, err)
+		}
+		frame := w.Bytes()
+		// Frames are | type | version | length (2 bytes) | payload |, the length is fixed up to match
+		for l := 4; l < len(frame); l++ {
+			truncated := append([]byte(nil), frame[:l]...)
+			truncated[2], truncated[3] = byte((l-4)>>8), byte(l-4)
+			r := &frameReader{}
+			r.Write(truncated)
+			if _, _, err := gateway.ReadMsg(r); err == nil {
+				t.Errorf("%T with payload truncated to %d bytes: expected error", msg, l-4)
+			}
+		}
+	}
+}
@@ -23,6 +23,7 @@ SOFTWARE.
 package ipadapter
 
 import (
+	"context"
 	"encoding/gob"
 	"fmt"
 	"github.com/andreatulimiero/seg/gateway"
@@ -34,9 +35,17 @@ import (
 	"gopkg.in/yaml.v2"
 	"io"
 	"net"
+	"sync"
+	"time"
 )
 
-var _ gateway.Adapter = (*IPAdapter)(nil)
+var (
+	_ gateway.Adapter            = (*IPAdapter)(nil)
+	_ gateway.TypedAdapter       = (*IPAdapter)(nil)
+	_ gateway.PeerRemovalHandler = (*IPAdapter)(nil)
+	_ gateway.Reconfigurable     = (*IPAdapter)(nil)
+	_ io.Closer                  = (*IPAdapter)(nil)
+)
 
 const (
 	defaultMTU     = 1200
@@ -44,9 +53,15 @@ const (
 	defaultTunName = "tun0"
 	ip4Ver         = 0x4
 	ip4DstOff      = 16
+	// confDeliveryTimeout is the time given to a remote gateway to acknowledge our ConfMsg
+	confDeliveryTimeout = time.Minute
 )
 
+const confMsgType = gateway.MinAdapterMsgType
+
 func init() {
+	gateway.RegisterMsgCodec(confMsgType, 1, &ConfMsg{}, confMsgCodec{})
+	// gob is only used to read messages of older gateways in compatibility mode
 	gob.Register(&ConfMsg{})
 }
 
@@ -56,6 +71,31 @@ type ConfMsg struct {
 	Net net.IPNet
 }
 
+// confMsgCodec encodes a ConfMsg as its network IP followed by its mask
+type confMsgCodec struct{}
+
+func (confMsgCodec) Encode(msg gateway.Message, e *gateway.MsgEncoder) error {
+	var confMsg *ConfMsg
+	switch m := msg.(type) {
+	case *ConfMsg:
+		confMsg = m
+	case ConfMsg:
+		confMsg = &m
+	default:
+		return fmt.Errorf("unexpected message %T", msg)
+	}
+	e.PutBytes(confMsg.Net.IP)
+	e.PutBytes(confMsg.Net.Mask)
+	return nil
+}
+
+func (confMsgCodec) Decode(version uint8, d *gateway.MsgDecoder) (gateway.Message, error) {
+	msg := &ConfMsg{}
+	msg.Net.IP = d.GetBytes()
+	msg.Net.Mask = d.GetBytes()
+	return msg, d.Err()
+}
+
 type Conf struct {
 	Subnet  *YIPNet
 	Addr    *YIP
@@ -70,14 +110,18 @@ type netToClient struct {
 }
 
 type IPAdapter struct {
-	conf    Conf
-	tunLink netlink.Link
-	tunIO   io.ReadWriteCloser
-	router  *Router
+	confMutex sync.RWMutex
+	conf      Conf
+	tunLink   netlink.Link
+	tunIO     io.ReadWriteCloser
+	router    *Router
+	// peers are the remote gateways we sent our conf to, they receive it again when our subnet changes
+	peersMutex sync.Mutex
+	peers      map[string]gateway.PeerWriter
 }
 
 func newIPAdapter(conf Conf) (*IPAdapter, error) {
-	a := &IPAdapter{conf: conf}
+	a := &IPAdapter{conf: conf, peers: make(map[string]gateway.PeerWriter)}
 	a.router = newRouter(a)
 	var err error
 	a.tunLink, a.tunIO, err = getTun(conf.MTU, conf.TxQlen, *conf.Addr.IP, conf.TunName)
@@ -136,14 +180,20 @@ func getDestIP(buf []byte) (net.IP, error) {
 	}
 }
 
-// NewIPAdapter returns a new IPAdapter
-func NewIPAdapter(confBuf []byte) (*IPAdapter, error) {
+// parseConf parses an IPAdapter configuration, using the defaults for the missing values
+func parseConf(confBuf []byte) (Conf, error) {
 	conf := Conf{
 		MTU:     defaultMTU,
 		TxQlen:  defaultTxQlen,
 		TunName: defaultTunName,
 	}
 	err := yaml.UnmarshalStrict(confBuf, &conf)
+	return conf, err
+}
+
+// NewIPAdapter returns a new IPAdapter
+func NewIPAdapter(confBuf []byte) (*IPAdapter, error) {
+	conf, err := parseConf(confBuf)
 	if err != nil {
 		return nil, err
 	}
@@ -151,13 +201,66 @@ func NewIPAdapter(confBuf []byte) (*IPAdapter, error) {
 	return newIPAdapter(conf)
 }
 
+// Reconfigure applies the MTU and queue length of a new configuration to the tun interface,
+// and announces the new subnet to remote gateways. The address and name of the tun interface cannot be changed.
+func (adapter *IPAdapter) Reconfigure(confBuf []byte) error {
+	conf, err := parseConf(confBuf)
+	if err != nil {
+		return err
+	}
+	if conf.Addr == nil || conf.Subnet == nil {
+		return fmt.Errorf("addr and subnet are required")
+	}
+	adapter.confMutex.Lock()
+	old := adapter.conf
+	if conf.TunName != old.TunName || !conf.Addr.IP.Equal(*old.Addr.IP) {
+		adapter.confMutex.Unlock()
+		return fmt.Errorf("changing the tun interface requires a restart")
+	}
+	if conf.MTU != old.MTU {
+		if err := netlink.LinkSetMTU(adapter.tunLink, conf.MTU); err != nil {
+			adapter.confMutex.Unlock()
+			return err
+		}
+	}
+	if conf.TxQlen != old.TxQlen {
+		if err := netlink.LinkSetTxQLen(adapter.tunLink, conf.TxQlen); err != nil {
+			adapter.confMutex.Unlock()
+			return err
+		}
+	}
+	adapter.conf = conf
+	adapter.confMutex.Unlock()
+	log.Info("IPAdapter reconfigured", "conf", conf)
+	if conf.Subnet.String() != old.Subnet.String() {
+		adapter.peersMutex.Lock()
+		for _, peer := range adapter.peers {
+			go adapter.sendConf(peer)
+		}
+		adapter.peersMutex.Unlock()
+	}
+	return nil
+}
+
 func (adapter *IPAdapter) HandshakeComplete(peer gateway.PeerWriter) {
-	msg := ConfMsg{
+	adapter.peersMutex.Lock()
+	adapter.peers[peer.RemoteIA().String()] = peer
+	adapter.peersMutex.Unlock()
+	adapter.sendConf(peer)
+}
+
+// sendConf sends our subnet to a remote gateway
+func (adapter *IPAdapter) sendConf(peer gateway.PeerWriter) {
+	adapter.confMutex.RLock()
+	msg := &ConfMsg{
 		//MACs:         Cfg.LaNeCa.MACs,
 		//FlowPolicies: Cfg.LaNeCa.Policies.Flow,
 		Net: *adapter.conf.Subnet.IPNet}
+	adapter.confMutex.RUnlock()
 	log.Debug("Sending conf to remote gateway")
-	err := gateway.WriteMsg(msg, peer.CtrlWriter())
+	ctx, cancel := context.WithTimeout(context.Background(), confDeliveryTimeout)
+	defer cancel()
+	err := peer.WriteMsgReliable(ctx, msg)
 	if err != nil {
 		log.Error("Error sending conf", "err", err)
 	}
@@ -172,12 +275,22 @@ func (adapter *IPAdapter) ProcessCtrlMsg(msg gateway.Message, remoteIA addr.IA)
 		//	lanecaAdapter.MACsToGatewayClientMap[mac.String()] = peer
 		//}
 		//LoadFlowPolicies(conf.FlowPolicies)
-		err := adapter.router.addNet(&reqMsg.Net, remoteIA.String())
+		err := adapter.router.setNet(&reqMsg.Net, remoteIA.String())
 		if err != nil {
 			log.Error("Error adding routing", "net", reqMsg.Net, "remoteIA", remoteIA, "err", err)
 		}
 	default:
-		log.Warn("Unknown message type received", "type", fmt.Sprintf("%T", msg))
+		// The message may be meant for another adapter
+		log.Debug("Ignoring unknown message type", "type", fmt.Sprintf("%T", msg))
+	}
+}
+
+func (adapter *IPAdapter) PeerRemoved(remoteIA addr.IA) {
+	adapter.peersMutex.Lock()
+	delete(adapter.peers, remoteIA.String())
+	adapter.peersMutex.Unlock()
+	if err := adapter.router.removeNets(remoteIA.String()); err != nil {
+		log.Error("Error removing routing", "remoteIA", remoteIA, "err", err)
 	}
 }
 
@@ -224,6 +337,18 @@ func (adapter *IPAdapter) Read(buf []byte) (int, error) {
 	return adapter.tunIO.Read(buf)
 }
 
+func (adapter *IPAdapter) AdapterType() string {
+	return "ip"
+}
+
+// Close removes the routes toward remote gateways and closes the tun interface
+func (adapter *IPAdapter) Close() error {
+	if err := adapter.router.removeAll(); err != nil {
+		log.Error("Error removing routing", "err", err)
+	}
+	return adapter.tunIO.Close()
+}
+
 func (adapter *IPAdapter) String() string {
 	return fmt.Sprintf("IP @ %s", adapter.tunLink.Attrs().Name)
 }
@@ -27,10 +27,12 @@ import (
 	"github.com/scionproto/scion/go/lib/log"
 	"github.com/vishvananda/netlink"
 	"net"
+	"sync"
 )
 
 type Router struct {
 	adapter         *IPAdapter
+	mutex           sync.RWMutex
 	netToClientList []netToClient
 }
 
@@ -39,6 +41,8 @@ func newRouter(adapter *IPAdapter) *Router {
 }
 
 func (r *Router) Lookup(addr net.IP) (string, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
 	for _, nToC := range r.netToClientList {
 		if nToC.net.Contains(addr) {
 			return nToC.IA, nil
@@ -48,7 +52,14 @@ func (r *Router) Lookup(addr net.IP) (string, error) {
 }
 
 func (r *Router) addNet(dst *net.IPNet, IA string) error {
-	// TODO: Check for duplicates
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for _, nToC := range r.netToClientList {
+		if nToC.IA == IA && nToC.net.String() == dst.String() {
+			// The remote sent its conf again (e.g., after a new handshake)
+			return nil
+		}
+	}
 	r.netToClientList = append(r.netToClientList, netToClient{dst, IA})
 	route := &netlink.Route{
 		LinkIndex: r.adapter.tunLink.Attrs().Index,
@@ -60,3 +71,47 @@ func (r *Router) addNet(dst *net.IPNet, IA string) error {
 	}
 	return nil
 }
+
+// setNet routes dst toward a remote gateway identified by IA, replacing the net it announced before (if any)
+func (r *Router) setNet(dst *net.IPNet, IA string) error {
+	err := r.removeRoutes(func(nToC netToClient) bool {
+		return nToC.IA == IA && nToC.net.String() != dst.String()
+	})
+	if err != nil {
+		log.Error("Error removing previous routing", "remoteIA", IA, "err", err)
+	}
+	return r.addNet(dst, IA)
+}
+
+// removeNets removes the routes toward the nets of a remote gateway identified by IA
+func (r *Router) removeNets(IA string) error {
+	return r.removeRoutes(func(nToC netToClient) bool { return nToC.IA == IA })
+}
+
+// removeAll removes the routes toward the nets of all remote gateways
+func (r *Router) removeAll() error {
+	return r.removeRoutes(func(netToClient) bool { return true })
+}
+
+func (r *Router) removeRoutes(match func(netToClient) bool) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	var err error
+	kept := r.netToClientList[:0]
+	for _, nToC := range r.netToClientList {
+		if !match(nToC) {
+			kept = append(kept, nToC)
+			continue
+		}
+		route := &netlink.Route{
+			LinkIndex: r.adapter.tunLink.Attrs().Index,
+			Dst:       nToC.net,
+		}
+		log.Info("Removing route from tun", "net", route.Dst)
+		if delErr := netlink.RouteDel(route); delErr != nil {
+			err = delErr
+		}
+	}
+	r.netToClientList = kept
+	return err
+}
@@ -0,0 +1,109 @@
+/*
+Copyright (c) 2020, ETH and Andrea Tulimiero
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package ipadapter
+
+import (
+	"context"
+	"fmt"
+	"github.com/andreatulimiero/seg/gateway"
+	"github.com/scionproto/scion/go/lib/addr"
+	"github.com/scionproto/scion/go/lib/log"
+	"net"
+)
+
+const (
+	subnetsRequestMsgType = confMsgType + 1 + iota
+	subnetsResponseMsgType
+)
+
+func init() {
+	gateway.RegisterMsgCodec(subnetsRequestMsgType, 1, &SubnetsRequestMsg{}, subnetsRequestCodec{})
+	gateway.RegisterMsgCodec(subnetsResponseMsgType, 1, &SubnetsResponseMsg{}, subnetsResponseCodec{})
+}
+
+// SubnetsRequestMsg asks a remote IPAdapter for the subnets it serves
+type SubnetsRequestMsg struct{}
+
+// SubnetsResponseMsg lists the subnets served by an IPAdapter
+type SubnetsResponseMsg struct {
+	Subnets []net.IPNet
+}
+
+type subnetsRequestCodec struct{}
+
+func (subnetsRequestCodec) Encode(msg gateway.Message, e *gateway.MsgEncoder) error {
+	return nil
+}
+
+func (subnetsRequestCodec) Decode(version uint8, d *gateway.MsgDecoder) (gateway.Message, error) {
+	return &SubnetsRequestMsg{}, nil
+}
+
+// subnetsResponseCodec encodes a SubnetsResponseMsg as the number of subnets followed by their IPs and masks
+type subnetsResponseCodec struct{}
+
+func (subnetsResponseCodec) Encode(msg gateway.Message, e *gateway.MsgEncoder) error {
+	var resMsg *SubnetsResponseMsg
+	switch m := msg.(type) {
+	case *SubnetsResponseMsg:
+		resMsg = m
+	case SubnetsResponseMsg:
+		resMsg = &m
+	default:
+		return fmt.Errorf("unexpected message %T", msg)
+	}
+	e.PutUint16(uint16(len(resMsg.Subnets)))
+	for _, subnet := range resMsg.Subnets {
+		e.PutBytes(subnet.IP)
+		e.PutBytes(subnet.Mask)
+	}
+	return nil
+}
+
+func (subnetsResponseCodec) Decode(version uint8, d *gateway.MsgDecoder) (gateway.Message, error) {
+	msg := &SubnetsResponseMsg{Subnets: make([]net.IPNet, d.GetUint16())}
+	for i := range msg.Subnets {
+		msg.Subnets[i].IP = d.GetBytes()
+		msg.Subnets[i].Mask = d.GetBytes()
+	}
+	return msg, d.Err()
+}
+
+// HandleSubnetsRequest is the gateway.RPCHandler answering SubnetsRequestMsgs with the local subnets
+func (adapter *IPAdapter) HandleSubnetsRequest(req gateway.Message, remoteIA addr.IA) (gateway.Message, error) {
+	log.Debug("Received subnets request", "remoteIA", remoteIA)
+	return &SubnetsResponseMsg{Subnets: []net.IPNet{*adapter.conf.Subnet.IPNet}}, nil
+}
+
+// RemoteSubnets asks the IPAdapter of a remote gateway for the subnets it serves
+func (adapter *IPAdapter) RemoteSubnets(ctx context.Context, peer gateway.PeerWriter) ([]net.IPNet, error) {
+	res, err := peer.Call(ctx, &SubnetsRequestMsg{})
+	if err != nil {
+		return nil, err
+	}
+	resMsg, ok := res.(*SubnetsResponseMsg)
+	if !ok {
+		return nil, fmt.Errorf("unexpected response %T", res)
+	}
+	return resMsg.Subnets, nil
+}
@@ -0,0 +1,176 @@
+/*
+Copyright (c) 2020, ETH and Andrea Tulimiero
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package gateway
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+const (
+	authTypeDRKey   = "drkey"
+	authTypePSK     = "psk"
+	authTypeEd25519 = "ed25519"
+)
+
+// Authenticator authenticates the public keys exchanged in the handshake with a remote gateway
+type Authenticator interface {
+	// Tag returns the authentication tag of a local public key
+	Tag(pubKey []byte) ([]byte, error)
+	// Verify checks the authentication tag of a remote public key
+	Verify(pubKey, tag []byte) error
+}
+
+// AuthConf configures the authentication of the handshake with a remote gateway
+type AuthConf struct {
+	// Type is the authentication method used with the remote: drkey (default), psk, ed25519, or cert
+	Type string
+	// PSK is the base64 encoded key shared with the remote (psk only)
+	PSK string `yaml:"psk"`
+	// PublicKey is the base64 encoded Ed25519 public key of the remote (ed25519 only)
+	PublicKey string `yaml:"publicKey"`
+}
+
+// SetAuthenticator overrides the Authenticator used with a remote gateway identified by IA.
+// It must be called before starting the gateway.
+func (gateway *Gateway) SetAuthenticator(IA string, authenticator Authenticator) {
+	gateway.authenticators[IA] = authenticator
+}
+
+// newAuthenticator returns the Authenticator to be used by a peer
+func (gateway *Gateway) newAuthenticator(peer *peer) (Authenticator, error) {
+	if authenticator, ok := gateway.authenticators[peer.remote.Address.IA.String()]; ok {
+		return authenticator, nil
+	}
+	authConf := peer.remote.Auth
+	switch authConf.Type {
+	case "", authTypeDRKey:
+		return newDRKeyMgr(peer), nil
+	case authTypePSK:
+		psk, err := base64.StdEncoding.DecodeString(authConf.PSK)
+		if err != nil {
+			return nil, fmt.Errorf("invalid psk: %s", err)
+		}
+		if len(psk) == 0 {
+			return nil, fmt.Errorf("missing psk")
+		}
+		return &pskAuthenticator{psk: psk, peer: peer}, nil
+	case authTypeEd25519:
+		if gateway.ed25519Key == nil {
+			return nil, fmt.Errorf("ed25519 authentication requires ed25519KeyPath")
+		}
+		remoteKey, err := base64.StdEncoding.DecodeString(authConf.PublicKey)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ed25519 public key: %s", err)
+		}
+		if len(remoteKey) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid ed25519 public key length: %d", len(remoteKey))
+		}
+		return &ed25519Authenticator{localKey: gateway.ed25519Key, remoteKey: remoteKey, peer: peer}, nil
+	case authTypeCert:
+		if gateway.certStore == nil {
+			return nil, fmt.Errorf("cert authentication requires the certificate configuration")
+		}
+		return &certAuthenticator{store: gateway.certStore, peer: peer}, nil
+	default:
+		return nil, fmt.Errorf("unknown authentication type: %s", authConf.Type)
+	}
+}
+
+// authContext returns the context a tag is bound to, so that tags cannot be reflected or used with another peer
+func authContext(method string, peer *peer, outgoing bool) []byte {
+	localIA, remoteIA := peer.gateway.localAddr().IA, peer.remoteAddr().IA
+	if outgoing {
+		return []byte(fmt.Sprintf("seg %s %s->%s", method, localIA, remoteIA))
+	}
+	return []byte(fmt.Sprintf("seg %s %s->%s", method, remoteIA, localIA))
+}
+
+// pskAuthenticator authenticates public keys with an HMAC keyed with a pre-shared key
+type pskAuthenticator struct {
+	psk  []byte
+	peer *peer
+}
+
+func (a *pskAuthenticator) mac(pubKey []byte, outgoing bool) []byte {
+	mac := hmac.New(sha256.New, a.psk)
+	mac.Write(authContext(authTypePSK, a.peer, outgoing))
+	mac.Write(pubKey)
+	return mac.Sum(nil)
+}
+
+func (a *pskAuthenticator) Tag(pubKey []byte) ([]byte, error) {
+	return a.mac(pubKey, true), nil
+}
+
+func (a *pskAuthenticator) Verify(pubKey, tag []byte) error {
+	if !hmac.Equal(tag, a.mac(pubKey, false)) {
+		return fmt.Errorf("psk authentication tag is not as expected")
+	}
+	return nil
+}
+
+// ed25519Authenticator authenticates public keys with signatures from static Ed25519 keys
+type ed25519Authenticator struct {
+	localKey  ed25519.PrivateKey
+	remoteKey ed25519.PublicKey
+	peer      *peer
+}
+
+func (a *ed25519Authenticator) Tag(pubKey []byte) ([]byte, error) {
+	msg := append(authContext(authTypeEd25519, a.peer, true), pubKey...)
+	return ed25519.Sign(a.localKey, msg), nil
+}
+
+func (a *ed25519Authenticator) Verify(pubKey, tag []byte) error {
+	msg := append(authContext(authTypeEd25519, a.peer, false), pubKey...)
+	if !ed25519.Verify(a.remoteKey, msg, tag) {
+		return fmt.Errorf("ed25519 signature is not valid")
+	}
+	return nil
+}
+
+// loadEd25519Key loads a base64 encoded Ed25519 private key (or its seed) from a file
+func loadEd25519Key(path string) (ed25519.PrivateKey, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(buf)))
+	if err != nil {
+		return nil, err
+	}
+	switch len(key) {
+	case ed25519.SeedSize:
+		return ed25519.NewKeyFromSeed(key), nil
+	case ed25519.PrivateKeySize:
+		return ed25519.PrivateKey(key), nil
+	default:
+		return nil, fmt.Errorf("invalid ed25519 key length: %d", len(key))
+	}
+}
@@ -0,0 +1,173 @@
+/*
+Copyright (c) 2020, ETH and Andrea Tulimiero
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package gateway
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"github.com/scionproto/scion/go/lib/addr"
+	"github.com/scionproto/scion/go/lib/snet"
+	"net"
+	"testing"
+)
+
+// newTestAuthPeer returns a peer of the gateway in localIA toward remoteIA, authenticated as configured by auth
+func newTestAuthPeer(t *testing.T, localIA, remoteIA string, auth AuthConf, key ed25519.PrivateKey) *peer {
+	parseAddr := func(s string) YUDPAddr {
+		ia, err := addr.IAFromString(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return YUDPAddr{&snet.UDPAddr{IA: ia, Host: &net.UDPAddr{}}}
+	}
+	gateway := &Gateway{conf: conf{Address: parseAddr(localIA)}, authenticators: make(map[string]Authenticator),
+		ed25519Key: key}
+	return &peer{gateway: gateway, remote: ConnConf{Address: parseAddr(remoteIA), Auth: auth}}
+}
+
+func TestAuthenticators(t *testing.T) {
+	psk := base64.StdEncoding.EncodeToString([]byte("test psk"))
+	otherPSK := base64.StdEncoding.EncodeToString([]byte("other psk"))
+	pubA, priA, _ := ed25519.GenerateKey(nil)
+	pubB, priB, _ := ed25519.GenerateKey(nil)
+	pubC, _, _ := ed25519.GenerateKey(nil)
+	ed25519Auth := func(pub ed25519.PublicKey) AuthConf {
+		return AuthConf{Type: authTypeEd25519, PublicKey: base64.StdEncoding.EncodeToString(pub)}
+	}
+	const ia1, ia2, ia3 = "1-ff00:0:1", "1-ff00:0:2", "1-ff00:0:3"
+	tests := []struct {
+		name string
+		// tagger tags a public key, which verifier verifies
+		tagger, verifier func(t *testing.T) *peer
+		expected         bool
+	}{
+		{
+			name: "psk",
+			tagger: func(t *testing.T) *peer {
+				return newTestAuthPeer(t, ia1, ia2, AuthConf{Type: authTypePSK, PSK: psk}, nil)
+			},
+			verifier: func(t *testing.T) *peer {
+				return newTestAuthPeer(t, ia2, ia1, AuthConf{Type: authTypePSK, PSK: psk}, nil)
+			},
+			expected: true,
+		},
+		{
+			name: "psk wrong key",
+			tagger: func(t *testing.T) *peer {
+				return newTestAuthPeer(t, ia1, ia2, AuthConf{Type: authTypePSK, PSK: psk}, nil)
+			},
+			verifier: func(t *testing.T) *peer {
+				return newTestAuthPeer(t, ia2, ia1, AuthConf{Type: authTypePSK, PSK: otherPSK}, nil)
+			},
+		},
+		{
+			name: "psk tag for another remote",
+			tagger: func(t *testing.T) *peer {
+				return newTestAuthPeer(t, ia1, ia3, AuthConf{Type: authTypePSK, PSK: psk}, nil)
+			},
+			verifier: func(t *testing.T) *peer {
+				return newTestAuthPeer(t, ia2, ia1, AuthConf{Type: authTypePSK, PSK: psk}, nil)
+			},
+		},
+		{
+			name: "psk reflected tag",
+			tagger: func(t *testing.T) *peer {
+				return newTestAuthPeer(t, ia2, ia1, AuthConf{Type: authTypePSK, PSK: psk}, nil)
+			},
+			verifier: func(t *testing.T) *peer {
+				return newTestAuthPeer(t, ia2, ia1, AuthConf{Type: authTypePSK, PSK: psk}, nil)
+			},
+		},
+		{
+			name:     "ed25519",
+			tagger:   func(t *testing.T) *peer { return newTestAuthPeer(t, ia1, ia2, ed25519Auth(pubB), priA) },
+			verifier: func(t *testing.T) *peer { return newTestAuthPeer(t, ia2, ia1, ed25519Auth(pubA), priB) },
+			expected: true,
+		},
+		{
+			name:     "ed25519 wrong key",
+			tagger:   func(t *testing.T) *peer { return newTestAuthPeer(t, ia1, ia2, ed25519Auth(pubB), priA) },
+			verifier: func(t *testing.T) *peer { return newTestAuthPeer(t, ia2, ia1, ed25519Auth(pubC), priB) },
+		},
+		{
+			name:     "ed25519 signature for another remote",
+			tagger:   func(t *testing.T) *peer { return newTestAuthPeer(t, ia1, ia3, ed25519Auth(pubB), priA) },
+			verifier: func(t *testing.T) *peer { return newTestAuthPeer(t, ia2, ia1, ed25519Auth(pubA), priB) },
+		},
+		{
+			name:     "ed25519 reflected signature",
+			tagger:   func(t *testing.T) *peer { return newTestAuthPeer(t, ia1, ia2, ed25519Auth(pubA), priA) },
+			verifier: func(t *testing.T) *peer { return newTestAuthPeer(t, ia1, ia2, ed25519Auth(pubA), priA) },
+		},
+	}
+	pubKey := []byte("public key")
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tagger, verifier := test.tagger(t), test.verifier(t)
+			taggerAuth, err := tagger.gateway.newAuthenticator(tagger)
+			if err != nil {
+				t.Fatal(err)
+			}
+			verifierAuth, err := verifier.gateway.newAuthenticator(verifier)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tag, err := taggerAuth.Tag(pubKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := verifierAuth.Verify(pubKey, tag); (err == nil) != test.expected {
+				t.Errorf("verified = %t, expected %t (%v)", err == nil, test.expected, err)
+			}
+			if test.expected {
+				if err := verifierAuth.Verify([]byte("other public key"), tag); err == nil {
+					t.Errorf("tag verified for another public key")
+				}
+			}
+		})
+	}
+}
+
+func TestNewAuthenticatorErrors(t *testing.T) {
+	_, key, _ := ed25519.GenerateKey(nil)
+	tests := []struct {
+		name string
+		auth AuthConf
+		key  ed25519.PrivateKey
+	}{
+		{name: "missing psk", auth: AuthConf{Type: authTypePSK}},
+		{name: "invalid psk", auth: AuthConf{Type: authTypePSK, PSK: "not base64!"}},
+		{name: "ed25519 without local key", auth: AuthConf{Type: authTypeEd25519, PublicKey: "AAAA"}},
+		{name: "invalid ed25519 public key", auth: AuthConf{Type: authTypeEd25519, PublicKey: "AAAA"}, key: key},
+		{name: "cert without certificates", auth: AuthConf{Type: authTypeCert}},
+		{name: "unknown type", auth: AuthConf{Type: "password"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			peer := newTestAuthPeer(t, "1-ff00:0:1", "1-ff00:0:2", test.auth, test.key)
+			if _, err := peer.gateway.newAuthenticator(peer); err == nil {
+				t.Error("expected error")
+			}
+		})
+	}
+}
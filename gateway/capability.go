@@ -0,0 +1,181 @@
+/*
+Copyright (c) 2020, ETH and Andrea Tulimiero
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package gateway
+
+import (
+	"fmt"
+	"sort"
+)
+
+const (
+	// protocolVersion is the newest version of the peer protocol spoken by this gateway
+	protocolVersion uint8 = 2
+	// minProtocolVersion is the oldest version of the peer protocol spoken by this gateway
+	minProtocolVersion uint8 = 1
+	// adapterIDVersion is the first protocol version prefixing data packets with the ID of their adapter
+	adapterIDVersion uint8 = 2
+	// multipathSupport tells whether data packets can be received over several paths at the same time
+	multipathSupport = true
+)
+
+// compression identifies the compression applied to data packets
+type compression uint8
+
+const (
+	compressionNone compression = iota
+)
+
+// compressionsByPreference lists the supported compressions from the most to the least preferred one
+var compressionsByPreference = []compression{compressionNone}
+
+func (c compression) String() string {
+	switch c {
+	case compressionNone:
+		return "none"
+	default:
+		return fmt.Sprintf("unknown(%d)", uint8(c))
+	}
+}
+
+// TypedAdapter is implemented by adapters advertising their type to remote gateways during the handshake,
+// the handshake with a remote is rejected if both advertise adapter types and none is in common
+type TypedAdapter interface {
+	AdapterType() string
+}
+
+// capabilities lists the features supported by a gateway, they are advertised in the handshake request
+type capabilities struct {
+	CipherSuites []cipherSuite
+	Compressions []compression
+	Multipath    bool
+	AdapterTypes []string
+}
+
+// negotiatedCaps are the features agreed upon with a peer
+type negotiatedCaps struct {
+	version      uint8
+	suite        cipherSuite
+	compression  compression
+	multipath    bool
+	adapterTypes []string
+}
+
+// localCapabilities returns the capabilities advertised by the gateway
+func (gateway *Gateway) localCapabilities() capabilities {
+	caps := capabilities{
+		CipherSuites: gateway.conf.CipherSuites,
+		Compressions: compressionsByPreference,
+		Multipath:    multipathSupport,
+	}
+	for _, entry := range gateway.adapters {
+		if a, ok := entry.adapter.(TypedAdapter); ok && !containsString(caps.AdapterTypes, a.AdapterType()) {
+			caps.AdapterTypes = append(caps.AdapterTypes, a.AdapterType())
+		}
+	}
+	return caps
+}
+
+// negotiateVersion returns the newest protocol version spoken by both ends
+func negotiateVersion(localMin, localMax, remoteMin, remoteMax uint8) (uint8, error) {
+	version := localMax
+	if remoteMax < version {
+		version = remoteMax
+	}
+	if version < localMin || version < remoteMin {
+		return 0, fmt.Errorf("no common protocol version: local = [%d, %d], remote = [%d, %d]",
+			localMin, localMax, remoteMin, remoteMax)
+	}
+	return version, nil
+}
+
+// negotiateCapabilities returns the highest common denominator of the capabilities of both ends.
+// Like negotiateCipherSuite, the selection is symmetric, hence both peers agree on the result.
+func negotiateCapabilities(localReq, remoteReq *handshakeRequestMsg) (*negotiatedCaps, error) {
+	version, err := negotiateVersion(localReq.MinVersion, localReq.Version, remoteReq.MinVersion, remoteReq.Version)
+	if err != nil {
+		return nil, err
+	}
+	local, remote := localReq.Caps, remoteReq.Caps
+	suite, err := negotiateCipherSuite(local.CipherSuites, remote.CipherSuites)
+	if err != nil {
+		return nil, err
+	}
+	compression, err := negotiateCompression(local.Compressions, remote.Compressions)
+	if err != nil {
+		return nil, err
+	}
+	adapterTypes := intersectStrings(local.AdapterTypes, remote.AdapterTypes)
+	if len(adapterTypes) == 0 && len(local.AdapterTypes) > 0 && len(remote.AdapterTypes) > 0 {
+		return nil, fmt.Errorf("no common adapter type: local = %v, remote = %v",
+			local.AdapterTypes, remote.AdapterTypes)
+	}
+	return &negotiatedCaps{
+		version:      version,
+		suite:        suite,
+		compression:  compression,
+		multipath:    local.Multipath && remote.Multipath,
+		adapterTypes: adapterTypes,
+	}, nil
+}
+
+// negotiateCompression returns the most preferred compression supported by both ends
+func negotiateCompression(local, remote []compression) (compression, error) {
+	contains := func(compressions []compression, c compression) bool {
+		for _, other := range compressions {
+			if other == c {
+				return true
+			}
+		}
+		return false
+	}
+	for _, c := range compressionsByPreference {
+		if contains(local, c) && contains(remote, c) {
+			return c, nil
+		}
+	}
+	return 0, fmt.Errorf("no common compression: local = %v, remote = %v", local, remote)
+}
+
+func containsString(strs []string, s string) bool {
+	for _, other := range strs {
+		if other == s {
+			return true
+		}
+	}
+	return false
+}
+
+// intersectStrings returns the sorted strings contained in both a and b
+func intersectStrings(a, b []string) []string {
+	var res []string
+	for _, s := range a {
+		for _, other := range b {
+			if s == other {
+				res = append(res, s)
+				break
+			}
+		}
+	}
+	sort.Strings(res)
+	return res
+}
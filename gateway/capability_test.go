@@ -0,0 +1,208 @@
+/*
+Copyright (c) 2020, ETH and Andrea Tulimiero
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package gateway
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestNegotiateVersion(t *testing.T) {
+	tests := []struct {
+		name                                     string
+		localMin, localMax, remoteMin, remoteMax uint8
+		expected                                 uint8
+		expectErr                                bool
+	}{
+		{name: "same range", localMin: 1, localMax: 2, remoteMin: 1, remoteMax: 2, expected: 2},
+		{name: "older remote", localMin: 1, localMax: 2, remoteMin: 1, remoteMax: 1, expected: 1},
+		{name: "newer remote", localMin: 1, localMax: 2, remoteMin: 1, remoteMax: 5, expected: 2},
+		{name: "single common version", localMin: 2, localMax: 3, remoteMin: 3, remoteMax: 4, expected: 3},
+		{name: "remote too old", localMin: 2, localMax: 3, remoteMin: 1, remoteMax: 1, expectErr: true},
+		{name: "remote too new", localMin: 1, localMax: 2, remoteMin: 3, remoteMax: 4, expectErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			version, err := negotiateVersion(test.localMin, test.localMax, test.remoteMin, test.remoteMax)
+			if test.expectErr {
+				if err == nil {
+					t.Errorf("expected error, negotiated %d", version)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if version != test.expected {
+				t.Errorf("expected = %d, actual = %d", test.expected, version)
+			}
+			// Negotiation is symmetric
+			if other, err := negotiateVersion(test.remoteMin, test.remoteMax, test.localMin, test.localMax); err != nil ||
+				other != version {
+				t.Errorf("asymmetric negotiation: %d, %d (%v)", version, other, err)
+			}
+		})
+	}
+}
+
+func TestNegotiateCipherSuite(t *testing.T) {
+	tests := []struct {
+		name          string
+		local, remote []cipherSuite
+		expected      cipherSuite
+		expectErr     bool
+	}{
+		{
+			name:     "both suites",
+			local:    []cipherSuite{cipherSuiteAES256GCM, cipherSuiteChaCha20Poly1305},
+			remote:   []cipherSuite{cipherSuiteChaCha20Poly1305, cipherSuiteAES256GCM},
+			expected: cipherSuiteAES256GCM,
+		},
+		{
+			name:     "single common suite",
+			local:    []cipherSuite{cipherSuiteAES256GCM, cipherSuiteChaCha20Poly1305},
+			remote:   []cipherSuite{cipherSuiteChaCha20Poly1305},
+			expected: cipherSuiteChaCha20Poly1305,
+		},
+		{
+			name:     "unknown suites are ignored",
+			local:    []cipherSuite{cipherSuiteChaCha20Poly1305},
+			remote:   []cipherSuite{cipherSuite(99), cipherSuiteChaCha20Poly1305},
+			expected: cipherSuiteChaCha20Poly1305,
+		},
+		{
+			name:      "no common suite",
+			local:     []cipherSuite{cipherSuiteAES256GCM},
+			remote:    []cipherSuite{cipherSuiteChaCha20Poly1305},
+			expectErr: true,
+		},
+		{
+			name:      "no remote suite",
+			local:     []cipherSuite{cipherSuiteAES256GCM},
+			expectErr: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for _, args := range [][2][]cipherSuite{{test.local, test.remote}, {test.remote, test.local}} {
+				suite, err := negotiateCipherSuite(args[0], args[1])
+				if test.expectErr {
+					if err == nil {
+						t.Errorf("expected error, negotiated %s", suite)
+					}
+					continue
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				if suite != test.expected {
+					t.Errorf("expected = %s, actual = %s", test.expected, suite)
+				}
+			}
+		})
+	}
+}
+
+func TestNegotiateCapabilities(t *testing.T) {
+	bothSuites := []cipherSuite{cipherSuiteAES256GCM, cipherSuiteChaCha20Poly1305}
+	request := func(minVersion, version uint8, caps capabilities) *handshakeRequestMsg {
+		if caps.CipherSuites == nil {
+			caps.CipherSuites = bothSuites
+		}
+		if caps.Compressions == nil {
+			caps.Compressions = []compression{compressionNone}
+		}
+		return &handshakeRequestMsg{MinVersion: minVersion, Version: version, Caps: caps}
+	}
+	tests := []struct {
+		name          string
+		local, remote *handshakeRequestMsg
+		expected      *negotiatedCaps
+		expectErr     bool
+	}{
+		{
+			name:   "common features",
+			local:  request(1, 2, capabilities{Multipath: true, AdapterTypes: []string{"ip", "eth"}}),
+			remote: request(1, 2, capabilities{Multipath: true, AdapterTypes: []string{"eth", "ip", "can"}}),
+			expected: &negotiatedCaps{version: 2, suite: cipherSuiteAES256GCM, compression: compressionNone,
+				multipath: true, adapterTypes: []string{"eth", "ip"}},
+		},
+		{
+			name:   "multipath on one end",
+			local:  request(1, 2, capabilities{Multipath: true}),
+			remote: request(1, 1, capabilities{CipherSuites: []cipherSuite{cipherSuiteChaCha20Poly1305}}),
+			expected: &negotiatedCaps{version: 1, suite: cipherSuiteChaCha20Poly1305,
+				compression: compressionNone},
+		},
+		{
+			name:   "adapter types advertised by one end",
+			local:  request(1, 2, capabilities{AdapterTypes: []string{"ip"}}),
+			remote: request(1, 2, capabilities{}),
+			expected: &negotiatedCaps{version: 2, suite: cipherSuiteAES256GCM,
+				compression: compressionNone},
+		},
+		{
+			name:      "no common adapter type",
+			local:     request(1, 2, capabilities{AdapterTypes: []string{"ip"}}),
+			remote:    request(1, 2, capabilities{AdapterTypes: []string{"eth"}}),
+			expectErr: true,
+		},
+		{
+			name:      "no common version",
+			local:     request(2, 2, capabilities{}),
+			remote:    request(1, 1, capabilities{}),
+			expectErr: true,
+		},
+		{
+			name:      "no common cipher suite",
+			local:     request(1, 2, capabilities{CipherSuites: []cipherSuite{cipherSuiteAES256GCM}}),
+			remote:    request(1, 2, capabilities{CipherSuites: []cipherSuite{cipherSuiteChaCha20Poly1305}}),
+			expectErr: true,
+		},
+		{
+			name:      "no common compression",
+			local:     request(1, 2, capabilities{}),
+			remote:    request(1, 2, capabilities{Compressions: []compression{compression(7)}}),
+			expectErr: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for _, args := range [][2]*handshakeRequestMsg{{test.local, test.remote}, {test.remote, test.local}} {
+				caps, err := negotiateCapabilities(args[0], args[1])
+				if test.expectErr {
+					if err == nil {
+						t.Errorf("expected error, negotiated %+v", caps)
+					}
+					continue
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !reflect.DeepEqual(caps, test.expected) {
+					t.Errorf("expected = %+v, actual = %+v", test.expected, caps)
+				}
+			}
+		})
+	}
+}
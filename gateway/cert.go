@@ -0,0 +1,210 @@
+/*
+Copyright (c) 2020, ETH and Andrea Tulimiero
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package gateway
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/scionproto/scion/go/lib/addr"
+	"github.com/scionproto/scion/go/lib/log"
+	"github.com/scionproto/scion/go/lib/scrypto"
+	"github.com/scionproto/scion/go/lib/scrypto/cert"
+	"github.com/scionproto/scion/go/lib/scrypto/trc"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	authTypeCert = "cert"
+)
+
+type certConf struct {
+	// ChainPath is the path of the certificate chain of the AS of the gateway
+	ChainPath string `yaml:"chainPath"`
+	// KeyPath is the path of the base64 encoded signing key of the AS certificate
+	KeyPath string `yaml:"keyPath"`
+	// TRCDir is the directory with the TRCs (*.trc) used to validate the certificate chains of remotes
+	TRCDir string `yaml:"trcDir"`
+}
+
+// chainAuthenticator is implemented by Authenticators which need a certificate chain to travel with the handshake
+type chainAuthenticator interface {
+	Authenticator
+	// CertChain returns the raw certificate chain to be sent to the remote
+	CertChain() []byte
+	// VerifyWithChain checks the authentication tag of a remote public key against the certificate chain of the remote
+	VerifyWithChain(chain, pubKey, tag []byte) error
+}
+
+// certStore keeps the local certificate chain, signing key, and the TRCs trusted by the gateway
+type certStore struct {
+	rawChain []byte
+	signKey  []byte
+	signAlgo string
+	trcs     map[addr.ISD]*trc.TRC
+}
+
+// loadCertStore loads the material configured in conf, the TRCs are verified offline and never fetched
+func loadCertStore(conf certConf) (*certStore, error) {
+	rawChain, err := ioutil.ReadFile(conf.ChainPath)
+	if err != nil {
+		return nil, fmt.Errorf("error loading certificate chain: %s", err)
+	}
+	var chain cert.Chain
+	if err := json.Unmarshal(rawChain, &chain); err != nil {
+		return nil, fmt.Errorf("error parsing certificate chain: %s", err)
+	}
+	as, err := chain.AS.Encoded.Decode()
+	if err != nil {
+		return nil, fmt.Errorf("error decoding AS certificate: %s", err)
+	}
+	signKeyMeta, ok := as.Keys[cert.SigningKey]
+	if !ok {
+		return nil, fmt.Errorf("AS certificate has no signing key")
+	}
+	rawKey, err := ioutil.ReadFile(conf.KeyPath)
+	if err != nil {
+		return nil, fmt.Errorf("error loading signing key: %s", err)
+	}
+	signKey, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(rawKey)))
+	if err != nil {
+		return nil, fmt.Errorf("error decoding signing key: %s", err)
+	}
+	store := &certStore{
+		rawChain: rawChain,
+		signKey:  signKey,
+		signAlgo: signKeyMeta.Algorithm,
+		trcs:     make(map[addr.ISD]*trc.TRC),
+	}
+	if err := store.loadTRCs(conf.TRCDir); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// loadTRCs loads the latest TRC of each ISD found in dir
+func (s *certStore) loadTRCs(dir string) error {
+	files, err := filepath.Glob(filepath.Join(dir, "*.trc"))
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		raw, err := ioutil.ReadFile(file)
+		if err != nil {
+			return fmt.Errorf("error loading TRC %s: %s", file, err)
+		}
+		signed, err := trc.ParseSigned(raw)
+		if err != nil {
+			return fmt.Errorf("error parsing TRC %s: %s", file, err)
+		}
+		t, err := signed.EncodedTRC.Decode()
+		if err != nil {
+			return fmt.Errorf("error decoding TRC %s: %s", file, err)
+		}
+		if other, ok := s.trcs[t.ISD]; ok && other.Version >= t.Version {
+			continue
+		}
+		s.trcs[t.ISD] = t
+	}
+	if len(s.trcs) == 0 {
+		return fmt.Errorf("no TRCs found in %s", dir)
+	}
+	log.Debug("Loaded TRCs", "dir", dir, "isds", len(s.trcs))
+	return nil
+}
+
+// verifyChain validates a certificate chain of subject against the trusted TRCs and returns the AS certificate
+func (s *certStore) verifyChain(rawChain []byte, subject addr.IA) (*cert.AS, error) {
+	var chain cert.Chain
+	if err := json.Unmarshal(rawChain, &chain); err != nil {
+		return nil, fmt.Errorf("error parsing certificate chain: %s", err)
+	}
+	issuer, err := chain.Issuer.Encoded.Decode()
+	if err != nil {
+		return nil, fmt.Errorf("error decoding issuer certificate: %s", err)
+	}
+	as, err := chain.AS.Encoded.Decode()
+	if err != nil {
+		return nil, fmt.Errorf("error decoding AS certificate: %s", err)
+	}
+	if !as.Subject.Equal(subject) {
+		return nil, fmt.Errorf("certificate subject mismatch: expected = %s, actual = %s", subject, as.Subject)
+	}
+	now := time.Now()
+	if !as.Validity.Contains(now) || !issuer.Validity.Contains(now) {
+		return nil, fmt.Errorf("certificate chain not valid at %s", now)
+	}
+	t, ok := s.trcs[issuer.Subject.I]
+	if !ok {
+		return nil, fmt.Errorf("no trusted TRC for ISD %d", issuer.Subject.I)
+	}
+	issuerVerifier := cert.IssuerVerifier{TRC: t, Issuer: issuer, SignedIssuer: &chain.Issuer}
+	if err := issuerVerifier.Verify(); err != nil {
+		return nil, fmt.Errorf("error verifying issuer certificate: %s", err)
+	}
+	asVerifier := cert.ASVerifier{Issuer: issuer, AS: as, SignedAS: &chain.AS}
+	if err := asVerifier.Verify(); err != nil {
+		return nil, fmt.Errorf("error verifying AS certificate: %s", err)
+	}
+	return as, nil
+}
+
+// certAuthenticator authenticates public keys with signatures of the AS signing keys, certified by the TRCs
+type certAuthenticator struct {
+	store *certStore
+	peer  *peer
+}
+
+var _ chainAuthenticator = (*certAuthenticator)(nil)
+
+func (a *certAuthenticator) Tag(pubKey []byte) ([]byte, error) {
+	msg := append(authContext(authTypeCert, a.peer, true), pubKey...)
+	return scrypto.Sign(msg, a.store.signKey, a.store.signAlgo)
+}
+
+func (a *certAuthenticator) Verify(pubKey, tag []byte) error {
+	return fmt.Errorf("certificate chain of the remote required")
+}
+
+func (a *certAuthenticator) CertChain() []byte {
+	return a.store.rawChain
+}
+
+func (a *certAuthenticator) VerifyWithChain(chain, pubKey, tag []byte) error {
+	as, err := a.store.verifyChain(chain, a.peer.remoteAddr().IA)
+	if err != nil {
+		return err
+	}
+	verifyKeyMeta, ok := as.Keys[cert.SigningKey]
+	if !ok {
+		return fmt.Errorf("AS certificate has no signing key")
+	}
+	msg := append(authContext(authTypeCert, a.peer, false), pubKey...)
+	if err := scrypto.Verify(msg, tag, verifyKeyMeta.Key, verifyKeyMeta.Algorithm); err != nil {
+		return fmt.Errorf("invalid public key signature: %s", err)
+	}
+	return nil
+}
@@ -0,0 +1,239 @@
+/*
+Copyright (c) 2020, ETH and Andrea Tulimiero
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package gateway
+
+import (
+	"encoding/json"
+	"github.com/scionproto/scion/go/lib/addr"
+	"github.com/scionproto/scion/go/lib/scrypto"
+	"github.com/scionproto/scion/go/lib/scrypto/cert"
+	"github.com/scionproto/scion/go/lib/scrypto/trc"
+	"github.com/scionproto/scion/go/lib/util"
+	"testing"
+	"time"
+)
+
+// testPKI is an ISD whose single issuing AS certifies the AS certificates of gateways
+type testPKI struct {
+	trc          *trc.TRC
+	signedIssuer cert.SignedIssuer
+	issuer       *cert.Issuer
+	issuingKey   []byte
+}
+
+func newTestValidity(notBefore, notAfter time.Time) *scrypto.Validity {
+	return &scrypto.Validity{NotBefore: util.UnixTime{Time: notBefore}, NotAfter: util.UnixTime{Time: notAfter}}
+}
+
+func mustIA(t *testing.T, s string) addr.IA {
+	ia, err := addr.IAFromString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ia
+}
+
+func newTestPKI(t *testing.T, issuerIA addr.IA) *testPKI {
+	grantPub, grantPriv, err := scrypto.GenKeyPair(scrypto.Ed25519)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issuingPub, issuingPriv, err := scrypto.GenKeyPair(scrypto.Ed25519)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().Truncate(time.Second)
+	pki := &testPKI{issuingKey: issuingPriv}
+	pki.trc = &trc.TRC{ISD: issuerIA.I, Version: 1, Validity: newTestValidity(now.Add(-time.Hour), now.Add(time.Hour)),
+		PrimaryASes: trc.PrimaryASes{issuerIA.A: trc.PrimaryAS{
+			Attributes: trc.Attributes{trc.Issuing},
+			Keys: map[trc.KeyType]scrypto.KeyMeta{
+				trc.IssuingGrantKey: {KeyVersion: 1, Algorithm: scrypto.Ed25519, Key: grantPub},
+			},
+		}},
+	}
+	pki.issuer = &cert.Issuer{
+		Base: cert.Base{Subject: issuerIA, Version: 1, FormatVersion: 1, Description: "test issuer",
+			OptionalDistributionPoints: []addr.IA{}, Validity: pki.trc.Validity,
+			Keys: map[cert.KeyType]scrypto.KeyMeta{
+				cert.IssuingKey: {KeyVersion: 1, Algorithm: scrypto.Ed25519, Key: issuingPub},
+			},
+		},
+		Issuer: cert.IssuerTRC{TRCVersion: 1},
+	}
+	if pki.signedIssuer.Encoded, err = cert.EncodeIssuer(pki.issuer); err != nil {
+		t.Fatal(err)
+	}
+	protected := cert.ProtectedIssuer{Algorithm: scrypto.Ed25519, TRCVersion: 1}
+	if pki.signedIssuer.EncodedProtected, err = cert.EncodeProtectedIssuer(protected); err != nil {
+		t.Fatal(err)
+	}
+	pki.signedIssuer.Signature, err = scrypto.Sign(pki.signedIssuer.SigInput(), grantPriv, scrypto.Ed25519)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pki
+}
+
+// newChain returns a certificate chain of subject valid during validity, and the signing key it certifies
+func (pki *testPKI) newChain(t *testing.T, subject addr.IA, validity *scrypto.Validity) ([]byte, []byte) {
+	signPub, signPriv, err := scrypto.GenKeyPair(scrypto.Ed25519)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encPub, _, err := scrypto.GenKeyPair(scrypto.Curve25519xSalsa20Poly1305)
+	if err != nil {
+		t.Fatal(err)
+	}
+	as := &cert.AS{
+		Base: cert.Base{Subject: subject, Version: 1, FormatVersion: 1, Description: "test AS",
+			OptionalDistributionPoints: []addr.IA{}, Validity: validity,
+			Keys: map[cert.KeyType]scrypto.KeyMeta{
+				cert.SigningKey:    {KeyVersion: 1, Algorithm: scrypto.Ed25519, Key: signPub},
+				cert.EncryptionKey: {KeyVersion: 1, Algorithm: scrypto.Curve25519xSalsa20Poly1305, Key: encPub},
+			},
+		},
+		Issuer: cert.IssuerCertID{IA: pki.issuer.Subject, CertificateVersion: 1},
+	}
+	chain := cert.Chain{Issuer: pki.signedIssuer}
+	if chain.AS.Encoded, err = cert.EncodeAS(as); err != nil {
+		t.Fatal(err)
+	}
+	protected := cert.ProtectedAS{Algorithm: scrypto.Ed25519, CertificateVersion: 1, IA: pki.issuer.Subject}
+	if chain.AS.EncodedProtected, err = cert.EncodeProtectedAS(protected); err != nil {
+		t.Fatal(err)
+	}
+	if chain.AS.Signature, err = scrypto.Sign(chain.AS.SigInput(), pki.issuingKey, scrypto.Ed25519); err != nil {
+		t.Fatal(err)
+	}
+	raw, err := json.Marshal(chain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return raw, signPriv
+}
+
+// newTestCertStore returns the certStore of a gateway holding chain, trusting the TRCs of pkis
+func newTestCertStore(chain, signKey []byte, pkis ...*testPKI) *certStore {
+	store := &certStore{rawChain: chain, signKey: signKey, signAlgo: scrypto.Ed25519, trcs: make(map[addr.ISD]*trc.TRC)}
+	for _, pki := range pkis {
+		store.trcs[pki.trc.ISD] = pki.trc
+	}
+	return store
+}
+
+func TestCertAuthenticator(t *testing.T) {
+	localIA, remoteIA, issuerIA := mustIA(t, "1-ff00:0:1"), mustIA(t, "1-ff00:0:2"), mustIA(t, "1-ff00:0:110")
+	pki, otherPKI := newTestPKI(t, issuerIA), newTestPKI(t, issuerIA)
+	now := time.Now().Truncate(time.Second)
+	valid, expired := newTestValidity(now.Add(-time.Minute), now.Add(time.Minute)),
+		newTestValidity(now.Add(-time.Hour), now.Add(-time.Minute))
+	tests := []struct {
+		name string
+		// remoteChain returns the chain and signing key of the remote
+		remoteChain func(t *testing.T) ([]byte, []byte)
+		// trusted are the PKIs trusted by the local gateway
+		trusted  []*testPKI
+		expected bool
+	}{
+		{
+			name:        "valid chain",
+			remoteChain: func(t *testing.T) ([]byte, []byte) { return pki.newChain(t, remoteIA, valid) },
+			trusted:     []*testPKI{pki},
+			expected:    true,
+		},
+		{
+			name:        "chain of another AS",
+			remoteChain: func(t *testing.T) ([]byte, []byte) { return pki.newChain(t, mustIA(t, "1-ff00:0:3"), valid) },
+			trusted:     []*testPKI{pki},
+		},
+		{
+			name:        "expired chain",
+			remoteChain: func(t *testing.T) ([]byte, []byte) { return pki.newChain(t, remoteIA, expired) },
+			trusted:     []*testPKI{pki},
+		},
+		{
+			name:        "untrusted ISD",
+			remoteChain: func(t *testing.T) ([]byte, []byte) { return pki.newChain(t, remoteIA, valid) },
+		},
+		{
+			name:        "issuer not certified by the TRC",
+			remoteChain: func(t *testing.T) ([]byte, []byte) { return otherPKI.newChain(t, remoteIA, valid) },
+			trusted:     []*testPKI{pki},
+		},
+		{
+			name: "key not certified by the chain",
+			remoteChain: func(t *testing.T) ([]byte, []byte) {
+				chain, _ := pki.newChain(t, remoteIA, valid)
+				_, signKey := pki.newChain(t, remoteIA, valid)
+				return chain, signKey
+			},
+			trusted: []*testPKI{pki},
+		},
+		{
+			name: "malformed chain",
+			remoteChain: func(t *testing.T) ([]byte, []byte) {
+				_, key := pki.newChain(t, remoteIA, valid)
+				return []byte("{}"), key
+			},
+			trusted: []*testPKI{pki},
+		},
+	}
+	pubKey := []byte("public key")
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			remoteChain, remoteKey := test.remoteChain(t)
+			tagger := newTestAuthPeer(t, remoteIA.String(), localIA.String(), AuthConf{Type: authTypeCert}, nil)
+			tagger.gateway.certStore = newTestCertStore(remoteChain, remoteKey, pki)
+			verifier := newTestAuthPeer(t, localIA.String(), remoteIA.String(), AuthConf{Type: authTypeCert}, nil)
+			localChain, localKey := pki.newChain(t, localIA, valid)
+			verifier.gateway.certStore = newTestCertStore(localChain, localKey, test.trusted...)
+
+			taggerAuth, err := tagger.gateway.newAuthenticator(tagger)
+			if err != nil {
+				t.Fatal(err)
+			}
+			verifierAuth, err := verifier.gateway.newAuthenticator(verifier)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tag, err := taggerAuth.Tag(pubKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+			a := verifierAuth.(chainAuthenticator)
+			err = a.VerifyWithChain(taggerAuth.(chainAuthenticator).CertChain(), pubKey, tag)
+			if (err == nil) != test.expected {
+				t.Errorf("verified = %t, expected %t (%v)", err == nil, test.expected, err)
+			}
+			if err := a.Verify(pubKey, tag); err == nil {
+				t.Errorf("verified without certificate chain")
+			}
+			if test.expected {
+				if err := a.VerifyWithChain(remoteChain, []byte("other public key"), tag); err == nil {
+					t.Errorf("tag verified for another public key")
+				}
+			}
+		})
+	}
+}
@@ -24,7 +24,9 @@ package gateway
 
 import (
 	"flag"
+	"fmt"
 	"github.com/scionproto/scion/go/lib/sciond"
+	"gopkg.in/yaml.v2"
 	"time"
 )
 
@@ -32,18 +34,123 @@ const (
 	useWorkerMemPool       = true
 	handshakeRetryInterval = 1 * time.Second
 	pathRefreshInterval    = 15 * time.Second
+	rekeyRetryInterval     = 1 * time.Second
+	rekeyMaxRetries        = 10
+	// nextSessionTimeout is the time after which the remote gave up on a rekey whose response it did not receive
+	nextSessionTimeout = rekeyRetryInterval * (rekeyMaxRetries + 1)
+	// reliableRetransmitInterval is the first retransmission interval of reliable ctrl messages,
+	// it doubles at every retransmission up to reliableMaxRetransmitInterval
+	reliableRetransmitInterval    = 200 * time.Millisecond
+	reliableMaxRetransmitInterval = 5 * time.Second
+	reliableMaxRetries            = 10
+	// reliableReorderLimit is the number of out of order reliable ctrl messages buffered per peer
+	reliableReorderLimit = 64
+	// rpcDefaultTimeout bounds the calls without a deadline, and the delivery of their responses
+	rpcDefaultTimeout = 10 * time.Second
+	// rpcMaxConcurrentRequests bounds the requests of a remote handled at the same time
+	rpcMaxConcurrentRequests = 16
+	// reassemblyTimeout, reassemblyMemLimit, and reassemblyMaxPending bound the fragments of ctrl messages
+	// buffered per peer
+	reassemblyTimeout    = 5 * time.Second
+	reassemblyMemLimit   = 1 << 20
+	reassemblyMaxPending = 32
+	// acceptReassemblyMemLimit bounds the fragments of handshake messages buffered per remote
+	acceptReassemblyMemLimit = 128 << 10
+	// inboundCollectInterval is the interval between checks of idle inbound peers
+	inboundCollectInterval = 10 * time.Second
+	// shutdownTimeout bounds the time given to Run to stop the gateway
+	shutdownTimeout = 5 * time.Second
 )
 
 var (
 	dispatcher     = flag.String("dispatcher", "", "Path to dispatcher socket")
 	sciondAddr     = flag.String("sciond", sciond.DefaultSCIONDAddress, "SCIOND address")
 	hiddenFailover = flag.Bool("hiddenFailover", false, "[TEST] force failover over hidden path")
+	gobCompat      = flag.Bool("gobCompat", false, "Also accept gob encoded messages from gateways of older versions")
 )
 
 type conf struct {
 	// Address is the full address of the gateway, including the IP and Port at which it will listen for connections
 	Address         YUDPAddr
 	AdapterConfPath string `yaml:"adapterConfPath"`
-	Remotes         []connConf
-	Pathing         pathingConf
+	// Adapters lists the adapters of the gateway, in place of AdapterConfPath
+	Adapters []AdapterConf
+	Remotes  []ConnConf
+	Pathing  pathingConf
+	// PathPolicies maps names to the path policies that can be selected in the pathing configuration
+	PathPolicies map[string]pathPolicyConf `yaml:"pathPolicies"`
+	// CipherSuites lists the cipher suites that can be negotiated with peers
+	CipherSuites []cipherSuite `yaml:"cipherSuites"`
+	Rekey        rekeyConf
+	// Ed25519KeyPath is the path of the file with the base64 encoded Ed25519 private key of the gateway,
+	// it is required by remotes authenticated with ed25519
+	Ed25519KeyPath string `yaml:"ed25519KeyPath"`
+	// Certificate configures the AS certificate and TRCs, it is required by remotes authenticated with cert
+	Certificate certConf
+	// Inbound configures the acceptance of handshakes from remotes that are not configured
+	Inbound inboundConf
+}
+
+// parseConf parses a gateway configuration, using the defaults for the missing values
+func parseConf(confBuf []byte) (conf, error) {
+	c := conf{
+		Pathing:      defaultPathingConf,
+		CipherSuites: cipherSuitesByPreference,
+		Rekey:        defaultRekeyConf,
+		Inbound:      defaultInboundConf,
+	}
+	if err := yaml.UnmarshalStrict(confBuf, &c); err != nil {
+		return conf{}, err
+	}
+	if len(c.CipherSuites) == 0 {
+		return conf{}, fmt.Errorf("at least one cipher suite must be enabled")
+	}
+	if len(c.Adapters) > 0 && c.AdapterConfPath != "" {
+		return conf{}, fmt.Errorf("adapterConfPath and adapters cannot be set at the same time")
+	}
+	adapterIDs := make(map[AdapterID]bool)
+	for _, a := range c.Adapters {
+		if adapterIDs[a.ID] {
+			return conf{}, fmt.Errorf("duplicate adapter ID: %d", a.ID)
+		}
+		adapterIDs[a.ID] = true
+	}
+	if _, err := c.pathingFor(ConnConf{}); err != nil {
+		return conf{}, err
+	}
+	for _, remote := range c.Remotes {
+		if _, err := c.pathingFor(remote); err != nil {
+			return conf{}, fmt.Errorf("invalid pathing of remote %s: %s", remote.Address.IA, err)
+		}
+	}
+	return c, nil
+}
+
+// pathingFor returns the pathing configuration of a remote, i.e., the global one with the overrides of the remote
+func (c *conf) pathingFor(remote ConnConf) (*pathingConf, error) {
+	pathing := c.Pathing
+	remote.Pathing.apply(&pathing)
+	if pathing.KeepAliveInterval <= 0 || pathing.KeepAliveTimeoutInterval <= 0 {
+		return nil, fmt.Errorf("keepalive intervals must be positive")
+	}
+	if pathing.BackupPaths < 0 || pathing.BackupProbeInterval <= 0 {
+		return nil, fmt.Errorf("backup paths must not be negative and backup probe interval must be positive")
+	}
+	if pathing.FailbackHoldDown < 0 {
+		return nil, fmt.Errorf("fail-back hold-down must not be negative")
+	}
+	var err error
+	if pathing.sorter, err = lookupPathSorter(pathing.Sorter); err != nil {
+		return nil, err
+	}
+	if pathing.Policy != "" {
+		policyConf, ok := c.PathPolicies[pathing.Policy]
+		if !ok {
+			return nil, fmt.Errorf("unknown path policy: %s", pathing.Policy)
+		}
+		if pathing.policy, err = newPathPolicy(policyConf); err != nil {
+			return nil, err
+		}
+	}
+	return &pathing, nil
 }
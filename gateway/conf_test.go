@@ -0,0 +1,104 @@
+/*
+Copyright (c) 2020, ETH and Andrea Tulimiero
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package gateway
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPathingFor(t *testing.T) {
+	global := `
+address: "1-ff00:0:1,[127.0.0.1]:30041"
+pathing:
+  keepAliveTimeout: 1s
+  backupPaths: 3
+pathPolicies:
+  noISD2:
+    acl: ["- 2", "+"]
+`
+	durationOf := func(s string) *time.Duration {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &d
+	}
+	stringOf := func(s string) *string { return &s }
+	intOf := func(i int) *int { return &i }
+	tests := []struct {
+		name      string
+		overrides *pathingOverrides
+		check     func(*pathingConf) bool
+		err       bool
+	}{
+		{
+			name: "inherited",
+			check: func(c *pathingConf) bool {
+				return c.KeepAliveTimeout == time.Second && c.BackupPaths == 3 &&
+					c.KeepAliveInterval == defaultKeepAliveInterval && c.sorter != nil && c.policy == nil
+			},
+		},
+		{
+			name:      "overridden",
+			overrides: &pathingOverrides{KeepAliveTimeout: durationOf("2s"), BackupPaths: intOf(0)},
+			check: func(c *pathingConf) bool {
+				return c.KeepAliveTimeout == 2*time.Second && c.BackupPaths == 0 &&
+					c.KeepAliveInterval == defaultKeepAliveInterval
+			},
+		},
+		{
+			name:      "sorter and policy",
+			overrides: &pathingOverrides{Sorter: stringOf("lowestRTT"), Policy: stringOf("noISD2")},
+			check: func(c *pathingConf) bool {
+				return c.Sorter == "lowestRTT" && c.sorter != nil && c.policy != nil
+			},
+		},
+		{name: "unknown sorter", overrides: &pathingOverrides{Sorter: stringOf("fastest")}, err: true},
+		{name: "unknown policy", overrides: &pathingOverrides{Policy: stringOf("noISD3")}, err: true},
+		{name: "keepalive interval", overrides: &pathingOverrides{KeepAliveInterval: durationOf("0s")}, err: true},
+		{name: "backup paths", overrides: &pathingOverrides{BackupPaths: intOf(-1)}, err: true},
+		{name: "hold-down", overrides: &pathingOverrides{FailbackHoldDown: durationOf("-1s")}, err: true},
+	}
+	c, err := parseConf([]byte(global))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pathing, err := c.pathingFor(ConnConf{Address: c.Address, Pathing: test.overrides})
+			if test.err {
+				if err == nil {
+					t.Error("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !test.check(pathing) {
+				t.Errorf("unexpected configuration: %+v", pathing)
+			}
+		})
+	}
+}
@@ -26,9 +26,122 @@ import (
 	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
 	"github.com/aead/cmac"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+	"io"
 )
 
+const (
+	// sessionKeyLen is the length of the keys derived for the AEADs of all cipher suites
+	sessionKeyLen = 32
+)
+
+// cipherSuite identifies the AEAD used to protect packets exchanged with a peer
+type cipherSuite uint8
+
+const (
+	cipherSuiteAES256GCM cipherSuite = iota + 1
+	cipherSuiteChaCha20Poly1305
+)
+
+var (
+	// cipherSuitesByPreference lists the supported cipher suites from the most to the least preferred one
+	cipherSuitesByPreference = []cipherSuite{cipherSuiteAES256GCM, cipherSuiteChaCha20Poly1305}
+	cipherSuiteNames         = map[cipherSuite]string{
+		cipherSuiteAES256GCM:        "aes-256-gcm",
+		cipherSuiteChaCha20Poly1305: "chacha20-poly1305",
+	}
+)
+
+func (s cipherSuite) String() string {
+	if name, ok := cipherSuiteNames[s]; ok {
+		return name
+	}
+	return fmt.Sprintf("unknown(%d)", uint8(s))
+}
+
+func (s *cipherSuite) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var name string
+	err := unmarshal(&name)
+	if err != nil {
+		return err
+	}
+	for suite, suiteName := range cipherSuiteNames {
+		if suiteName == name {
+			*s = suite
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown cipher suite: %s", name)
+}
+
+// newAEAD returns the AEAD of the cipher suite keyed with key
+func (s cipherSuite) newAEAD(key []byte) (cipher.AEAD, error) {
+	switch s {
+	case cipherSuiteAES256GCM:
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		return cipher.NewGCM(block)
+	case cipherSuiteChaCha20Poly1305:
+		return chacha20poly1305.New(key)
+	default:
+		return nil, fmt.Errorf("unsupported cipher suite: %s", s)
+	}
+}
+
+// negotiateCipherSuite returns the most preferred cipher suite enabled on both ends.
+// Both peers run the same selection, hence they agree on the result without further messages.
+func negotiateCipherSuite(local, remote []cipherSuite) (cipherSuite, error) {
+	contains := func(suites []cipherSuite, suite cipherSuite) bool {
+		for _, s := range suites {
+			if s == suite {
+				return true
+			}
+		}
+		return false
+	}
+	for _, suite := range cipherSuitesByPreference {
+		if contains(local, suite) && contains(remote, suite) {
+			return suite, nil
+		}
+	}
+	return 0, fmt.Errorf("no common cipher suite: local = %v, remote = %v", local, remote)
+}
+
+// newX25519KeyPair returns a fresh X25519 private/public key pair
+func newX25519KeyPair() ([]byte, []byte, error) {
+	priKey := make([]byte, curve25519.ScalarSize)
+	if _, err := rand.Read(priKey); err != nil {
+		return nil, nil, err
+	}
+	pubKey, err := curve25519.X25519(priKey, curve25519.Basepoint)
+	if err != nil {
+		return nil, nil, err
+	}
+	return priKey, pubKey, nil
+}
+
+// computeSharedSecret completes an X25519 key exchange, rejecting low order remote public keys
+func computeSharedSecret(priKey, remotePubKey []byte) ([]byte, error) {
+	return curve25519.X25519(priKey, remotePubKey)
+}
+
+// deriveKey derives a key from secret using HKDF-SHA256, salted with salt and bound to the label
+func deriveKey(secret, salt []byte, label string, keyLen int) ([]byte, error) {
+	key := make([]byte, keyLen)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, secret, salt, []byte(label)), key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
 // getCMAC returns the CMAC of buf using AES-256 keyed with key
 func getCMAC(buf []byte, key []byte) ([]byte, error) {
 	c, err := aes.NewCipher(key)
@@ -0,0 +1,135 @@
+/*
+Copyright (c) 2020, ETH and Andrea Tulimiero
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package gateway
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestCipherSuiteAEAD(t *testing.T) {
+	key := bytes.Repeat([]byte{0x42}, sessionKeyLen)
+	otherKey := bytes.Repeat([]byte{0x24}, sessionKeyLen)
+	plaintext, hdr := []byte("payload"), []byte{0, 0, 0, 0, 0, 0, 0, 0, 1}
+	for _, suite := range cipherSuitesByPreference {
+		t.Run(suite.String(), func(t *testing.T) {
+			sendAEAD, err := suite.newAEAD(key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			recvAEAD, err := suite.newAEAD(key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			otherAEAD, err := suite.newAEAD(otherKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if sendAEAD.NonceSize() != nonceLen {
+				t.Fatalf("nonce size = %d, expected %d", sendAEAD.NonceSize(), nonceLen)
+			}
+			sealed := sendAEAD.Seal(nil, buildNonce(1), plaintext, hdr)
+			if len(sealed) != len(plaintext)+sendAEAD.Overhead() {
+				t.Errorf("sealed length = %d, expected %d", len(sealed), len(plaintext)+sendAEAD.Overhead())
+			}
+			opened, err := recvAEAD.Open(nil, buildNonce(1), sealed, hdr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(opened, plaintext) {
+				t.Errorf("opened = %q, expected %q", opened, plaintext)
+			}
+
+			tampered := append([]byte(nil), sealed...)
+			tampered[0] ^= 1
+			tamperedHdr := append([]byte(nil), hdr...)
+			tamperedHdr[0] ^= 1
+			rejected := []struct {
+				name string
+				open func() ([]byte, error)
+			}{
+				{"tampered ciphertext", func() ([]byte, error) { return recvAEAD.Open(nil, buildNonce(1), tampered, hdr) }},
+				{"tampered header", func() ([]byte, error) { return recvAEAD.Open(nil, buildNonce(1), sealed, tamperedHdr) }},
+				{"wrong nonce", func() ([]byte, error) { return recvAEAD.Open(nil, buildNonce(2), sealed, hdr) }},
+				{"wrong key", func() ([]byte, error) { return otherAEAD.Open(nil, buildNonce(1), sealed, hdr) }},
+			}
+			for _, r := range rejected {
+				if _, err := r.open(); err == nil {
+					t.Errorf("%s: expected authentication failure", r.name)
+				}
+			}
+		})
+	}
+}
+
+func TestCipherSuiteNewAEADErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		suite cipherSuite
+		key   []byte
+	}{
+		{"unknown suite", cipherSuite(0), make([]byte, sessionKeyLen)},
+		{"short aes key", cipherSuiteAES256GCM, make([]byte, 7)},
+		{"short chacha20 key", cipherSuiteChaCha20Poly1305, make([]byte, sessionKeyLen-1)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := test.suite.newAEAD(test.key); err == nil {
+				t.Error("expected error")
+			}
+		})
+	}
+}
+
+func TestCipherSuiteUnmarshalYAML(t *testing.T) {
+	tests := []struct {
+		name      string
+		expected  cipherSuite
+		expectErr bool
+	}{
+		{name: "aes-256-gcm", expected: cipherSuiteAES256GCM},
+		{name: "chacha20-poly1305", expected: cipherSuiteChaCha20Poly1305},
+		{name: "aes-128-cbc", expectErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var suite cipherSuite
+			err := suite.UnmarshalYAML(func(v interface{}) error {
+				*v.(*string) = test.name
+				return nil
+			})
+			if test.expectErr {
+				if err == nil {
+					t.Errorf("expected error, got %s", suite)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if suite != test.expected {
+				t.Errorf("expected = %s, actual = %s", test.expected, suite)
+			}
+		})
+	}
+}
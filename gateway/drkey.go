@@ -24,6 +24,9 @@ package gateway
 
 import (
 	"context"
+	"crypto/aes"
+	"fmt"
+	"github.com/aead/cmac"
 	"github.com/scionproto/scion/go/lib/addr"
 	"time"
 
@@ -32,6 +35,9 @@ import (
 	"github.com/JordiSubira/drkeymockup/mockupsciond"
 )
 
+var _ Authenticator = (*drkeyMgr)(nil)
+
+// drkeyMgr authenticates public keys with a CMAC keyed with the DRKey shared by the two hosts
 type drkeyMgr struct {
 	peer                   *peer
 	metaClient, metaServer drkey.Lvl2Meta
@@ -116,3 +122,28 @@ func (m *drkeyMgr) serverHostKey() ([]byte, error) {
 	}
 	return drkey.Key, nil
 }
+
+// Tag returns the CMAC of pubKey keyed with the client host key
+func (m *drkeyMgr) Tag(pubKey []byte) ([]byte, error) {
+	hostKey, err := m.clientHostKey()
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving DRKey: %s", err)
+	}
+	return getCMAC(pubKey, hostKey)
+}
+
+// Verify checks that tag is the CMAC of pubKey keyed with the server host key
+func (m *drkeyMgr) Verify(pubKey, tag []byte) error {
+	hostKey, err := m.serverHostKey()
+	if err != nil {
+		return fmt.Errorf("error retrieving server host key: %s", err)
+	}
+	c, err := aes.NewCipher(hostKey)
+	if err != nil {
+		return err
+	}
+	if !cmac.Verify(tag, pubKey, c, len(hostKey)) {
+		return fmt.Errorf("public key authentication tag is not as expected")
+	}
+	return nil
+}
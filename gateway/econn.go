@@ -23,72 +23,146 @@ SOFTWARE.
 package gateway
 
 import (
-	"bytes"
-	"crypto/aes"
-	"crypto/cipher"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"github.com/scionproto/scion/go/lib/snet"
 	"net"
+	"sync/atomic"
+)
+
+const (
+	// pktHdrLen is the length of the header prepended to each encrypted packet
+	pktHdrLen = 9
 )
 
 var (
-	cryptoHandshakeError = errors.New("cryptoHandshakeComplete not yet true")
-	PeerIsMigratingError = errors.New("peer is migrating")
+	cryptoHandshakeError   = errors.New("session keys not yet derived")
+	PeerIsMigratingError   = errors.New("peer is migrating")
+	pktAuthenticationError = errors.New("packet authentication failed")
+	replayedPktError       = errors.New("packet replayed")
+	unknownKeyEpochError   = errors.New("unknown or expired key epoch")
 )
 
 type readerFromAddr interface {
 	ReadFrom([]byte) (int, net.Addr, error)
 }
 
-// eConn is an encrypted snet.Conn
+// eConn is an encrypted snet.Conn.
+// Each packet is sealed with the AEAD negotiated during the handshake and has the following format:
+//
+//	| key epoch (1 byte) | packet counter (8 bytes) | ciphertext | tag |
+//
+// The key epoch selects the session key, the packet counter is used to build the nonce,
+// and both are authenticated as additional data.
+// The packet counter also acts as sequence number, which is checked against the replay window of the channel.
 type eConn struct {
-	peer *peer
-	conn *snet.Conn
+	peer    *peer
+	conn    *snet.Conn
+	channel pktChannel
+	// maxLen is the maximum length of the packets (without the tag) fitting in the MTU of the path of egress eConns
+	maxLen int
+}
+
+func newEConn(conn *snet.Conn, peer *peer, channel pktChannel) *eConn {
+	return &eConn{conn: conn, peer: peer, channel: channel, maxLen: defaultMaxMsgLen}
 }
 
-func newEConn(conn *snet.Conn, peer *peer) *eConn {
-	return &eConn{conn: conn, peer: peer}
+// maxMsgLen returns the maximum length of the messages fitting in a packet, sealed with the current session key
+func (e *eConn) maxMsgLen() int {
+	l := e.maxLen
+	if session := e.peer.keyMgr.sendSession(); session != nil {
+		l -= session.channels[e.channel].sendAEAD.Overhead()
+	}
+	if l < minMsgLen {
+		return minMsgLen
+	}
+	return l
 }
 
 func (e *eConn) writeTo(b []byte, raddr net.Addr) (int, error) {
-	if !e.peer.cryptoHandshakeComplete {
+	return e.writeWithPrefix(nil, b, raddr)
+}
+
+// writeWithPrefix seals prefix followed by b in a single packet, it returns the number of bytes of b written
+func (e *eConn) writeWithPrefix(prefix, b []byte, raddr net.Addr) (int, error) {
+	if !e.peer.keysReady() {
 		return -1, cryptoHandshakeError
 	}
-	if e.peer.pathMgr.isMigrating == 1 {
+	if atomic.LoadInt32(&e.peer.pathMgr.isMigrating) == 1 {
 		return -1, PeerIsMigratingError
 	}
-	block := e.peer.keyMgr.block
-	padLen := aes.BlockSize - (len(b) % aes.BlockSize)
-	padding := bytes.Repeat([]byte{byte(padLen)}, padLen)
-	plaintext := append(b, padding...)
-	mode := cipher.NewCBCEncrypter(block, e.peer.keyMgr.iv)
-	mode.CryptBlocks(plaintext, plaintext)
-	return e.conn.WriteTo(plaintext, raddr)
+	if atomic.LoadInt32(&e.peer.pathMgr.noCompliantPath) == 1 {
+		return -1, noCompliantPathError
+	}
+	session := e.peer.keyMgr.sendSession()
+	if session == nil {
+		return -1, cryptoHandshakeError
+	}
+	keys := session.channels[e.channel]
+	pktCounter := keys.nextPktCounter()
+	plaintextLen := len(prefix) + len(b)
+	pkt := make([]byte, pktHdrLen+plaintextLen, pktHdrLen+plaintextLen+keys.sendAEAD.Overhead())
+	pkt[0] = session.epoch
+	binary.BigEndian.PutUint64(pkt[1:], pktCounter)
+	copy(pkt[pktHdrLen:], prefix)
+	copy(pkt[pktHdrLen+len(prefix):], b)
+	// The plaintext is sealed in-place
+	pkt = keys.sendAEAD.Seal(pkt[:pktHdrLen], buildNonce(pktCounter), pkt[pktHdrLen:], pkt[:pktHdrLen])
+	_, err := e.conn.WriteTo(pkt, raddr)
+	if err != nil {
+		return -1, err
+	}
+	e.peer.keyMgr.accountSentBytes(session, plaintextLen)
+	return len(b), nil
 }
 
 func (e *eConn) Write(b []byte) (int, error) {
 	return e.writeTo(b, e.conn.RemoteAddr())
 }
 
+// eConnTo writes through an eConn to raddr, e.g., to answer over the path a packet came from
+type eConnTo struct {
+	*eConn
+	raddr net.Addr
+}
+
+func (e eConnTo) Write(b []byte) (int, error) {
+	return e.writeTo(b, e.raddr)
+}
+
+// ReadFrom reads a packet, authenticates and decrypts it, and stores the plaintext at the beginning of buf
 func (e *eConn) ReadFrom(buf []byte) (int, net.Addr, error) {
 	n, raddr, err := e.conn.ReadFrom(buf)
 	if err != nil {
 		return -1, nil, err
 	}
-	if !e.peer.cryptoHandshakeComplete {
-		return -1, nil, fmt.Errorf("cryptoHandshakeComplete not yet true")
+	if !e.peer.keysReady() {
+		return -1, nil, cryptoHandshakeError
+	}
+	if n < pktHdrLen {
+		return -1, nil, fmt.Errorf("invalid packet length: %d", n)
+	}
+	session := e.peer.keyMgr.recvSession(buf[0])
+	if session == nil {
+		return -1, nil, unknownKeyEpochError
+	}
+	keys := session.channels[e.channel]
+	if n < pktHdrLen+keys.recvAEAD.Overhead() {
+		return -1, nil, fmt.Errorf("invalid packet length: %d", n)
+	}
+	hdr, ciphertext := buf[:pktHdrLen], buf[pktHdrLen:n]
+	pktCounter := binary.BigEndian.Uint64(hdr[1:])
+	// Open can work in-place if ciphertext[:0] is used as destination
+	plaintext, err := keys.recvAEAD.Open(ciphertext[:0], buildNonce(pktCounter), ciphertext, hdr)
+	if err != nil {
+		return -1, nil, pktAuthenticationError
 	}
-	block := e.peer.keyMgr.block
-	ciphertext := buf[:n]
-	if len(ciphertext) < aes.BlockSize || len(ciphertext)%aes.BlockSize != 0 {
-		return -1, nil, fmt.Errorf("invalid ciphertext length: %d", len(ciphertext))
+	if !keys.replayWindow.checkAndUpdate(pktCounter) {
+		atomic.AddUint64(&e.peer.counters.replayedPkts, 1)
+		return -1, nil, replayedPktError
 	}
-	mode := cipher.NewCBCDecrypter(block, e.peer.keyMgr.iv)
-	// CryptBlocks can work in-place if the two arguments are the same.
-	mode.CryptBlocks(ciphertext, ciphertext)
-	padLen := int(ciphertext[n-1])
-	dataLen := n - padLen
-	buf = ciphertext[:dataLen]
-	return dataLen, raddr, nil
+	e.peer.keyMgr.promoteSession(session)
+	copy(buf, plaintext)
+	return len(plaintext), raddr, nil
 }
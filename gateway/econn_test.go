@@ -0,0 +1,54 @@
+/*
+Copyright (c) 2020, ETH and Andrea Tulimiero
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package gateway
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEConnMaxMsgLen(t *testing.T) {
+	tests := []struct {
+		name     string
+		maxLen   int
+		session  bool
+		expected int
+	}{
+		{name: "no session key", maxLen: 1000, expected: 1000},
+		{name: "tag of the session key", maxLen: 1000, session: true, expected: 1000 - 16},
+		{name: "minimum length", maxLen: minMsgLen, session: true, expected: minMsgLen},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			k := newTestKeyMgr(time.Hour)
+			if test.session {
+				k.currSession = newTestSessionKey(t, 0)
+			}
+			e := newEConn(nil, k.peer, dataChannel)
+			e.maxLen = test.maxLen
+			if actual := e.maxMsgLen(); actual != test.expected {
+				t.Errorf("expected = %d, actual = %d", test.expected, actual)
+			}
+		})
+	}
+}
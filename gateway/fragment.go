@@ -0,0 +1,247 @@
+/*
+Copyright (c) 2020, ETH and Andrea Tulimiero
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package gateway
+
+import (
+	"errors"
+	"fmt"
+	"github.com/scionproto/scion/go/lib/log"
+	"github.com/scionproto/scion/go/lib/snet"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+)
+
+const (
+	// scionHdrOverhead is a conservative estimate of the SCION and UDP headers of a packet, excluding the path
+	scionHdrOverhead = 64
+	// fragmentOverhead is the overhead of the frame and fields of a fragmentMsg
+	fragmentOverhead = msgHdrLen + 16
+	// minMsgLen is the minimum length of the messages written on a connection
+	minMsgLen = 256
+	// maxFragmentCount is the number of fragments of the longest frame split in the shortest chunks
+	maxFragmentCount = (msgHdrLen + maxMsgPayload + minMsgLen - fragmentOverhead - 1) / (minMsgLen - fragmentOverhead)
+	// fragmentSlotSize is the memory taken by the slot of a fragment in a partialMsg
+	fragmentSlotSize = int(unsafe.Sizeof([]byte(nil)))
+	// defaultMaxMsgLen is the length of the messages written on connections of unknown MTU
+	defaultMaxMsgLen = 1000
+)
+
+var (
+	invalidFragmentError     = errors.New("invalid fragment")
+	reassemblyLimitError     = errors.New("reassembly memory limit exceeded")
+	tooManyReassemblersError = errors.New("too many inbound remotes reassembling messages")
+)
+
+// fragmentMsg carries a chunk of the frame of a message too long for the MTU of the path
+type fragmentMsg struct {
+	ID    uint32
+	Index uint16
+	Count uint16
+	Data  []byte
+}
+
+func (m *fragmentMsg) encode(e *MsgEncoder) error {
+	e.PutUint32(m.ID)
+	e.PutUint16(m.Index)
+	e.PutUint16(m.Count)
+	e.PutBytes(m.Data)
+	return nil
+}
+
+func (m *fragmentMsg) decode(version uint8, d *MsgDecoder) error {
+	m.ID = d.GetUint32()
+	m.Index = d.GetUint16()
+	m.Count = d.GetUint16()
+	m.Data = d.GetBytes()
+	return d.Err()
+}
+
+// msgLenLimiter is implemented by writers that know the maximum length of the messages they can send in one packet
+type msgLenLimiter interface {
+	maxMsgLen() int
+}
+
+// lastFragmentID is the ID of the last message fragmented by this gateway
+var lastFragmentID uint32
+
+// maxMsgLenForPath returns the maximum length of the messages that fit in a packet sent over path,
+// overhead being the bytes added to the message by the connection
+func maxMsgLenForPath(path snet.Path, overhead int) int {
+	l := int(path.MTU()) - scionHdrOverhead - overhead
+	if raw := path.Path(); raw != nil {
+		l -= len(raw.Raw)
+	}
+	if l < minMsgLen {
+		return minMsgLen
+	}
+	return l
+}
+
+// writeFrame writes the frame of a message, split in fragments if longer than maxLen
+func writeFrame(frame []byte, writer io.Writer, maxLen int) error {
+	if len(frame) <= maxLen {
+		return writePkt(frame, writer)
+	}
+	chunkLen := maxLen - fragmentOverhead
+	count := (len(frame) + chunkLen - 1) / chunkLen
+	id := atomic.AddUint32(&lastFragmentID, 1)
+	for i := 0; i < count; i++ {
+		end := (i + 1) * chunkLen
+		if end > len(frame) {
+			end = len(frame)
+		}
+		fragFrame, err := encodeMsg(&fragmentMsg{ID: id, Index: uint16(i), Count: uint16(count),
+			Data: frame[i*chunkLen : end]})
+		if err != nil {
+			return err
+		}
+		if err := writePkt(fragFrame, writer); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writePkt writes a packet in one go, short writes are reported as errors
+func writePkt(pkt []byte, writer io.Writer) error {
+	n, err := writer.Write(pkt)
+	if err != nil {
+		return err
+	} else if n < len(pkt) {
+		return fmt.Errorf("short write: required = %d, sent = %d", len(pkt), n)
+	}
+	return nil
+}
+
+// partialMsg is a message whose fragments are being collected
+type partialMsg struct {
+	fragments [][]byte
+	received  int
+	size      int
+	createdAt time.Time
+}
+
+// mem returns the memory taken by the message, including the slots of its fragments
+func (msg *partialMsg) mem() int {
+	return msg.size + len(msg.fragments)*fragmentSlotSize
+}
+
+// reassembler collects the fragments of the messages of a peer.
+// Messages not completed within reassemblyTimeout are dropped, and fragments are dropped
+// while more than memLimit bytes are buffered or reassemblyMaxPending messages are incomplete.
+type reassembler struct {
+	mutex    sync.Mutex
+	pending  map[uint32]*partialMsg
+	buffered int
+	memLimit int
+}
+
+func newReassembler(memLimit int) *reassembler {
+	return &reassembler{pending: make(map[uint32]*partialMsg), memLimit: memLimit}
+}
+
+// add stores a fragment and returns the frame of its message once all fragments were received
+func (r *reassembler) add(frag *fragmentMsg) ([]byte, error) {
+	if frag.Count == 0 || frag.Count > maxFragmentCount || frag.Index >= frag.Count || len(frag.Data) == 0 {
+		return nil, invalidFragmentError
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.expire()
+	msg, ok := r.pending[frag.ID]
+	if !ok {
+		slots := int(frag.Count) * fragmentSlotSize
+		if len(r.pending) >= reassemblyMaxPending || r.buffered+slots > r.memLimit {
+			return nil, reassemblyLimitError
+		}
+		msg = &partialMsg{fragments: make([][]byte, frag.Count), createdAt: time.Now()}
+		r.pending[frag.ID] = msg
+		r.buffered += slots
+	}
+	if len(msg.fragments) != int(frag.Count) {
+		return nil, fmt.Errorf("fragment count mismatch: expected = %d, actual = %d", len(msg.fragments), frag.Count)
+	}
+	if msg.fragments[frag.Index] != nil {
+		// Duplicate fragment
+		return nil, nil
+	}
+	if r.buffered+len(frag.Data) > r.memLimit || msg.size+len(frag.Data) > msgHdrLen+maxMsgPayload {
+		if msg.received == 0 {
+			r.drop(frag.ID, msg)
+		}
+		return nil, reassemblyLimitError
+	}
+	msg.fragments[frag.Index] = frag.Data
+	msg.received++
+	msg.size += len(frag.Data)
+	r.buffered += len(frag.Data)
+	if msg.received < len(msg.fragments) {
+		return nil, nil
+	}
+	r.drop(frag.ID, msg)
+	frame := make([]byte, 0, msg.size)
+	for _, f := range msg.fragments {
+		frame = append(frame, f...)
+	}
+	return frame, nil
+}
+
+// expire drops the messages older than reassemblyTimeout
+func (r *reassembler) expire() {
+	for id, msg := range r.pending {
+		if time.Since(msg.createdAt) > reassemblyTimeout {
+			log.Debug("Dropping incomplete message", "id", id, "received", msg.received, "count", len(msg.fragments))
+			r.drop(id, msg)
+		}
+	}
+}
+
+// drop forgets a message and frees its memory
+func (r *reassembler) drop(id uint32, msg *partialMsg) {
+	r.buffered -= msg.mem()
+	delete(r.pending, id)
+}
+
+// idle returns whether no message is being reassembled
+func (r *reassembler) idle() bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.expire()
+	return len(r.pending) == 0
+}
+
+// reassemble returns the message completed by a fragment of the remote, if any
+func (peer *peer) reassemble(frag *fragmentMsg) (Message, error) {
+	return reassemble(peer.reassembler, frag)
+}
+
+func reassemble(r *reassembler, frag *fragmentMsg) (Message, error) {
+	frame, err := r.add(frag)
+	if err != nil || frame == nil {
+		return nil, err
+	}
+	return decodeFrame(frame)
+}
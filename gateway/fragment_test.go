@@ -0,0 +1,276 @@
+/*
+Copyright (c) 2020, ETH and Andrea Tulimiero
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package gateway
+
+import (
+	"bytes"
+	"github.com/scionproto/scion/go/lib/addr"
+	"github.com/scionproto/scion/go/lib/snet"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// pktRecorder records the packets written to it
+type pktRecorder struct {
+	pkts [][]byte
+	// short makes writes report one byte less than written
+	short bool
+}
+
+func (r *pktRecorder) Write(b []byte) (int, error) {
+	r.pkts = append(r.pkts, append([]byte(nil), b...))
+	if r.short {
+		return len(b) - 1, nil
+	}
+	return len(b), nil
+}
+
+func TestReassemblerAdd(t *testing.T) {
+	frag := func(id uint32, index, count uint16, data string) *fragmentMsg {
+		return &fragmentMsg{ID: id, Index: index, Count: count, Data: []byte(data)}
+	}
+	type step struct {
+		frag      *fragmentMsg
+		expected  string
+		expectErr bool
+	}
+	type test struct {
+		name     string
+		memLimit int
+		steps    []step
+	}
+	tests := []test{
+		{
+			name:     "in order",
+			memLimit: reassemblyMemLimit,
+			steps: []step{
+				{frag: frag(1, 0, 3, "ab")},
+				{frag: frag(1, 1, 3, "cd")},
+				{frag: frag(1, 2, 3, "e"), expected: "abcde"},
+			},
+		},
+		{
+			name:     "out of order and interleaved",
+			memLimit: reassemblyMemLimit,
+			steps: []step{
+				{frag: frag(1, 2, 3, "e")},
+				{frag: frag(2, 1, 2, "y")},
+				{frag: frag(1, 0, 3, "ab")},
+				{frag: frag(2, 0, 2, "x"), expected: "xy"},
+				{frag: frag(1, 1, 3, "cd"), expected: "abcde"},
+			},
+		},
+		{
+			name:     "single fragment",
+			memLimit: reassemblyMemLimit,
+			steps:    []step{{frag: frag(1, 0, 1, "a"), expected: "a"}},
+		},
+		{
+			name:     "duplicate fragment",
+			memLimit: reassemblyMemLimit,
+			steps: []step{
+				{frag: frag(1, 0, 2, "a")},
+				{frag: frag(1, 0, 2, "a")},
+				{frag: frag(1, 1, 2, "b"), expected: "ab"},
+			},
+		},
+		{
+			name:     "invalid fragments",
+			memLimit: reassemblyMemLimit,
+			steps: []step{
+				{frag: frag(1, 0, 0, "a"), expectErr: true},
+				{frag: frag(1, 2, 2, "a"), expectErr: true},
+				{frag: frag(1, 0, 2, ""), expectErr: true},
+				{frag: frag(1, 0, 2, "a")},
+				{frag: frag(1, 1, 3, "b"), expectErr: true},
+			},
+		},
+		{
+			name:     "fragment count limit",
+			memLimit: reassemblyMemLimit,
+			steps: []step{
+				{frag: frag(1, 0, maxFragmentCount+1, "a"), expectErr: true},
+				{frag: frag(1, 0, maxFragmentCount, "a")},
+			},
+		},
+		{
+			name:     "fragment slots charged",
+			memLimit: 3 * fragmentSlotSize,
+			steps: []step{
+				{frag: frag(1, 0, 2, "a")},
+				{frag: frag(2, 0, 2, "b"), expectErr: true},
+				{frag: frag(1, 1, 2, "c"), expected: "ac"},
+				{frag: frag(2, 0, 2, "b")},
+			},
+		},
+		{
+			name:     "byte limit",
+			memLimit: 4*fragmentSlotSize + 4,
+			steps: []step{
+				{frag: frag(1, 0, 2, "abc")},
+				{frag: frag(2, 0, 2, "de"), expectErr: true},
+				{frag: frag(1, 1, 2, "f"), expected: "abcf"},
+				// Completed messages free their bytes
+				{frag: frag(2, 0, 2, "de")},
+				{frag: frag(2, 1, 2, "gh"), expected: "degh"},
+			},
+		},
+	}
+	pendingLimit := test{name: "pending messages limit", memLimit: reassemblyMemLimit}
+	for i := 0; i < reassemblyMaxPending; i++ {
+		pendingLimit.steps = append(pendingLimit.steps, step{frag: frag(uint32(i), 0, 2, "a")})
+	}
+	pendingLimit.steps = append(pendingLimit.steps,
+		step{frag: frag(reassemblyMaxPending, 0, 2, "b"), expectErr: true},
+		step{frag: frag(0, 1, 2, "c"), expected: "ac"},
+		step{frag: frag(reassemblyMaxPending, 0, 2, "b")})
+	tests = append(tests, pendingLimit)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := newReassembler(test.memLimit)
+			for i, step := range test.steps {
+				frame, err := r.add(step.frag)
+				if step.expectErr {
+					if err == nil {
+						t.Errorf("step %d: expected error", i)
+					}
+					continue
+				}
+				if err != nil {
+					t.Fatalf("step %d: %s", i, err)
+				}
+				if string(frame) != step.expected {
+					t.Errorf("step %d: expected = %q, actual = %q", i, step.expected, frame)
+				}
+			}
+		})
+	}
+}
+
+func TestReassemblerTimeout(t *testing.T) {
+	r := newReassembler(4*fragmentSlotSize + 4)
+	if _, err := r.add(&fragmentMsg{ID: 1, Index: 0, Count: 2, Data: []byte("abcd")}); err != nil {
+		t.Fatal(err)
+	}
+	if r.idle() {
+		t.Error("reassembler with a pending message is idle")
+	}
+	if _, err := r.add(&fragmentMsg{ID: 2, Index: 0, Count: 2, Data: []byte("e")}); err != reassemblyLimitError {
+		t.Errorf("expected = %v, actual = %v", reassemblyLimitError, err)
+	}
+	r.pending[1].createdAt = time.Now().Add(-reassemblyTimeout - time.Second)
+	// The expired message frees its bytes, and its late fragments start a new message
+	if _, err := r.add(&fragmentMsg{ID: 2, Index: 0, Count: 2, Data: []byte("e")}); err != nil {
+		t.Fatal(err)
+	}
+	if frame, err := r.add(&fragmentMsg{ID: 1, Index: 1, Count: 2, Data: []byte("f")}); err != nil || frame != nil {
+		t.Errorf("expected incomplete message, frame = %q, err = %v", frame, err)
+	}
+	r.pending[1].createdAt = time.Now().Add(-reassemblyTimeout - time.Second)
+	r.pending[2].createdAt = time.Now().Add(-reassemblyTimeout - time.Second)
+	if !r.idle() {
+		t.Error("reassembler with expired messages only is not idle")
+	}
+	if r.buffered != 0 {
+		t.Errorf("expected no buffered bytes, actual = %d", r.buffered)
+	}
+}
+
+func TestWriteFrameFragments(t *testing.T) {
+	msg := &rekeyRequestMsg{Epoch: 1, PubKey: bytes.Repeat([]byte{1, 2, 3}, 300)}
+	frame, err := encodeMsg(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := &pktRecorder{}
+	if err := writeFrame(frame, w, minMsgLen); err != nil {
+		t.Fatal(err)
+	}
+	if len(w.pkts) < 2 {
+		t.Fatalf("expected fragments, written %d packets", len(w.pkts))
+	}
+	r := newReassembler(reassemblyMemLimit)
+	var reassembled Message
+	// Fragments are fed in reverse order
+	for i := len(w.pkts) - 1; i >= 0; i-- {
+		if len(w.pkts[i]) > minMsgLen {
+			t.Errorf("packet %d longer than %d: %d", i, minMsgLen, len(w.pkts[i]))
+		}
+		decoded, err := decodeFrame(w.pkts[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reassembled, err = reassemble(r, decoded.(*fragmentMsg)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !reflect.DeepEqual(reassembled, msg) {
+		t.Errorf("expected = %+v, actual = %+v", msg, reassembled)
+	}
+}
+
+func TestWritePktShortWrite(t *testing.T) {
+	if err := writePkt([]byte{1, 2, 3}, &pktRecorder{short: true}); err == nil {
+		t.Error("expected error on short write")
+	}
+	if err := writePkt([]byte{1, 2, 3}, &pktRecorder{}); err != nil {
+		t.Error(err)
+	}
+}
+
+// TestAcceptFragmentsSeparated checks that unauthenticated fragments received on the accept connection
+// do not complete the ctrl messages of a peer
+func TestAcceptFragmentsSeparated(t *testing.T) {
+	raddr := &snet.UDPAddr{IA: addr.IA{I: 1, A: 0xff0000000002}, Host: &net.UDPAddr{}}
+	p := &peer{remote: ConnConf{Address: YUDPAddr{raddr}}, reassembler: newReassembler(reassemblyMemLimit),
+		handshakeReassembler: newReassembler(acceptReassemblyMemLimit)}
+	gateway := &Gateway{asClientMap: map[string]*peer{raddr.IA.String(): p}}
+	p.gateway = gateway
+
+	frame, err := encodeMsg(&rekeyRequestMsg{Epoch: 1, PubKey: bytes.Repeat([]byte{1}, 2*minMsgLen)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := &pktRecorder{}
+	if err := writeFrame(frame, w, minMsgLen); err != nil {
+		t.Fatal(err)
+	}
+	for i, pkt := range w.pkts {
+		frag, err := decodeFrame(pkt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i == 0 {
+			gateway.handleAcceptMsg(frag, raddr)
+			continue
+		}
+		if msg, err := p.reassemble(frag.(*fragmentMsg)); err != nil || msg != nil {
+			t.Fatalf("fragment %d: reassembled = %+v, err = %v", i, msg, err)
+		}
+	}
+	if p.reassembler.idle() || p.handshakeReassembler.idle() {
+		t.Errorf("fragments of the accept connection completed a ctrl message")
+	}
+}
@@ -24,100 +24,206 @@ package gateway
 
 import (
 	"context"
+	"crypto/ed25519"
 	"fmt"
 	"github.com/scionproto/scion/go/lib/addr"
 	"github.com/scionproto/scion/go/lib/common"
 	"github.com/scionproto/scion/go/lib/log"
 	"github.com/scionproto/scion/go/lib/sciond"
 	"github.com/scionproto/scion/go/lib/snet"
-	"gopkg.in/yaml.v2"
+	"sync"
 )
 
 type Gateway struct {
-	conf          conf
-	network       snet.Network
-	sdConn        sciond.Connector
-	asClientMap   map[string]*peer
-	adapter       Adapter
-	egressWorker  *egressWorker
-	ingressWorker *ingressWorker
-	pathDBPath    string
+	// confMutex guards the parts of conf that can be reloaded (i.e., Remotes, Pathing, and PathPolicies),
+	// reloadMutex serializes reloads
+	confMutex   sync.RWMutex
+	reloadMutex sync.Mutex
+	conf        conf
+	network     snet.Network
+	sdConn      sciond.Connector
+	peersMutex  sync.RWMutex
+	asClientMap map[string]*peer
+	// adapters are added before the gateway starts, hence they are not guarded by a mutex
+	adapters   []*adapterEntry
+	pathDBPath string
+	// authenticators overrides the authenticators configured for remotes
+	authenticators map[string]Authenticator
+	// pathSorters overrides the path sorters configured for remotes, it is guarded by confMutex
+	pathSorters   map[string]PathSorter
+	ed25519Key    ed25519.PrivateKey
+	certStore     *certStore
+	inboundPolicy inboundPolicy
+	// inboundReassemblers collect the fragmented handshakes of each remote allowed by inboundPolicy
+	inboundReassemblersMutex sync.Mutex
+	inboundReassemblers      map[addr.IA]*reassembler
+	// rpcHandlers maps the types of requests sent to each adapter to their handlers
+	rpcHandlersMutex sync.RWMutex
+	rpcHandlers      map[rpcHandlerKey]RPCHandler
+	// Lifecycle
+	acceptConn *snet.Conn
+	stop       chan struct{}
+	stopOnce   sync.Once
 }
 
 func newGateway(conf conf, pathDBPath string) (*Gateway, error) {
+	sdConn, network, err := getSCIONNetwork(*dispatcher, *sciondAddr, conf.Address.IA)
+	if err != nil {
+		return nil, err
+	}
+	return newGatewayWithNetwork(conf, pathDBPath, sdConn, network)
+}
+
+// newGatewayWithNetwork returns a new Gateway reaching remotes through network, using the paths of sdConn
+func newGatewayWithNetwork(conf conf, pathDBPath string, sdConn sciond.Connector,
+	network snet.Network) (*Gateway, error) {
 	gateway := &Gateway{
-		conf:        conf,
-		pathDBPath:  pathDBPath,
-		asClientMap: make(map[string]*peer),
+		conf:                conf,
+		network:             network,
+		sdConn:              sdConn,
+		pathDBPath:          pathDBPath,
+		asClientMap:         make(map[string]*peer),
+		authenticators:      make(map[string]Authenticator),
+		pathSorters:         make(map[string]PathSorter),
+		rpcHandlers:         make(map[rpcHandlerKey]RPCHandler),
+		stop:                make(chan struct{}),
+		inboundReassemblers: make(map[addr.IA]*reassembler),
 	}
 	var err error
-	gateway.sdConn, gateway.network, err = getSCIONNetwork(*dispatcher, *sciondAddr, gateway.conf.Address.IA)
+	gateway.inboundPolicy, err = newInboundPolicy(conf.Inbound.Allow)
 	if err != nil {
 		return nil, err
 	}
+	if t := conf.Inbound.Auth.Type; len(gateway.inboundPolicy) > 0 && (t == authTypePSK || t == authTypeEd25519) {
+		log.Warn("Inbound remotes share the same credential, any of them can claim the IA of the others",
+			"auth", t)
+	}
+	if conf.Ed25519KeyPath != "" {
+		gateway.ed25519Key, err = loadEd25519Key(conf.Ed25519KeyPath)
+		if err != nil {
+			return nil, fmt.Errorf("error loading ed25519 key: %s", err)
+		}
+	}
+	if conf.Certificate.ChainPath != "" {
+		gateway.certStore, err = loadCertStore(conf.Certificate)
+		if err != nil {
+			return nil, err
+		}
+	}
 	return gateway, nil
 }
 
-func (gateway *Gateway) startWorkers(adapter Adapter) {
-	gateway.egressWorker = newEgressWorker(adapter, gateway)
-	go gateway.egressWorker.Run()
-	gateway.ingressWorker = newIngressWorker(adapter, gateway)
-	go gateway.ingressWorker.Run()
+func (gateway *Gateway) startWorkers(entry *adapterEntry) {
+	entry.egressWorker = newEgressWorker(entry.adapter, entry.id, gateway)
+	go entry.egressWorker.Run()
+	entry.ingressWorker = newIngressWorker(entry.adapter, gateway)
+	go entry.ingressWorker.Run()
 }
 
-func (gateway *Gateway) accept() {
-	conn, err := gateway.network.Listen(context.Background(), "udp", gateway.localAcceptAddr().Host, addr.SvcNone)
-	if err != nil {
-		LogFatal("Unable to listen for incoming ctrl messages", "err", err)
+// adapterByID returns the adapter with the given ID, if any
+func (gateway *Gateway) adapterByID(id AdapterID) *adapterEntry {
+	for _, entry := range gateway.adapters {
+		if entry.id == id {
+			return entry
+		}
 	}
+	return nil
+}
+
+func (gateway *Gateway) accept(conn *snet.Conn) {
 	log.Debug("Accepting peer connections", "addr", conn.LocalAddr())
 	for {
 		msg, raddr, err := ReadMsg(conn)
+		if err != nil && gateway.stopped() {
+			return
+		}
 		if err != nil {
 			log.Error("Error reading controler message", "err", err)
 			continue
 		}
-		log.Trace("Received new control message", "type", fmt.Sprintf("%T", msg))
-		switch reqMsg := msg.(type) {
-		case *handshakeRequestMsg:
-			peer, err := gateway.getPeer(raddr.IA.String())
-			if err != nil {
-				log.Error("Error retrieving peer", "raddr", raddr.IA)
-				continue
-			}
-			go peer.handleHandshakeRequest(reqMsg)
-		case *handshakeResponseMsg:
-			peer, err := gateway.getPeer(raddr.IA.String())
+		gateway.handleAcceptMsg(msg, raddr)
+	}
+}
+
+// handleAcceptMsg dispatches a message received on the accept connection to the peer of the sender
+func (gateway *Gateway) handleAcceptMsg(msg Message, raddr *snet.UDPAddr) {
+	log.Trace("Received new control message", "type", fmt.Sprintf("%T", msg))
+	switch reqMsg := msg.(type) {
+	case *handshakeRequestMsg:
+		peer, err := gateway.getPeer(raddr.IA.String())
+		if err != nil {
+			peer, err = gateway.acceptInboundPeer(reqMsg, raddr)
 			if err != nil {
-				log.Error("Error retrieving peer", "raddr", raddr.IA)
-				continue
+				log.Error("Error retrieving peer", "raddr", raddr.IA, "err", err)
+				return
 			}
-			go peer.handleHandshakeResponse(reqMsg)
+		}
+		go peer.handleHandshakeRequest(reqMsg)
+	case *handshakeResponseMsg:
+		peer, err := gateway.getPeer(raddr.IA.String())
+		if err != nil {
+			log.Error("Error retrieving peer", "raddr", raddr.IA)
+			return
+		}
+		go peer.handleHandshakeResponse(reqMsg)
+	case *fragmentMsg:
+		// Handshake messages carrying certificate chains may not fit in a single packet.
+		// These fragments are not authenticated, hence they are never reassembled with the ones of ctrl messages.
+		var r *reassembler
+		peer, err := gateway.getPeer(raddr.IA.String())
+		switch {
+		case err == nil:
+			r = peer.handshakeReassembler
+		case gateway.inboundPolicy.allows(raddr.IA):
+			r, err = gateway.inboundReassembler(raddr.IA)
+		default:
+			log.Error("Error retrieving peer", "raddr", raddr.IA)
+			return
+		}
+		var reassembled Message
+		if err == nil {
+			reassembled, err = reassemble(r, reqMsg)
+		}
+		if err != nil {
+			log.Debug("Dropped fragment", "raddr", raddr.IA, "err", err)
+			return
+		}
+		switch reassembled.(type) {
+		case nil:
+		case *handshakeRequestMsg, *handshakeResponseMsg:
+			gateway.handleAcceptMsg(reassembled, raddr)
 		default:
-			log.Warn("Unknown message type received from gateway", "type", fmt.Sprintf("%T", msg))
+			log.Warn("Dropped reassembled message not part of a handshake", "raddr", raddr.IA,
+				"type", fmt.Sprintf("%T", reassembled))
 		}
+	default:
+		log.Warn("Unknown message type received from gateway", "type", fmt.Sprintf("%T", msg))
 	}
 }
 
-func (gateway *Gateway) listen() {
+// listen reads the packets of an adapter and passes them to its egress worker
+func (gateway *Gateway) listen(entry *adapterEntry) {
 	buf := make([]byte, common.MaxMTU)
 	for {
-		n, err := gateway.adapter.Read(buf)
+		n, err := entry.adapter.Read(buf)
+		if err != nil && gateway.stopped() {
+			return
+		}
 		if err != nil {
-			log.Error("Error reading from ", "adapter", gateway.adapter, "err", err)
+			log.Error("Error reading from ", "adapter", entry.adapter, "err", err)
 			continue
 		}
 
 		if useWorkerMemPool {
-			freeBuf := gateway.egressWorker.pktsPool.get()
+			freeBuf := entry.egressWorker.pktsPool.get()
 			if freeBuf == nil {
 				log.Debug("Couldn't retrieve free buf")
 				continue
 			}
-			gateway.ProcessEgressPkt(buf[:n])
+			gateway.enqueuePkt(entry.egressWorker.pktsChannel, buf[:n])
 			buf = freeBuf
 		} else {
-			gateway.ProcessEgressPkt(buf[:n])
+			gateway.enqueuePkt(entry.egressWorker.pktsChannel, buf[:n])
 			buf = make([]byte, common.MaxMTU)
 		}
 	}
@@ -131,26 +237,36 @@ func (gateway *Gateway) localAddr() *snet.UDPAddr {
 
 func (gateway *Gateway) localAcceptAddr() *snet.UDPAddr { return gateway.conf.Address.UDPAddr }
 
-func (gateway *Gateway) getConnTo(remoteAddr *snet.UDPAddr) (*snet.Conn, error) {
+// getConnTo dials a remote over the first path complying with policy, if any
+func (gateway *Gateway) getConnTo(remoteAddr *snet.UDPAddr, policy *pathPolicy) (*snet.Conn, snet.Path, error) {
 	sdConn, network := gateway.sdConn, gateway.network
 	localAddr := gateway.localAddr()
 	paths, err := sdConn.Paths(context.Background(), remoteAddr.IA, localAddr.IA, sciond.PathReqFlags{Refresh: true})
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+	if len(paths) == 0 {
+		return nil, nil, noPathError
 	}
+	if policy != nil {
+		if paths = policy.filter(paths); len(paths) == 0 {
+			return nil, nil, noCompliantPathError
+		}
+	}
+	// remoteAddr may be shared, e.g., by a peer
+	remoteAddr = remoteAddr.Copy()
 	remoteAddr.Path = paths[0].Path()
 	remoteAddr.NextHop = paths[0].OverlayNextHop()
 	newConn, err := network.Dial(context.Background(), "udp", localAddr.Host, remoteAddr, addr.SvcNone)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	return newConn, nil
+	return newConn, paths[0], nil
 }
 
 // NewGateway returns a new Gateway.
 func NewGateway(confBuf []byte, pathDBPath string) (*Gateway, error) {
-	conf := conf{Pathing: defaultPathingConf}
-	err := yaml.UnmarshalStrict(confBuf, &conf)
+	conf, err := parseConf(confBuf)
 	if err != nil {
 		return nil, err
 	}
@@ -158,61 +274,175 @@ func NewGateway(confBuf []byte, pathDBPath string) (*Gateway, error) {
 	return newGateway(conf, pathDBPath)
 }
 
+// SetAdapter sets the adapter with DefaultAdapterID
 func (gateway *Gateway) SetAdapter(adapter Adapter) {
-	gateway.adapter = adapter
-	gateway.startWorkers(adapter)
+	if err := gateway.AddAdapter(DefaultAdapterID, adapter); err != nil {
+		log.Error("Error setting adapter", "err", err)
+	}
+}
+
+// AddAdapter adds an adapter exchanging data packets with the adapters with the same ID on remote gateways,
+// it must be called before Start. Each adapter has its own workers.
+func (gateway *Gateway) AddAdapter(id AdapterID, adapter Adapter) error {
+	if gateway.adapterByID(id) != nil {
+		return fmt.Errorf("adapter already exists: %d", id)
+	}
+	entry := &adapterEntry{id: id, adapter: adapter}
+	gateway.startWorkers(entry)
+	gateway.adapters = append(gateway.adapters, entry)
+	return nil
 }
 
 // Start the gateway by accepting incoming connection requests from other peers, connecting to other peers,
-// and listening to incoming local traffic using the adapter
+// and listening to incoming local traffic using the adapters
 func (gateway *Gateway) Start() {
-	go gateway.accept()
+	conn, err := gateway.network.Listen(context.Background(), "udp", gateway.localAcceptAddr().Host, addr.SvcNone)
+	if err != nil {
+		LogFatal("Unable to listen for incoming ctrl messages", "err", err)
+	}
+	gateway.acceptConn = conn
+	go gateway.accept(conn)
 	// initialize peer connections with other gateways
-	for _, remoteConf := range gateway.conf.Remotes {
-		remoteIA := remoteConf.Address.IA.String()
-		peer, err := newPeer(gateway, remoteConf, &gateway.conf.Pathing)
-		if err != nil {
-			log.Error("Error creating peer", "remoteConf", remoteIA)
-			continue
+	gateway.confMutex.RLock()
+	remotes := gateway.conf.Remotes
+	gateway.confMutex.RUnlock()
+	for _, remoteConf := range remotes {
+		if err := gateway.AddPeer(remoteConf); err != nil {
+			log.Error("Error creating peer", "remoteConf", remoteConf.Address.IA, "err", err)
+		}
+	}
+	if len(gateway.inboundPolicy) > 0 {
+		go gateway.inboundPeersCollector()
+	}
+	for _, entry := range gateway.adapters {
+		go gateway.listen(entry)
+	}
+}
+
+// AddPeer connects to a new remote gateway, it is safe to call it while the gateway is running
+func (gateway *Gateway) AddPeer(remoteConf ConnConf) error {
+	remoteIA := remoteConf.Address.IA.String()
+	gateway.peersMutex.Lock()
+	defer gateway.peersMutex.Unlock()
+	if _, ok := gateway.asClientMap[remoteIA]; ok {
+		return fmt.Errorf("peer already exists: %s", remoteIA)
+	}
+	pathing, err := gateway.pathingFor(remoteConf)
+	if err != nil {
+		return err
+	}
+	peer, err := newPeer(gateway, remoteConf, pathing)
+	if err != nil {
+		return err
+	}
+	gateway.asClientMap[remoteIA] = peer
+	log.Info("Added peer", "remote", remoteIA)
+	go peer.initHandshaking()
+	return nil
+}
+
+// RemovePeer disconnects from a remote gateway, stopping the goroutines of its peer and wiping its keys.
+// Adapters implementing PeerRemovalHandler are notified once the peer is closed.
+func (gateway *Gateway) RemovePeer(IA addr.IA) error {
+	gateway.peersMutex.Lock()
+	peer, ok := gateway.asClientMap[IA.String()]
+	delete(gateway.asClientMap, IA.String())
+	gateway.peersMutex.Unlock()
+	if !ok {
+		return fmt.Errorf("unknown peer: %s", IA)
+	}
+	peer.sayGoodbye(goodbyeClose)
+	peer.close()
+	for _, entry := range gateway.adapters {
+		if h, ok := entry.adapter.(PeerRemovalHandler); ok {
+			h.PeerRemoved(IA)
 		}
-		gateway.asClientMap[remoteIA] = peer
-		go peer.initHandshaking()
 	}
-	go gateway.listen()
+	return nil
 }
 
-// ProcessIngressPkt passes a packet received from a peer to an ingress worker
+// ProcessIngressPkt passes a packet received from a peer to the ingress worker of the default adapter
 func (gateway *Gateway) ProcessIngressPkt(b []byte) {
-	gateway.ingressWorker.pktsChannel <- b
+	if entry := gateway.adapterByID(DefaultAdapterID); entry != nil {
+		gateway.enqueuePkt(entry.ingressWorker.pktsChannel, b)
+	}
 }
 
-// ProcessEgressPkt passes a packet received from an adapter to an egress worker
+// ProcessEgressPkt passes a packet received from the default adapter to its egress worker
 func (gateway *Gateway) ProcessEgressPkt(b []byte) {
-	gateway.egressWorker.pktsChannel <- b
+	if entry := gateway.adapterByID(DefaultAdapterID); entry != nil {
+		gateway.enqueuePkt(entry.egressWorker.pktsChannel, b)
+	}
+}
+
+// enqueuePkt passes a packet to a worker, unless the gateway stops
+func (gateway *Gateway) enqueuePkt(pkts chan<- []byte, b []byte) {
+	select {
+	case pkts <- b:
+	case <-gateway.stop:
+	}
+}
+
+// pathingFor returns the pathing configuration of a remote
+func (gateway *Gateway) pathingFor(remoteConf ConnConf) (*pathingConf, error) {
+	gateway.confMutex.RLock()
+	defer gateway.confMutex.RUnlock()
+	conf, err := gateway.conf.pathingFor(remoteConf)
+	if err != nil {
+		return nil, err
+	}
+	if remoteConf.Address.UDPAddr == nil {
+		// e.g., the configuration of an inbound remote that has no entry in remotes
+		return conf, nil
+	}
+	if sorter, ok := gateway.pathSorters[remoteConf.Address.IA.String()]; ok {
+		conf.sorter = sorter
+	}
+	return conf, nil
 }
 
 // GetAdapterConfPath returns the file path of the Adapter configuration
 func (gateway *Gateway) GetAdapterConfPath() string { return gateway.conf.AdapterConfPath }
 
+// GetAdapterConfs returns the configuration of the adapters, adapterConfPath configures the default adapter
+func (gateway *Gateway) GetAdapterConfs() []AdapterConf {
+	if len(gateway.conf.Adapters) == 0 && gateway.conf.AdapterConfPath != "" {
+		return []AdapterConf{{ID: DefaultAdapterID, ConfPath: gateway.conf.AdapterConfPath}}
+	}
+	return gateway.conf.Adapters
+}
+
 // getPeer returns a peer, if any, for a remote gateway identified by IA
 func (gateway *Gateway) getPeer(IA string) (*peer, error) {
+	gateway.peersMutex.RLock()
 	peer, ok := gateway.asClientMap[IA]
+	gateway.peersMutex.RUnlock()
 	if !ok {
-		return nil, fmt.Errorf("Unknown client", "addr", IA)
+		return nil, fmt.Errorf("unknown client: %s", IA)
 	}
 	return peer, nil
 }
 
-// getPeerWriter is similar to getPeer but scopes the returned peer to a PeerWriter
-func (gateway *Gateway) getPeerWriter(IA string) (PeerWriter, error) {
-	return gateway.getPeer(IA)
+// getAdapterPeerWriter is similar to getPeer but scopes the returned peer to a PeerWriter of an adapter
+func (gateway *Gateway) getAdapterPeerWriter(IA string, id AdapterID) (PeerWriter, error) {
+	peer, err := gateway.getPeer(IA)
+	if err != nil {
+		return nil, err
+	}
+	return adapterPeerWriter{peer: peer, id: id}, nil
 }
 
 // WriteMsgOneOff writes a messages like WriteMsg but uses an ephemeral connection
 func (gateway *Gateway) WriteMsgOneOff(msg Message, remoteAddr *snet.UDPAddr) error {
-	c, err := gateway.getConnTo(remoteAddr)
+	return gateway.writeMsgOneOff(msg, remoteAddr, nil)
+}
+
+// writeMsgOneOff is like WriteMsgOneOff, but only uses the paths complying with policy, if any
+func (gateway *Gateway) writeMsgOneOff(msg Message, remoteAddr *snet.UDPAddr, policy *pathPolicy) error {
+	c, path, err := gateway.getConnTo(remoteAddr, policy)
 	if err != nil {
 		return err
 	}
-	return WriteMsg(msg, c)
+	defer c.Close()
+	return writeMsgWithLimit(msg, c, maxMsgLenForPath(path, 0))
 }
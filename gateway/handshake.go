@@ -0,0 +1,334 @@
+/*
+Copyright (c) 2020, ETH and Andrea Tulimiero
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package gateway
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/scionproto/scion/go/lib/log"
+	"sync/atomic"
+	"time"
+)
+
+// handshakeState is the state of the handshake with a remote peer.
+// A peer moves from handshakeIdle to handshakeKeysDerived once it authenticates the request of the remote,
+// and from handshakeKeysDerived to handshakeEstablished once the remote confirms it derived the same keys.
+type handshakeState int32
+
+const (
+	// handshakeIdle waits for an authenticated handshake request from the remote
+	handshakeIdle handshakeState = iota
+	// handshakeKeysDerived waits for the remote to confirm the session keys derived from its request
+	handshakeKeysDerived
+	// handshakeEstablished is reached once both ends hold the same authenticated session keys
+	handshakeEstablished
+)
+
+func (s handshakeState) String() string {
+	switch s {
+	case handshakeIdle:
+		return "idle"
+	case handshakeKeysDerived:
+		return "keysDerived"
+	case handshakeEstablished:
+		return "established"
+	default:
+		return fmt.Sprintf("unknown(%d)", int32(s))
+	}
+}
+
+// handshakeStatus tells whether a handshake request was accepted
+type handshakeStatus uint8
+
+const (
+	handshakeAccepted handshakeStatus = iota
+	handshakeRejected
+)
+
+func (peer *peer) getHandshakeState() handshakeState {
+	return handshakeState(atomic.LoadInt32(&peer.handshakeState))
+}
+
+func (peer *peer) setHandshakeState(state handshakeState) {
+	log.Debug("Handshake state transition", "remote", peer.remote.Address.IA,
+		"from", peer.getHandshakeState(), "to", state)
+	atomic.StoreInt32(&peer.handshakeState, int32(state))
+}
+
+// keysReady returns whether session keys were derived and can be used by eConns
+func (peer *peer) keysReady() bool {
+	return peer.getHandshakeState() >= handshakeKeysDerived
+}
+
+// handshakeRequest mediates the access to the singleton handshake request sent to the remote
+func (peer *peer) handshakeRequest() (*handshakeRequestMsg, error) {
+	peer.handshakeRequestMutex.Lock()
+	defer peer.handshakeRequestMutex.Unlock()
+	if peer.localHandshakeReq != nil {
+		return peer.localHandshakeReq, nil
+	}
+	pubKey, err := peer.keyMgr.getPubKey()
+	if err != nil {
+		return nil, fmt.Errorf("error computing public key: %s", err)
+	}
+	sessionID := peer.newSessionID()
+	pubTag, err := peer.authenticator.Tag(handshakeTagInput(pubKey, sessionID))
+	if err != nil {
+		return nil, fmt.Errorf("error authenticating public key: %s", err)
+	}
+	peer.localHandshakeReq = &handshakeRequestMsg{PubKey: pubKey,
+		PubKeyTag:  pubTag,
+		SessionID:  sessionID,
+		CtrlPort:   getConnLocalPort(peer.ingressCtrlConn.conn),
+		DataPort:   getConnLocalPort(peer.ingressDataConn.conn),
+		AcceptPort: peer.gateway.localAcceptAddr().Host.Port,
+		Version:    protocolVersion,
+		MinVersion: minProtocolVersion,
+		Caps:       peer.gateway.localCapabilities()}
+	if a, ok := peer.authenticator.(chainAuthenticator); ok {
+		peer.localHandshakeReq.CertChain = a.CertChain()
+	}
+	return peer.localHandshakeReq, nil
+}
+
+// newSessionID returns an ID greater than the ones of the previous local sessions, handshakeRequestMutex must be held.
+// IDs are based on the current time so that they keep growing across restarts of the gateway.
+func (peer *peer) newSessionID() uint64 {
+	id := uint64(time.Now().UnixNano())
+	if id <= peer.lastSessionID {
+		id = peer.lastSessionID + 1
+	}
+	peer.lastSessionID = id
+	return id
+}
+
+// handshakeTagInput binds the session ID of a request to its public key, so that both are authenticated by the tag
+func handshakeTagInput(pubKey []byte, sessionID uint64) []byte {
+	b := make([]byte, len(pubKey)+8)
+	copy(b, pubKey)
+	binary.BigEndian.PutUint64(b[len(pubKey):], sessionID)
+	return b
+}
+
+// initHandshaking initiates a handshake process with a remote peer until it succeeds
+func (peer *peer) initHandshaking() {
+	if !atomic.CompareAndSwapInt32(&peer.handshaking, 0, 1) {
+		// Requests are already being sent
+		return
+	}
+	defer atomic.StoreInt32(&peer.handshaking, 0)
+	log.Debug("Initiating handshake with", "addr", peer.remoteAddr())
+	for peer.getHandshakeState() != handshakeEstablished {
+		// The request is fetched every time since a reset of the session replaces it
+		reqMsg, err := peer.handshakeRequest()
+		if err != nil {
+			log.Error("Error building handshake request", "err", err)
+			return
+		}
+		err = peer.writeMsgOneOff(reqMsg)
+		if err != nil {
+			log.Error("Error sending handshake request", "err", err)
+			return
+		}
+		log.Trace("Sent handshake request", "remote", peer.remoteAddr())
+		select {
+		case <-peer.stop:
+			return
+		case <-time.After(handshakeRetryInterval):
+		}
+	}
+}
+
+// verifyHandshakeRequest checks that the public key of a handshake request was authenticated by the remote
+func (peer *peer) verifyHandshakeRequest(reqMsg *handshakeRequestMsg) error {
+	if a, ok := peer.authenticator.(chainAuthenticator); ok {
+		return a.VerifyWithChain(reqMsg.CertChain, handshakeTagInput(reqMsg.PubKey, reqMsg.SessionID), reqMsg.PubKeyTag)
+	}
+	return peer.authenticator.Verify(handshakeTagInput(reqMsg.PubKey, reqMsg.SessionID), reqMsg.PubKeyTag)
+}
+
+// handleHandshakeRequest authenticates the request of the remote, sets up connections and keys with it,
+// and answers with a response confirming the derived keys (or with the reason of the rejection)
+func (peer *peer) handleHandshakeRequest(reqMsg *handshakeRequestMsg) {
+	peer.handshakeMutex.Lock()
+	defer peer.handshakeMutex.Unlock()
+	log.Debug("Handling handshake request", "remote", peer.remoteAddr(), "state", peer.getHandshakeState())
+	if peer.closed() {
+		return
+	}
+	if peer.getHandshakeState() != handshakeIdle {
+		if bytes.Equal(peer.remoteHandshakeReq.PubKey, reqMsg.PubKey) {
+			// The remote did not receive our response yet
+			peer.sendHandshakeResponse(peer.handshakeRes)
+			return
+		}
+		if reqMsg.SessionID <= peer.remoteHandshakeReq.SessionID {
+			log.Warn("Ignoring handshake request of a stale session", "remote", peer.remote.Address.IA,
+				"session", reqMsg.SessionID)
+			return
+		}
+	}
+
+	if err := peer.verifyHandshakeRequest(reqMsg); err != nil {
+		peer.rejectHandshakeRequest(err)
+		return
+	}
+	if peer.getHandshakeState() != handshakeIdle {
+		// The remote restarted (or lost its session), our keys and egress connections are set up again below
+		log.Info("Remote started a new session, re-handshaking", "remote", peer.remote.Address.IA,
+			"session", reqMsg.SessionID)
+		peer.resetSession()
+		go peer.initHandshaking()
+	}
+	localReq, err := peer.handshakeRequest()
+	if err != nil {
+		log.Error("Error building handshake request", "err", err)
+		return
+	}
+	caps, err := negotiateCapabilities(localReq, reqMsg)
+	if err != nil {
+		peer.rejectHandshakeRequest(err)
+		return
+	}
+
+	// Setup egress connections
+	peer.remoteCtrlPort, peer.remoteDataPort = reqMsg.CtrlPort, reqMsg.DataPort
+	// manually update paths to setup initial connection
+	err = peer.pathMgr.updatePathsToRemote()
+	if err != nil {
+		log.Error("Error updating paths to remote", "err", err)
+		return
+	}
+	err = peer.setupEgressConnections()
+	if err != nil {
+		log.Error("Error setting up egress connections", "err", err)
+		return
+	}
+
+	// Setup data plane crypto
+	err = peer.keyMgr.initDataCrypto(localReq, reqMsg, caps.suite)
+	if err != nil {
+		peer.rejectHandshakeRequest(fmt.Errorf("error computing shared key: %s", err))
+		return
+	}
+	log.Debug("Initialized data plane crypto", "remote", peer.remote.Address.IA, "suite", caps.suite)
+	log.Info("Negotiated capabilities", "remote", peer.remote.Address.IA, "version", caps.version,
+		"suite", caps.suite, "compression", caps.compression, "multipath", caps.multipath,
+		"adapterTypes", caps.adapterTypes)
+	peer.caps = caps
+	peer.setUsesAdapterIDs(caps.version >= adapterIDVersion)
+	peer.remoteHandshakeReq = reqMsg
+	peer.handshakeRes = &handshakeResponseMsg{Status: handshakeAccepted, Confirm: peer.keyMgr.handshakeConfirm()}
+	peer.setHandshakeState(handshakeKeysDerived)
+	peer.sendHandshakeResponse(peer.handshakeRes)
+}
+
+// rejectHandshakeRequest reports the reason of a rejected handshake request to the remote
+func (peer *peer) rejectHandshakeRequest(reason error) {
+	log.Error("Rejecting handshake request", "remote", peer.remote.Address.IA, "err", reason)
+	peer.sendHandshakeResponse(&handshakeResponseMsg{Status: handshakeRejected, Reason: reason.Error()})
+}
+
+// writeMsgOneOff sends a message over an ephemeral connection, complying with the path policy of the remote
+func (peer *peer) writeMsgOneOff(msg Message) error {
+	return peer.gateway.writeMsgOneOff(msg, peer.remoteAddr(), peer.pathMgr.getConf().policy)
+}
+
+func (peer *peer) sendHandshakeResponse(resMsg *handshakeResponseMsg) {
+	err := peer.writeMsgOneOff(resMsg)
+	if err != nil {
+		log.Error("Error sending handshake response msg", "err", err)
+	}
+}
+
+// handleHandshakeResponse verifies that the remote peer derived the same keys and completes the handshake
+func (peer *peer) handleHandshakeResponse(resMsg *handshakeResponseMsg) {
+	peer.handshakeMutex.Lock()
+	defer peer.handshakeMutex.Unlock()
+	log.Debug("Handling handshake response", "remote", peer.remoteAddr(), "state", peer.getHandshakeState())
+	if peer.closed() {
+		return
+	}
+	if resMsg.Status == handshakeRejected {
+		// The reason cannot be authenticated, hence it is only logged while we keep retrying
+		log.Error("Handshake rejected by remote", "remote", peer.remote.Address.IA, "reason", resMsg.Reason)
+		return
+	}
+	switch peer.getHandshakeState() {
+	case handshakeIdle:
+		// The confirmation cannot be verified yet, the remote sends it again upon our next request
+		log.Debug("Ignoring handshake response, keys not yet derived", "remote", peer.remote.Address.IA)
+		return
+	case handshakeEstablished:
+		return
+	}
+	if !peer.keyMgr.verifyHandshakeConfirm(resMsg.Confirm) {
+		log.Error("Invalid handshake confirmation", "remote", peer.remote.Address.IA)
+		return
+	}
+	peer.setHandshakeState(handshakeEstablished)
+	peer.completeHandshake()
+}
+
+// completeHandshake completes handshake process (e.g., starting the pathMgr)
+func (peer *peer) completeHandshake() {
+	log.Info("Completed handshake", "remote", peer.remote.Address.IA)
+	peer.sessionStop = make(chan struct{})
+	peer.pathMgr.start(peer.sessionStop)
+	go peer.keyMgr.rekeyer(peer.sessionStop)
+	for _, entry := range peer.gateway.adapters {
+		go entry.adapter.HandshakeComplete(adapterPeerWriter{peer: peer, id: entry.id})
+	}
+}
+
+// endSession stops the goroutines started upon the completion of the handshake, handshakeMutex must be held
+func (peer *peer) endSession() {
+	if peer.sessionStop != nil {
+		close(peer.sessionStop)
+		peer.sessionStop = nil
+	}
+}
+
+// resetHandshake drops the session with the remote and starts a new handshake with fresh keys
+func (peer *peer) resetHandshake() {
+	peer.handshakeMutex.Lock()
+	peer.resetSession()
+	peer.handshakeMutex.Unlock()
+	log.Info("Reset handshake", "remote", peer.remote.Address.IA)
+	go peer.initHandshaking()
+}
+
+// resetSession drops the session with the remote and the keys of its handshake, handshakeMutex must be held
+func (peer *peer) resetSession() {
+	peer.endSession()
+	peer.setHandshakeState(handshakeIdle)
+	peer.remoteHandshakeReq, peer.handshakeRes, peer.caps = nil, nil, nil
+	peer.setUsesAdapterIDs(false)
+	peer.keyMgr.wipe()
+	peer.handshakeRequestMutex.Lock()
+	peer.localHandshakeReq = nil
+	peer.handshakeRequestMutex.Unlock()
+	// The reliable messages of the remote start over with the new session
+	peer.reliableReceiver.reset()
+}
@@ -0,0 +1,197 @@
+/*
+Copyright (c) 2020, ETH and Andrea Tulimiero
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package gateway
+
+import (
+	"context"
+	"github.com/scionproto/scion/go/lib/snet"
+	"testing"
+)
+
+func TestHandshakeTranscriptMismatch(t *testing.T) {
+	tests := []struct {
+		name string
+		// tamper modifies the request of the first end as received by the second one
+		tamper   func(req *handshakeRequestMsg)
+		expected bool
+	}{
+		{name: "same requests", tamper: func(req *handshakeRequestMsg) {}, expected: true},
+		{name: "tampered ports", tamper: func(req *handshakeRequestMsg) { req.CtrlPort++ }},
+		{name: "tampered session ID", tamper: func(req *handshakeRequestMsg) { req.SessionID++ }},
+		{name: "downgraded version", tamper: func(req *handshakeRequestMsg) { req.Version = req.MinVersion }},
+		{
+			name: "stripped cipher suites",
+			tamper: func(req *handshakeRequestMsg) {
+				req.Caps.CipherSuites = []cipherSuite{cipherSuiteChaCha20Poly1305}
+			},
+		},
+		{name: "replaced tag", tamper: func(req *handshakeRequestMsg) { req.PubKeyTag = []byte("forged") }},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ks, reqs := newTestHandshake(t)
+			received := *reqs[0]
+			test.tamper(&received)
+			if err := ks[0].initDataCrypto(reqs[0], reqs[1], cipherSuiteAES256GCM); err != nil {
+				t.Fatal(err)
+			}
+			if err := ks[1].initDataCrypto(reqs[1], &received, cipherSuiteAES256GCM); err != nil {
+				t.Fatal(err)
+			}
+			if actual := ks[0].verifyHandshakeConfirm(ks[1].handshakeConfirm()); actual != test.expected {
+				t.Errorf("confirmation accepted = %t, expected %t", actual, test.expected)
+			}
+			if actual := ks[1].verifyHandshakeConfirm(ks[0].handshakeConfirm()); actual != test.expected {
+				t.Errorf("remote confirmation accepted = %t, expected %t", actual, test.expected)
+			}
+		})
+	}
+}
+
+func TestHandleHandshakeResponseRejections(t *testing.T) {
+	tests := []struct {
+		name     string
+		state    handshakeState
+		res      func(k *keyMgr) *handshakeResponseMsg
+		expected handshakeState
+	}{
+		{
+			name:  "bad key confirmation",
+			state: handshakeKeysDerived,
+			res: func(k *keyMgr) *handshakeResponseMsg {
+				confirm := append([]byte(nil), k.recvConfirm...)
+				confirm[0] ^= 1
+				return &handshakeResponseMsg{Status: handshakeAccepted, Confirm: confirm}
+			},
+			expected: handshakeKeysDerived,
+		},
+		{
+			name:  "reflected key confirmation",
+			state: handshakeKeysDerived,
+			res: func(k *keyMgr) *handshakeResponseMsg {
+				return &handshakeResponseMsg{Status: handshakeAccepted, Confirm: k.handshakeConfirm()}
+			},
+			expected: handshakeKeysDerived,
+		},
+		{
+			name:  "missing key confirmation",
+			state: handshakeKeysDerived,
+			res: func(k *keyMgr) *handshakeResponseMsg {
+				return &handshakeResponseMsg{Status: handshakeAccepted}
+			},
+			expected: handshakeKeysDerived,
+		},
+		{
+			name:  "rejected",
+			state: handshakeKeysDerived,
+			res: func(k *keyMgr) *handshakeResponseMsg {
+				return &handshakeResponseMsg{Status: handshakeRejected, Reason: "test", Confirm: k.recvConfirm}
+			},
+			expected: handshakeKeysDerived,
+		},
+		{
+			name:  "keys not yet derived",
+			state: handshakeIdle,
+			res: func(k *keyMgr) *handshakeResponseMsg {
+				return &handshakeResponseMsg{Status: handshakeAccepted, Confirm: k.recvConfirm}
+			},
+			expected: handshakeIdle,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ks, reqs := newTestHandshake(t)
+			if err := ks[0].initDataCrypto(reqs[0], reqs[1], cipherSuiteAES256GCM); err != nil {
+				t.Fatal(err)
+			}
+			peer := ks[0].peer
+			peer.keyMgr, peer.stop = ks[0], make(chan struct{})
+			peer.setHandshakeState(test.state)
+			peer.handleHandshakeResponse(test.res(ks[0]))
+			if actual := peer.getHandshakeState(); actual != test.expected {
+				t.Errorf("state = %s, expected %s", actual, test.expected)
+			}
+		})
+	}
+}
+
+func TestRemoteRestart(t *testing.T) {
+	d, sd := newTestTestbed()
+	a, b := newTestPair(t, d, sd)
+	p, err := b.getPeer(a.conf.Address.IA.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldSession := p.keyMgr.sendSession()
+
+	// a crashes: its goodbye is lost, so b learns about the restart from the new handshake only
+	d.setDrop(func(pkt *snet.Packet) bool { return pkt.Source.IA.Equal(a.conf.Address.IA) })
+	if err := a.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	d.setDrop(nil)
+	if state := p.getHandshakeState(); state != handshakeEstablished {
+		t.Fatalf("expected = %s, actual = %s", handshakeEstablished, state)
+	}
+	restarted := newTestGateway(t, d, sd, testGatewayConf("1-ff00:0:1,[127.0.0.1]:30041", "1-ff00:0:2,[127.0.0.2]:30041"),
+		"1-ff00:0:2")
+	restarted.adapter.waitHandshake(t, b.conf.Address.IA)
+	b.adapter.waitHandshake(t, a.conf.Address.IA)
+
+	if actual, err := b.getPeer(a.conf.Address.IA.String()); err != nil || actual != p {
+		t.Fatal("peer not re-handshaked in place")
+	}
+	if p.keyMgr.sendSession() == oldSession {
+		t.Error("session keys not renewed")
+	}
+	restarted.ProcessEgressPkt([]byte("after restart"))
+	if actual := string(b.adapter.waitReceived(t)); actual != "after restart" {
+		t.Errorf("expected = %q, actual = %q", "after restart", actual)
+	}
+	b.ProcessEgressPkt([]byte("reply"))
+	if actual := string(restarted.adapter.waitReceived(t)); actual != "reply" {
+		t.Errorf("expected = %q, actual = %q", "reply", actual)
+	}
+}
+
+func TestHandshakeStaleSession(t *testing.T) {
+	d, sd := newTestTestbed()
+	a, b := newTestPair(t, d, sd)
+	p, err := b.getPeer(a.conf.Address.IA.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	session := p.keyMgr.sendSession()
+	p.handshakeMutex.Lock()
+	stale := *p.remoteHandshakeReq
+	p.handshakeMutex.Unlock()
+	stale.PubKey = append([]byte{0}, stale.PubKey[1:]...)
+	stale.SessionID--
+	p.handleHandshakeRequest(&stale)
+	if state := p.getHandshakeState(); state != handshakeEstablished {
+		t.Errorf("expected = %s, actual = %s", handshakeEstablished, state)
+	}
+	if p.keyMgr.sendSession() != session {
+		t.Error("session keys replaced by a stale session")
+	}
+}
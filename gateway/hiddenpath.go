@@ -110,6 +110,9 @@ func (m *pathMgr) combineHiddenSegments(localPathSegment, remotePathSegment *seg
 }
 
 func (m *pathMgr) storeHiddenPaths(paths []snet.Path) {
+	if policy := m.getConf().policy; policy != nil {
+		paths = policy.filter(paths)
+	}
 	log.Info("Adding hidden path", "entries", paths)
 	m.pathsUpdateMutex.Lock()
 	defer m.pathsUpdateMutex.Unlock()
@@ -133,7 +136,7 @@ func (m *pathMgr) sendHiddenPath() error {
 	}
 	hiddenPathMsg := &hiddenPathRequestMsg{PathSegment: *localPathSegment}
 	log.Debug("Sending hidden paths ...")
-	err = m.peer.WriteMsg(hiddenPathMsg)
+	err = m.peer.WriteMsgReliable(context.Background(), hiddenPathMsg)
 	if err != nil {
 		return fmt.Errorf("couldn't send hidden paths: %s", err)
 	}
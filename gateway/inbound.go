@@ -0,0 +1,256 @@
+/*
+Copyright (c) 2020, ETH and Andrea Tulimiero
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package gateway
+
+import (
+	"errors"
+	"fmt"
+	"github.com/scionproto/scion/go/lib/addr"
+	"github.com/scionproto/scion/go/lib/log"
+	"github.com/scionproto/scion/go/lib/snet"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	defaultInboundConf = inboundConf{
+		IdleTimeout: 5 * time.Minute,
+		MaxPeers:    64,
+	}
+	inboundNotAllowedError = errors.New("remote not allowed by the inbound policy")
+)
+
+// inboundConf configures the acceptance of handshakes from remotes that are not configured.
+// Remotes are matched by their IA, which is authenticated during the handshake (e.g., with drkey or cert).
+type inboundConf struct {
+	// Allow lists the rules of the remotes that are accepted, none by default
+	Allow []inboundRule
+	// Auth selects how the handshake with inbound remotes is authenticated.
+	// Only drkey and cert bind the credential to the IA of the remote: any holder of a psk or ed25519 key
+	// can claim to be any of the allowed remotes.
+	Auth AuthConf
+	// IdleTimeout is the inactivity after which an inbound peer is removed
+	IdleTimeout time.Duration `yaml:"idleTimeout"`
+	// MaxPeers bounds the number of inbound peers
+	MaxPeers int `yaml:"maxPeers"`
+}
+
+// inboundRule matches the remotes satisfying all its fields, empty fields match any remote
+type inboundRule struct {
+	// ISD matches the ASes of an ISD
+	ISD addr.ISD `yaml:"isd"`
+	// ASRange matches the ASes in an inclusive range (e.g., ff00:0:100-ff00:0:1ff)
+	ASRange string `yaml:"asRange"`
+	// IA matches a single AS
+	IA *YIA `yaml:"ia"`
+}
+
+// inboundMatcher is a parsed inboundRule
+type inboundMatcher struct {
+	isd             addr.ISD
+	firstAS, lastAS addr.AS
+	matchASRange    bool
+	ia              *addr.IA
+}
+
+func (m inboundMatcher) matches(ia addr.IA) bool {
+	if m.isd != 0 && ia.I != m.isd {
+		return false
+	}
+	if m.matchASRange && (ia.A < m.firstAS || ia.A > m.lastAS) {
+		return false
+	}
+	if m.ia != nil && !m.ia.Equal(ia) {
+		return false
+	}
+	return true
+}
+
+// inboundPolicy accepts the remotes matched by any of its matchers
+type inboundPolicy []inboundMatcher
+
+func newInboundPolicy(rules []inboundRule) (inboundPolicy, error) {
+	var policy inboundPolicy
+	for _, rule := range rules {
+		m := inboundMatcher{isd: rule.ISD}
+		if rule.IA != nil {
+			m.ia = rule.IA.IA
+		}
+		if rule.ASRange != "" {
+			bounds := strings.Split(rule.ASRange, "-")
+			if len(bounds) != 2 {
+				return nil, fmt.Errorf("invalid AS range: %s", rule.ASRange)
+			}
+			var err error
+			if m.firstAS, err = addr.ASFromString(bounds[0]); err != nil {
+				return nil, fmt.Errorf("invalid AS range: %s: %s", rule.ASRange, err)
+			}
+			if m.lastAS, err = addr.ASFromString(bounds[1]); err != nil {
+				return nil, fmt.Errorf("invalid AS range: %s: %s", rule.ASRange, err)
+			}
+			m.matchASRange = true
+		}
+		if m.isd == 0 && !m.matchASRange && m.ia == nil {
+			return nil, fmt.Errorf("inbound rule without fields")
+		}
+		policy = append(policy, m)
+	}
+	return policy, nil
+}
+
+func (p inboundPolicy) allows(ia addr.IA) bool {
+	for _, m := range p {
+		if m.matches(ia) {
+			return true
+		}
+	}
+	return false
+}
+
+// acceptInboundPeer creates a peer for an unconfigured remote allowed by the inbound policy,
+// once its handshake request is authenticated
+func (gateway *Gateway) acceptInboundPeer(reqMsg *handshakeRequestMsg, raddr *snet.UDPAddr) (*peer, error) {
+	if !gateway.inboundPolicy.allows(raddr.IA) {
+		return nil, inboundNotAllowedError
+	}
+	remoteAddr := &snet.UDPAddr{IA: raddr.IA, Host: &net.UDPAddr{IP: raddr.Host.IP, Port: reqMsg.AcceptPort}}
+	remoteConf := ConnConf{
+		Address:     YUDPAddr{remoteAddr},
+		Description: "inbound",
+		Auth:        gateway.conf.Inbound.Auth,
+	}
+	pathing, err := gateway.pathingFor(remoteConf)
+	if err != nil {
+		return nil, err
+	}
+	// No connection is bound before the remote is authenticated
+	peer, err := newUnboundPeer(gateway, remoteConf, pathing)
+	if err != nil {
+		return nil, err
+	}
+	if err := peer.verifyHandshakeRequest(reqMsg); err != nil {
+		return nil, err
+	}
+	peer.inbound = true
+	if err := peer.startIngressHandlers(); err != nil {
+		return nil, err
+	}
+
+	remoteIA := raddr.IA.String()
+	gateway.peersMutex.Lock()
+	if existing, ok := gateway.asClientMap[remoteIA]; ok {
+		// Another request of the remote was accepted in the meantime
+		gateway.peersMutex.Unlock()
+		peer.close()
+		return existing, nil
+	}
+	if gateway.countInboundPeers() >= gateway.conf.Inbound.MaxPeers {
+		gateway.peersMutex.Unlock()
+		peer.close()
+		return nil, fmt.Errorf("too many inbound peers: %d", gateway.conf.Inbound.MaxPeers)
+	}
+	gateway.asClientMap[remoteIA] = peer
+	gateway.peersMutex.Unlock()
+	log.Info("Accepted inbound peer", "remote", remoteAddr)
+	go peer.initHandshaking()
+	return peer, nil
+}
+
+// countInboundPeers returns the number of inbound peers, peersMutex must be held
+func (gateway *Gateway) countInboundPeers() int {
+	count := 0
+	for _, peer := range gateway.asClientMap {
+		if peer.inbound {
+			count++
+		}
+	}
+	return count
+}
+
+// inboundPeersCollector periodically removes the inbound peers idle for longer than IdleTimeout,
+// and the reassemblers of inbound remotes that are done
+func (gateway *Gateway) inboundPeersCollector() {
+	t := time.NewTicker(inboundCollectInterval)
+	for {
+		select {
+		case <-gateway.stop:
+			t.Stop()
+			return
+		case <-t.C:
+			gateway.evictIdleReassemblers()
+			var idle []addr.IA
+			gateway.peersMutex.RLock()
+			for _, peer := range gateway.asClientMap {
+				if peer.inbound && peer.idleTime() > gateway.conf.Inbound.IdleTimeout {
+					idle = append(idle, peer.remote.Address.IA)
+				}
+			}
+			gateway.peersMutex.RUnlock()
+			for _, IA := range idle {
+				log.Info("Removing idle inbound peer", "remote", IA)
+				if err := gateway.RemovePeer(IA); err != nil {
+					log.Debug("Error removing idle inbound peer", "remote", IA, "err", err)
+				}
+			}
+		}
+	}
+}
+
+// inboundReassembler returns the reassembler of the fragments of a remote that has no peer yet,
+// at most MaxPeers remotes are reassembling at the same time
+func (gateway *Gateway) inboundReassembler(IA addr.IA) (*reassembler, error) {
+	gateway.inboundReassemblersMutex.Lock()
+	defer gateway.inboundReassemblersMutex.Unlock()
+	if r, ok := gateway.inboundReassemblers[IA]; ok {
+		return r, nil
+	}
+	if len(gateway.inboundReassemblers) >= gateway.conf.Inbound.MaxPeers {
+		return nil, tooManyReassemblersError
+	}
+	r := newReassembler(acceptReassemblyMemLimit)
+	gateway.inboundReassemblers[IA] = r
+	return r, nil
+}
+
+// evictIdleReassemblers drops the reassemblers of inbound remotes that are not reassembling any message
+func (gateway *Gateway) evictIdleReassemblers() {
+	gateway.inboundReassemblersMutex.Lock()
+	defer gateway.inboundReassemblersMutex.Unlock()
+	for IA, r := range gateway.inboundReassemblers {
+		if r.idle() {
+			delete(gateway.inboundReassemblers, IA)
+		}
+	}
+}
+
+// idleTime returns the time elapsed since the last packet received from the remote
+func (peer *peer) idleTime() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&peer.counters.lastActivity)))
+}
+
+// touch records the reception of a packet from the remote
+func (peer *peer) touch() {
+	atomic.StoreInt64(&peer.counters.lastActivity, time.Now().UnixNano())
+}
@@ -0,0 +1,182 @@
+/*
+Copyright (c) 2020, ETH and Andrea Tulimiero
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package gateway
+
+import (
+	"encoding/base64"
+	"fmt"
+	"github.com/scionproto/scion/go/lib/snet"
+	"gopkg.in/yaml.v2"
+	"net"
+	"sync"
+	"testing"
+)
+
+func TestInboundPolicy(t *testing.T) {
+	rules := `
+- isd: 1
+- isd: 2
+  asRange: ff00:0:200-ff00:0:2ff
+- ia: 3-ff00:0:310
+`
+	var parsed []inboundRule
+	if err := yaml.Unmarshal([]byte(rules), &parsed); err != nil {
+		t.Fatal(err)
+	}
+	policy, err := newInboundPolicy(parsed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		ia       string
+		expected bool
+	}{
+		{ia: "1-ff00:0:1", expected: true},
+		{ia: "2-ff00:0:200", expected: true},
+		{ia: "2-ff00:0:2ff", expected: true},
+		{ia: "2-ff00:0:300", expected: false},
+		{ia: "2-ff00:0:1ff", expected: false},
+		{ia: "3-ff00:0:310", expected: true},
+		{ia: "3-ff00:0:311", expected: false},
+		{ia: "4-ff00:0:310", expected: false},
+	}
+	for _, test := range tests {
+		if actual := policy.allows(mustIA(t, test.ia)); actual != test.expected {
+			t.Errorf("%s: expected = %t, actual = %t", test.ia, test.expected, actual)
+		}
+	}
+}
+
+func TestNewInboundPolicyErrors(t *testing.T) {
+	for _, rule := range []inboundRule{{}, {ASRange: "ff00:0:1"}, {ASRange: "ff00:0:1-x"}, {ASRange: "x-ff00:0:1"}} {
+		if _, err := newInboundPolicy([]inboundRule{rule}); err == nil {
+			t.Errorf("%+v: expected error", rule)
+		}
+	}
+}
+
+const testInboundAddr = "1-ff00:0:2,[127.0.0.2]:30041"
+
+// testInboundConf returns the configuration of a gateway accepting up to maxPeers remotes of ISD 1
+// authenticated with testPSK
+func testInboundConf(maxPeers int) string {
+	return testGatewayConf(testInboundAddr) + fmt.Sprintf(
+		"inbound:\n  allow:\n    - isd: 1\n  auth: {type: psk, psk: %q}\n  maxPeers: %d\n", testPSK, maxPeers)
+}
+
+// testInboundRequest returns a handshake request of remoteIA toward testInboundAddr, tagged with psk
+func testInboundRequest(t *testing.T, remoteIA string, psk []byte) (*handshakeRequestMsg, *snet.UDPAddr) {
+	t.Helper()
+	auth := AuthConf{Type: authTypePSK, PSK: base64.StdEncoding.EncodeToString(psk)}
+	tagger := newTestAuthPeer(t, remoteIA, "1-ff00:0:2", auth, nil)
+	a, err := tagger.gateway.newAuthenticator(tagger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reqMsg := &handshakeRequestMsg{PubKey: []byte("public key"), SessionID: 1, AcceptPort: 30041}
+	if reqMsg.PubKeyTag, err = a.Tag(handshakeTagInput(reqMsg.PubKey, reqMsg.SessionID)); err != nil {
+		t.Fatal(err)
+	}
+	raddr := &snet.UDPAddr{IA: mustIA(t, remoteIA), Host: &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 40000}}
+	return reqMsg, raddr
+}
+
+func TestAcceptInboundPeer(t *testing.T) {
+	d, sd := newTestTestbed()
+	b := newTestGateway(t, d, sd, testInboundConf(1), "1-ff00:0:1")
+	a := newTestGateway(t, d, sd, testGatewayConf("1-ff00:0:1,[127.0.0.1]:30041", testInboundAddr), "1-ff00:0:2")
+	a.adapter.waitHandshake(t, b.conf.Address.IA)
+	b.adapter.waitHandshake(t, a.conf.Address.IA)
+	p, err := b.getPeer("1-ff00:0:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !p.inbound {
+		t.Error("accepted peer not inbound")
+	}
+	a.ProcessEgressPkt([]byte("request"))
+	if actual := string(b.adapter.waitReceived(t)); actual != "request" {
+		t.Errorf("expected = %q, actual = %q", "request", actual)
+	}
+	b.ProcessEgressPkt([]byte("response"))
+	if actual := string(a.adapter.waitReceived(t)); actual != "response" {
+		t.Errorf("expected = %q, actual = %q", "response", actual)
+	}
+}
+
+func TestAcceptInboundPeerRejections(t *testing.T) {
+	tests := []struct {
+		name     string
+		remoteIA string
+		psk      []byte
+		maxPeers int
+		// binds tells whether connections are bound before the rejection
+		binds bool
+	}{
+		{name: "not allowed", remoteIA: "2-ff00:0:1", psk: []byte("test psk"), maxPeers: 1},
+		{name: "wrong psk", remoteIA: "1-ff00:0:1", psk: []byte("other psk"), maxPeers: 1},
+		{name: "no inbound peers", remoteIA: "1-ff00:0:1", psk: []byte("test psk"), maxPeers: 0, binds: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			d, sd := newTestTestbed()
+			b := newTestGateway(t, d, sd, testInboundConf(test.maxPeers), "")
+			conns, registrations := d.numConns(), d.numRegistrations()
+			reqMsg, raddr := testInboundRequest(t, test.remoteIA, test.psk)
+			if _, err := b.acceptInboundPeer(reqMsg, raddr); err == nil {
+				t.Fatal("expected error")
+			}
+			if _, err := b.getPeer(test.remoteIA); err == nil {
+				t.Error("rejected remote has a peer")
+			}
+			if actual := d.numConns(); actual != conns {
+				t.Errorf("expected = %d open connections, actual = %d", conns, actual)
+			}
+			if bound := d.numRegistrations() != registrations; bound != test.binds {
+				t.Errorf("expected bound = %t, actual = %t", test.binds, bound)
+			}
+		})
+	}
+}
+
+func TestAcceptInboundPeerMaxPeers(t *testing.T) {
+	const maxPeers, remotes = 2, 8
+	d, sd := newTestTestbed()
+	b := newTestGateway(t, d, sd, testInboundConf(maxPeers), "")
+	var wg sync.WaitGroup
+	for i := 0; i < remotes; i++ {
+		reqMsg, raddr := testInboundRequest(t, fmt.Sprintf("1-ff00:0:%x", 0x10+i), []byte("test psk"))
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			b.acceptInboundPeer(reqMsg, raddr)
+		}()
+	}
+	wg.Wait()
+	b.peersMutex.RLock()
+	actual := b.countInboundPeers()
+	b.peersMutex.RUnlock()
+	if actual != maxPeers {
+		t.Errorf("expected = %d inbound peers, actual = %d", maxPeers, actual)
+	}
+}
@@ -24,102 +24,291 @@ package gateway
 
 import (
 	"bytes"
-	"crypto/aes"
 	"crypto/cipher"
-	"github.com/aead/cmac"
-	"github.com/monnand/dhkx"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"github.com/scionproto/scion/go/lib/log"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
-type keyMgr struct {
-	peer             *peer
-	group            *dhkx.DHGroup
-	priKey           *dhkx.DHKey
-	pubKey           []byte
-	key              []byte
-	iv               []byte
-	block            cipher.Block
-	pubKeyCheckMutex sync.Mutex
+const (
+	// nonceLen is the length of the AEAD nonces, i.e., 4 zero bytes followed by the packet counter
+	nonceLen = 12
+)
+
+// pktChannel identifies the channel (i.e., ctrl or data) an eConn belongs to
+type pktChannel uint8
+
+const (
+	ctrlChannel pktChannel = iota
+	dataChannel
+	numPktChannels
+)
+
+func (c pktChannel) String() string {
+	switch c {
+	case ctrlChannel:
+		return "ctrl"
+	case dataChannel:
+		return "data"
+	default:
+		return fmt.Sprintf("unknown(%d)", uint8(c))
+	}
 }
 
-func newKeyMgr(peer *peer) *keyMgr {
-	return &keyMgr{peer: peer}
+// channelKeys holds the keys of a channel in a key epoch, each direction having its own key
+type channelKeys struct {
+	// pktCounter is the counter (i.e., sequence number) of the last packet sent.
+	// It is accessed atomically and kept first for 64-bit alignment
+	pktCounter uint64
+	sendAEAD   cipher.AEAD
+	recvAEAD   cipher.AEAD
+	// replayWindow tracks the packet counters received on the channel
+	replayWindow replayWindow
+}
+
+// nextPktCounter returns a fresh packet counter to be used in the header of an outgoing packet
+func (c *channelKeys) nextPktCounter() uint64 {
+	return atomic.AddUint64(&c.pktCounter, 1)
 }
 
-// initDataCrypto initializes data plane crypto structures
-func (k *keyMgr) initDataCrypto(remotePubKey []byte) error {
-	if len(k.key) != 0 {
-		panic("Key was already initialized")
+// sessionKey holds the key material of a key epoch
+type sessionKey struct {
+	// sentBytes is the number of bytes sent with this key epoch.
+	// It is accessed atomically and kept first for 64-bit alignment
+	sentBytes uint64
+	epoch     uint8
+	// transcript is the hash binding the key epoch to the exchanges which established it
+	transcript []byte
+	channels   [numPktChannels]*channelKeys
+	createdAt  time.Time
+}
+
+// newSessionKey derives the keys of a key epoch from a DH shared secret salted with the transcript hash.
+// Keys are separated by channel and direction, where directions are identified by the side with the lower public key.
+func newSessionKey(epoch uint8, suite cipherSuite, sharedSecret, transcript []byte, lowSide bool) (*sessionKey, error) {
+	s := &sessionKey{epoch: epoch, transcript: transcript, createdAt: time.Now()}
+	for ch := pktChannel(0); ch < numPktChannels; ch++ {
+		var aeads [2]cipher.AEAD
+		for i, direction := range []string{"low->high", "high->low"} {
+			key, err := deriveKey(sharedSecret, transcript, fmt.Sprintf("seg %s %s", ch, direction), sessionKeyLen)
+			if err != nil {
+				return nil, err
+			}
+			aeads[i], err = suite.newAEAD(key)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if lowSide {
+			s.channels[ch] = &channelKeys{sendAEAD: aeads[0], recvAEAD: aeads[1]}
+		} else {
+			s.channels[ch] = &channelKeys{sendAEAD: aeads[1], recvAEAD: aeads[0]}
+		}
 	}
+	return s, nil
+}
+
+// buildNonce returns the nonce of a packet, which is unique since every direction has its own key
+func buildNonce(pktCounter uint64) []byte {
+	nonce := make([]byte, nonceLen)
+	binary.BigEndian.PutUint64(nonce[nonceLen-8:], pktCounter)
+	return nonce
+}
+
+// handshakeTranscript returns the hash of the handshake requests of both ends, ordered by their public keys
+func handshakeTranscript(lowReq, highReq *handshakeRequestMsg) []byte {
+	h := sha256.New()
+	h.Write([]byte("seg handshake"))
+	lowReq.writeTranscript(h)
+	highReq.writeTranscript(h)
+	return h.Sum(nil)
+}
 
-	err := k.computeSharedKey(remotePubKey)
+// rekeyTranscript returns the hash binding a new key epoch to the previous one and to its DH exchange
+func rekeyTranscript(prevTranscript []byte, epoch uint8, reqPubKey, resPubKey []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte("seg rekey"))
+	h.Write(prevTranscript)
+	h.Write([]byte{epoch})
+	writeTranscriptField(h, reqPubKey)
+	writeTranscriptField(h, resPubKey)
+	return h.Sum(nil)
+}
+
+type keyMgr struct {
+	peer *peer
+	// X25519 key pair used in the handshake
+	priKey []byte
+	pubKey []byte
+	suite  cipherSuite
+	// lowSide tells whether the local public key of the handshake is the lower one, it is used to break symmetries
+	lowSide bool
+	// currSession is used to send packets, prevSession is still accepted until prevSessionExpiry,
+	// and nextSession (installed when answering a rekey request) is promoted upon its first use by the remote,
+	// or dropped at nextSessionExpiry
+	sessionsMutex     sync.RWMutex
+	currSession       *sessionKey
+	prevSession       *sessionKey
+	nextSession       *sessionKey
+	prevSessionExpiry time.Time
+	nextSessionExpiry time.Time
+	// sendConfirm and recvConfirm are the key confirmations of the handshake
+	sendConfirm []byte
+	recvConfirm []byte
+	// Rekeying
+	rekeyMutex        sync.Mutex
+	pendingRekey      *pendingRekey
+	lastRekeyRequest  *rekeyRequestMsg
+	lastRekeyResponse *rekeyResponseMsg
+	rekeyTrigger      chan struct{}
+	pubKeyCheckMutex  sync.Mutex
+}
+
+func newKeyMgr(peer *peer) *keyMgr {
+	return &keyMgr{peer: peer, rekeyTrigger: make(chan struct{}, 1)}
+}
+
+// initDataCrypto initializes data plane crypto structures using the negotiated cipher suite.
+// The handshake requests exchanged by the two ends are bound into the derived keys.
+func (k *keyMgr) initDataCrypto(localReq, remoteReq *handshakeRequestMsg, suite cipherSuite) error {
+	sharedSecret, err := computeSharedSecret(k.priKey, remoteReq.PubKey)
 	if err != nil {
 		return err
 	}
-	k.block, err = aes.NewCipher(k.key[:32])
+	var transcript []byte
+	lowSide := bytes.Compare(localReq.PubKey, remoteReq.PubKey) < 0
+	if lowSide {
+		transcript = handshakeTranscript(localReq, remoteReq)
+	} else {
+		transcript = handshakeTranscript(remoteReq, localReq)
+	}
+	session, err := newSessionKey(0, suite, sharedSecret, transcript, lowSide)
 	if err != nil {
 		return err
 	}
-	k.iv = bytes.Repeat([]byte{0x0}, aes.BlockSize)
+	var confirms [2][]byte
+	for i, direction := range []string{"low->high", "high->low"} {
+		key, err := deriveKey(sharedSecret, transcript, "seg confirm "+direction, sha256.Size)
+		if err != nil {
+			return err
+		}
+		mac := hmac.New(sha256.New, key)
+		mac.Write(transcript)
+		confirms[i] = mac.Sum(nil)
+	}
+	if lowSide {
+		k.sendConfirm, k.recvConfirm = confirms[0], confirms[1]
+	} else {
+		k.sendConfirm, k.recvConfirm = confirms[1], confirms[0]
+	}
+	k.sessionsMutex.Lock()
+	defer k.sessionsMutex.Unlock()
+	k.suite, k.lowSide = suite, lowSide
+	k.currSession, k.prevSession, k.nextSession = session, nil, nil
 	return nil
 }
 
-// computePriPubPair computes a private/public DH pair
-func (k *keyMgr) computePriPubPair() error {
-	var err error
-	k.group, err = dhkx.GetGroup(0)
-	if err != nil {
-		return err
-	}
-	k.priKey, err = k.group.GeneratePrivateKey(nil)
-	if err != nil {
-		return err
+// handshakeConfirm returns the key confirmation to be sent to the remote
+func (k *keyMgr) handshakeConfirm() []byte {
+	return k.sendConfirm
+}
+
+// verifyHandshakeConfirm returns whether the key confirmation received from the remote matches the derived keys
+func (k *keyMgr) verifyHandshakeConfirm(confirm []byte) bool {
+	return len(k.recvConfirm) != 0 && hmac.Equal(confirm, k.recvConfirm)
+}
+
+// sendSession returns the session key to be used for outgoing packets
+func (k *keyMgr) sendSession() *sessionKey {
+	k.sessionsMutex.RLock()
+	defer k.sessionsMutex.RUnlock()
+	return k.currSession
+}
+
+// recvSession returns the session key of a key epoch, if it is still accepted for incoming packets
+func (k *keyMgr) recvSession(epoch uint8) *sessionKey {
+	k.sessionsMutex.RLock()
+	defer k.sessionsMutex.RUnlock()
+	switch {
+	case k.currSession != nil && k.currSession.epoch == epoch:
+		return k.currSession
+	case k.nextSession != nil && k.nextSession.epoch == epoch:
+		return k.nextSession
+	case k.prevSession != nil && k.prevSession.epoch == epoch && time.Now().Before(k.prevSessionExpiry):
+		return k.prevSession
 	}
-	k.pubKey = k.priKey.Bytes()
 	return nil
 }
 
-// getPubKey mediates the access to the singleton pubKey (and priKey in turn)
-func (k *keyMgr) getPubKey() ([]byte, error) {
-	k.pubKeyCheckMutex.Lock()
-	defer k.pubKeyCheckMutex.Unlock()
-	if len(k.pubKey) == 0 {
-		if err := k.computePriPubPair(); err != nil {
-			return nil, err
-		}
+// installSession switches outgoing packets to a new session key, still accepting the current one for a while
+func (k *keyMgr) installSession(session *sessionKey) {
+	k.sessionsMutex.Lock()
+	defer k.sessionsMutex.Unlock()
+	k.prevSession, k.prevSessionExpiry = k.currSession, time.Now().Add(k.peer.gateway.conf.Rekey.Overlap)
+	k.currSession, k.nextSession = session, nil
+	log.Info("Switched key epoch", "remote", k.peer.remote.Address.IA, "epoch", session.epoch)
+}
+
+// promoteSession installs the next session key once the remote started using it
+func (k *keyMgr) promoteSession(session *sessionKey) {
+	k.sessionsMutex.RLock()
+	isNext := k.nextSession == session
+	k.sessionsMutex.RUnlock()
+	if isNext {
+		k.installSession(session)
 	}
-	return k.pubKey, nil
 }
 
-// getAuthdPubKey returns an authenticated pubKey using getCMAC keyed with authKey
-func (k *keyMgr) getAuthdPubKey(authKey []byte) ([]byte, []byte, error) {
-	pubKey, err := k.getPubKey()
-	if err != nil {
-		return nil, nil, err
+// accountSentBytes keeps track of the bytes sent with a session key and triggers a rekey when needed
+func (k *keyMgr) accountSentBytes(session *sessionKey, n int) {
+	sentBytes, maxBytes := atomic.AddUint64(&session.sentBytes, uint64(n)), k.peer.gateway.conf.Rekey.Bytes
+	if maxBytes == 0 || sentBytes < maxBytes {
+		return
 	}
-	pubTag, err := getCMAC(pubKey, authKey)
-	if err != nil {
-		return nil, nil, err
+	select {
+	case k.rekeyTrigger <- struct{}{}:
+	default:
+		// A rekey was already triggered
 	}
-	return pubKey, pubTag, nil
 }
 
-// verifyRemotePubKey verifies that tag is the CMAC (keyed with authKey) of key
-func (k *keyMgr) verifyRemotePubKey(tag []byte, key []byte, authKey []byte) (bool, error) {
-	// Check remote key authenticity
-	c, err := aes.NewCipher(authKey)
-	if err != nil {
-		return false, err
+// wipe drops all session keys and the handshake key pair
+func (k *keyMgr) wipe() {
+	k.rekeyMutex.Lock()
+	k.pendingRekey, k.lastRekeyRequest, k.lastRekeyResponse = nil, nil, nil
+	k.rekeyMutex.Unlock()
+	k.sessionsMutex.Lock()
+	k.currSession, k.prevSession, k.nextSession = nil, nil, nil
+	k.sessionsMutex.Unlock()
+	k.pubKeyCheckMutex.Lock()
+	for i := range k.priKey {
+		k.priKey[i] = 0
 	}
-	return cmac.Verify(tag, key, c, len(authKey)), nil
+	k.priKey, k.pubKey = nil, nil
+	k.pubKeyCheckMutex.Unlock()
+	k.sendConfirm, k.recvConfirm = nil, nil
 }
 
-// computeSharedKey completes the DH key exchange and stores the results in the keyMgr
-func (k *keyMgr) computeSharedKey(remotePubKey []byte) error {
-	key, err := k.group.ComputeKey(dhkx.NewPublicKey(remotePubKey), k.priKey)
-	if err != nil {
-		return err
+// computePriPubPair computes the private/public X25519 pair used in the handshake
+func (k *keyMgr) computePriPubPair() error {
+	var err error
+	k.priKey, k.pubKey, err = newX25519KeyPair()
+	return err
+}
+
+// getPubKey mediates the access to the singleton pubKey (and priKey in turn)
+func (k *keyMgr) getPubKey() ([]byte, error) {
+	k.pubKeyCheckMutex.Lock()
+	defer k.pubKeyCheckMutex.Unlock()
+	if len(k.pubKey) == 0 {
+		if err := k.computePriPubPair(); err != nil {
+			return nil, err
+		}
 	}
-	k.key = key.Bytes()
-	return nil
+	return k.pubKey, nil
 }
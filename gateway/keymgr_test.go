@@ -0,0 +1,204 @@
+/*
+Copyright (c) 2020, ETH and Andrea Tulimiero
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package gateway
+
+import (
+	"bytes"
+	"github.com/scionproto/scion/go/lib/snet"
+	"net"
+	"testing"
+	"time"
+)
+
+// newTestKeyMgr returns a keyMgr accepting the previous key epoch for overlap after a switch
+func newTestKeyMgr(overlap time.Duration) *keyMgr {
+	gateway := &Gateway{conf: conf{Rekey: rekeyConf{Overlap: overlap}}}
+	peer := &peer{gateway: gateway, remote: ConnConf{Address: YUDPAddr{&snet.UDPAddr{Host: &net.UDPAddr{}}}}}
+	peer.keyMgr = newKeyMgr(peer)
+	return peer.keyMgr
+}
+
+func newTestSessionKey(t *testing.T, epoch uint8) *sessionKey {
+	secret, transcript := bytes.Repeat([]byte{epoch}, 32), bytes.Repeat([]byte{^epoch}, 32)
+	s, err := newSessionKey(epoch, cipherSuiteAES256GCM, secret, transcript, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestKeyMgrRecvSession(t *testing.T) {
+	tests := []struct {
+		name    string
+		overlap time.Duration
+		epoch   uint8
+		// expected is the epoch of the expected session, if any
+		expected int
+	}{
+		{name: "current epoch", overlap: time.Hour, epoch: 1, expected: 1},
+		{name: "previous epoch within overlap", overlap: time.Hour, epoch: 0, expected: 0},
+		{name: "previous epoch after overlap", overlap: 0, epoch: 0, expected: -1},
+		{name: "next epoch", overlap: time.Hour, epoch: 2, expected: 2},
+		{name: "unknown epoch", overlap: time.Hour, epoch: 3, expected: -1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			k := newTestKeyMgr(test.overlap)
+			k.currSession = newTestSessionKey(t, 0)
+			k.installSession(newTestSessionKey(t, 1))
+			k.nextSession, k.nextSessionExpiry = newTestSessionKey(t, 2), time.Now().Add(time.Hour)
+			session := k.recvSession(test.epoch)
+			switch {
+			case test.expected < 0 && session != nil:
+				t.Errorf("expected no session, got epoch %d", session.epoch)
+			case test.expected >= 0 && session == nil:
+				t.Errorf("expected epoch %d, got no session", test.expected)
+			case test.expected >= 0 && session.epoch != uint8(test.expected):
+				t.Errorf("expected epoch %d, got %d", test.expected, session.epoch)
+			}
+		})
+	}
+}
+
+func TestKeyMgrEpochSwitch(t *testing.T) {
+	k := newTestKeyMgr(time.Hour)
+	curr, next := newTestSessionKey(t, 0), newTestSessionKey(t, 1)
+	k.currSession = curr
+	k.nextSession, k.nextSessionExpiry = next, time.Now().Add(time.Hour)
+
+	// Packets under the current epoch do not switch
+	k.promoteSession(curr)
+	if k.sendSession() != curr {
+		t.Fatalf("switched epoch without use of the next one")
+	}
+	// The first packet under the next epoch does
+	k.promoteSession(k.recvSession(1))
+	if k.sendSession() != next {
+		t.Fatalf("send epoch = %d, expected 1", k.sendSession().epoch)
+	}
+	if k.nextSession != nil {
+		t.Errorf("next session still set after switch")
+	}
+	if k.recvSession(0) != curr {
+		t.Errorf("previous epoch not accepted during overlap")
+	}
+	k.prevSessionExpiry = time.Now()
+	if k.recvSession(0) != nil {
+		t.Errorf("previous epoch accepted after overlap")
+	}
+}
+
+func TestKeyMgrExpireNextSession(t *testing.T) {
+	tests := []struct {
+		name    string
+		expiry  time.Duration
+		dropped bool
+	}{
+		{name: "used in time", expiry: time.Hour, dropped: false},
+		{name: "expired", expiry: -time.Second, dropped: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			k := newTestKeyMgr(time.Hour)
+			k.currSession = newTestSessionKey(t, 0)
+			k.nextSession, k.nextSessionExpiry = newTestSessionKey(t, 1), time.Now().Add(test.expiry)
+			k.lastRekeyRequest = &rekeyRequestMsg{Epoch: 1}
+			k.lastRekeyResponse = &rekeyResponseMsg{Epoch: 1}
+			k.expireNextSession()
+			if dropped := k.nextSession == nil; dropped != test.dropped {
+				t.Errorf("dropped = %t, expected %t", dropped, test.dropped)
+			}
+			if dropped := k.lastRekeyResponse == nil; dropped != test.dropped {
+				t.Errorf("dropped response = %t, expected %t", dropped, test.dropped)
+			}
+			if accepted := k.recvSession(1) != nil; accepted == test.dropped {
+				t.Errorf("next epoch accepted = %t, expected %t", accepted, !test.dropped)
+			}
+			if k.sendSession().epoch != 0 {
+				t.Errorf("send epoch = %d, expected 0", k.sendSession().epoch)
+			}
+		})
+	}
+}
+
+// newTestHandshake returns the keyMgrs and handshake requests of two ends of a handshake
+func newTestHandshake(t *testing.T) ([2]*keyMgr, [2]*handshakeRequestMsg) {
+	var ks [2]*keyMgr
+	var reqs [2]*handshakeRequestMsg
+	for i := range ks {
+		ks[i] = newTestKeyMgr(time.Hour)
+		pubKey, err := ks[i].getPubKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		reqs[i] = &handshakeRequestMsg{PubKey: pubKey, PubKeyTag: []byte{byte(i)}, SessionID: uint64(i + 1),
+			CtrlPort: 30000 + i, DataPort: 31000 + i, Version: protocolVersion, MinVersion: minProtocolVersion,
+			Caps: capabilities{CipherSuites: cipherSuitesByPreference}}
+	}
+	return ks, reqs
+}
+
+func TestInitDataCrypto(t *testing.T) {
+	for _, suite := range cipherSuitesByPreference {
+		t.Run(suite.String(), func(t *testing.T) {
+			ks, reqs := newTestHandshake(t)
+			if err := ks[0].initDataCrypto(reqs[0], reqs[1], suite); err != nil {
+				t.Fatal(err)
+			}
+			if err := ks[1].initDataCrypto(reqs[1], reqs[0], suite); err != nil {
+				t.Fatal(err)
+			}
+			if ks[0].lowSide == ks[1].lowSide {
+				t.Fatalf("both ends are on the same side")
+			}
+			if !bytes.Equal(ks[0].sendSession().transcript, ks[1].sendSession().transcript) {
+				t.Errorf("transcripts differ")
+			}
+			if !ks[0].verifyHandshakeConfirm(ks[1].handshakeConfirm()) ||
+				!ks[1].verifyHandshakeConfirm(ks[0].handshakeConfirm()) {
+				t.Errorf("key confirmations do not match")
+			}
+			if bytes.Equal(ks[0].handshakeConfirm(), ks[1].handshakeConfirm()) {
+				t.Errorf("key confirmations are the same in both directions")
+			}
+
+			plaintext := []byte("payload")
+			for ch := pktChannel(0); ch < numPktChannels; ch++ {
+				for i, k := range ks {
+					sender, receiver := k.sendSession(), ks[1-i].sendSession()
+					sealed := sender.channels[ch].sendAEAD.Seal(nil, buildNonce(1), plaintext, nil)
+					if _, err := receiver.channels[ch].recvAEAD.Open(nil, buildNonce(1), sealed, nil); err != nil {
+						t.Errorf("%s channel, end %d: remote cannot open: %s", ch, i, err)
+					}
+					if _, err := sender.channels[ch].recvAEAD.Open(nil, buildNonce(1), sealed, nil); err == nil {
+						t.Errorf("%s channel, end %d: reflected packet accepted", ch, i)
+					}
+					otherCh := (ch + 1) % numPktChannels
+					if _, err := receiver.channels[otherCh].recvAEAD.Open(nil, buildNonce(1), sealed, nil); err == nil {
+						t.Errorf("%s channel, end %d: packet accepted on the %s channel", ch, i, otherCh)
+					}
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,169 @@
+/*
+Copyright (c) 2020, ETH and Andrea Tulimiero
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package gateway
+
+import (
+	"context"
+	"fmt"
+	"github.com/scionproto/scion/go/lib/log"
+	"io"
+)
+
+// goodbyeReason tells the remote why a peer is being closed
+type goodbyeReason uint8
+
+const (
+	// goodbyeClose is sent when the gateway stops or removes the peer
+	goodbyeClose goodbyeReason = iota
+	// goodbyeRestart is sent when the gateway is about to restart
+	goodbyeRestart
+)
+
+func (r goodbyeReason) String() string {
+	switch r {
+	case goodbyeClose:
+		return "close"
+	case goodbyeRestart:
+		return "restart"
+	default:
+		return fmt.Sprintf("unknown(%d)", uint8(r))
+	}
+}
+
+// goodbyeMsg informs the remote that the peer is being closed, so that it resets its session right away
+type goodbyeMsg struct {
+	Reason goodbyeReason
+}
+
+func (m *goodbyeMsg) encode(e *MsgEncoder) error {
+	e.PutUint8(uint8(m.Reason))
+	return nil
+}
+
+func (m *goodbyeMsg) decode(version uint8, d *MsgDecoder) error {
+	m.Reason = goodbyeReason(d.GetUint8())
+	return d.Err()
+}
+
+// Run starts the gateway and blocks until ctx is done, then stops the gateway within shutdownTimeout
+func (gateway *Gateway) Run(ctx context.Context) error {
+	gateway.Start()
+	<-ctx.Done()
+	stopCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	return gateway.Stop(stopCtx)
+}
+
+// Stop stops the gateway: workers process the packets already queued, peers are sent a goodbye message and closed,
+// and the adapters can clean up if they implement io.Closer.
+// It returns ctx.Err() if the workers are not drained before ctx is done, but tears down the gateway anyway.
+func (gateway *Gateway) Stop(ctx context.Context) error {
+	return gateway.stopWithReason(ctx, goodbyeClose)
+}
+
+// StopForRestart is like Stop, but tells remotes that the gateway is about to restart,
+// so that they keep trying to handshake with it (inbound peers included)
+func (gateway *Gateway) StopForRestart(ctx context.Context) error {
+	return gateway.stopWithReason(ctx, goodbyeRestart)
+}
+
+func (gateway *Gateway) stopWithReason(ctx context.Context, reason goodbyeReason) error {
+	var err error
+	gateway.stopOnce.Do(func() {
+		log.Info("Stopping gateway")
+		close(gateway.stop)
+		err = gateway.waitWorkers(ctx)
+
+		gateway.peersMutex.Lock()
+		peers := gateway.asClientMap
+		gateway.asClientMap = make(map[string]*peer)
+		gateway.peersMutex.Unlock()
+		for _, peer := range peers {
+			peer.sayGoodbye(reason)
+			peer.close()
+		}
+
+		if gateway.acceptConn != nil {
+			if closeErr := gateway.acceptConn.Close(); closeErr != nil {
+				log.Debug("Error closing accept connection", "err", closeErr)
+			}
+		}
+		for _, entry := range gateway.adapters {
+			if closer, ok := entry.adapter.(io.Closer); ok {
+				if closeErr := closer.Close(); closeErr != nil {
+					log.Error("Error closing adapter", "adapter", entry.adapter, "err", closeErr)
+				}
+			}
+		}
+		log.Info("Stopped gateway")
+	})
+	return err
+}
+
+// stopped returns whether the gateway was stopped
+func (gateway *Gateway) stopped() bool {
+	select {
+	case <-gateway.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// waitWorkers waits for the workers to drain their channels
+func (gateway *Gateway) waitWorkers(ctx context.Context) error {
+	for _, entry := range gateway.adapters {
+		for _, w := range []*worker{&entry.egressWorker.worker, &entry.ingressWorker.worker} {
+			select {
+			case <-w.done:
+			case <-ctx.Done():
+				log.Warn("Stopping gateway without draining workers", "err", ctx.Err())
+				return ctx.Err()
+			}
+		}
+	}
+	return nil
+}
+
+// sayGoodbye informs the remote that the peer is being closed, if the handshake was completed
+func (peer *peer) sayGoodbye(reason goodbyeReason) {
+	if peer.getHandshakeState() != handshakeEstablished {
+		return
+	}
+	if err := peer.WriteMsg(&goodbyeMsg{Reason: reason}); err != nil {
+		log.Debug("Error sending goodbye", "remote", peer.remote.Address.IA, "err", err)
+	}
+}
+
+// handleGoodbye resets the session with a remote that is closing or restarting, instead of waiting for keepalives
+// to time out. Inbound peers are removed when the remote closes, while configured peers re-handshake.
+func (peer *peer) handleGoodbye(msg *goodbyeMsg) {
+	log.Info("Remote gateway said goodbye", "remote", peer.remote.Address.IA, "reason", msg.Reason)
+	if peer.inbound && msg.Reason == goodbyeClose {
+		if err := peer.gateway.RemovePeer(peer.remote.Address.IA); err != nil {
+			log.Debug("Error removing inbound peer", "remote", peer.remote.Address.IA, "err", err)
+		}
+		return
+	}
+	peer.resetHandshake()
+}
@@ -0,0 +1,149 @@
+/*
+Copyright (c) 2020, ETH and Andrea Tulimiero
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package gateway
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestGatewayStop(t *testing.T) {
+	d, sd := newTestTestbed()
+	a, b := newTestPair(t, d, sd)
+	stop := make(chan struct{})
+	done := sendTraffic(a, stop)
+	b.adapter.waitReceived(t)
+
+	if err := a.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	close(stop)
+	<-done
+	if err := a.Stop(context.Background()); err != nil {
+		t.Errorf("second stop: %s", err)
+	}
+	select {
+	case <-a.adapter.closed:
+	default:
+		t.Error("adapter not closed")
+	}
+	if _, err := a.getPeer(b.conf.Address.IA.String()); err == nil {
+		t.Error("peer not removed")
+	}
+	// Packets processed after stopping are dropped instead of blocking
+	for i := 0; i < 2*chanLength; i++ {
+		a.ProcessEgressPkt([]byte("late"))
+	}
+	if err := b.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if actual := d.numConns(); actual != 0 {
+		t.Errorf("expected = 0 open connections, actual = %d", actual)
+	}
+}
+
+func TestGatewayRun(t *testing.T) {
+	d, sd := newTestTestbed()
+	conf, err := parseConf([]byte(testGatewayConf("1-ff00:0:1,[127.0.0.1]:30041")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	gateway, err := newGatewayWithNetwork(conf, "", sd, testNetworkOf(d, conf.Address.IA))
+	if err != nil {
+		t.Fatal(err)
+	}
+	adapter := newTestAdapter("")
+	gateway.SetAdapter(adapter)
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan error, 1)
+	go func() { stopped <- gateway.Run(ctx) }()
+	waitFor(t, "accept connection", func() bool { return d.numConns() > 0 })
+	cancel()
+	select {
+	case err := <-stopped:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(testEventTimeout):
+		t.Fatal("gateway not stopped")
+	}
+	if actual := d.numConns(); actual != 0 {
+		t.Errorf("expected = 0 open connections, actual = %d", actual)
+	}
+}
+
+func TestGoodbye(t *testing.T) {
+	tests := []struct {
+		name    string
+		inbound bool
+		restart bool
+		// removed tells whether the remote removes the peer, instead of handshaking again
+		removed bool
+	}{
+		{name: "close"},
+		{name: "restart", restart: true},
+		{name: "inbound close", inbound: true, removed: true},
+		{name: "inbound restart", inbound: true, restart: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			d, sd := newTestTestbed()
+			var a, b *testGateway
+			if test.inbound {
+				b = newTestGateway(t, d, sd, testInboundConf(1), "1-ff00:0:1")
+				a = newTestGateway(t, d, sd, testGatewayConf("1-ff00:0:1,[127.0.0.1]:30041", testInboundAddr),
+					"1-ff00:0:2")
+				a.adapter.waitHandshake(t, b.conf.Address.IA)
+				b.adapter.waitHandshake(t, a.conf.Address.IA)
+			} else {
+				a, b = newTestPair(t, d, sd)
+			}
+			p, err := b.getPeer(a.conf.Address.IA.String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			stop := a.Stop
+			if test.restart {
+				stop = a.StopForRestart
+			}
+			if err := stop(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			waitFor(t, "session reset", func() bool { return p.getHandshakeState() != handshakeEstablished })
+			if test.removed {
+				waitFor(t, "peer removal", p.closed)
+				if _, err := b.getPeer(a.conf.Address.IA.String()); err == nil {
+					t.Error("inbound peer not removed")
+				}
+				return
+			}
+			if p.closed() {
+				t.Error("peer closed")
+			}
+			if p.keyMgr.sendSession() != nil {
+				t.Error("session keys not wiped")
+			}
+		})
+	}
+}
@@ -23,52 +23,301 @@ SOFTWARE.
 package gateway
 
 import (
-	"bytes"
+	"encoding/binary"
 	"encoding/gob"
 	"github.com/scionproto/scion/go/lib/common"
 	"github.com/scionproto/scion/go/lib/ctrl/seg"
-	"github.com/scionproto/scion/go/lib/log"
 	"github.com/scionproto/scion/go/lib/snet"
 	"io"
 )
 
+const (
+	keepAliveMsgType MsgType = iota + 1
+	handshakeRequestMsgType
+	handshakeResponseMsgType
+	hiddenPathRequestMsgType
+	rekeyRequestMsgType
+	rekeyResponseMsgType
+	reliableMsgType
+	ackMsgType
+	rpcRequestMsgType
+	rpcResponseMsgType
+	fragmentMsgType
+	goodbyeMsgType
+	adapterMsgType
+)
+
 func init() {
+	registerWireMsgVersion(keepAliveMsgType, 2, func() wireMsg { return &keepAliveMsg{} })
+	registerWireMsg(handshakeRequestMsgType, func() wireMsg { return &handshakeRequestMsg{} })
+	registerWireMsg(handshakeResponseMsgType, func() wireMsg { return &handshakeResponseMsg{} })
+	registerWireMsg(hiddenPathRequestMsgType, func() wireMsg { return &hiddenPathRequestMsg{} })
+	registerWireMsg(rekeyRequestMsgType, func() wireMsg { return &rekeyRequestMsg{} })
+	registerWireMsg(rekeyResponseMsgType, func() wireMsg { return &rekeyResponseMsg{} })
+	registerWireMsg(reliableMsgType, func() wireMsg { return &reliableMsg{} })
+	registerWireMsg(ackMsgType, func() wireMsg { return &ackMsg{} })
+	registerWireMsg(rpcRequestMsgType, func() wireMsg { return &rpcRequestMsg{} })
+	registerWireMsg(rpcResponseMsgType, func() wireMsg { return &rpcResponseMsg{} })
+	registerWireMsg(fragmentMsgType, func() wireMsg { return &fragmentMsg{} })
+	registerWireMsg(goodbyeMsgType, func() wireMsg { return &goodbyeMsg{} })
+	registerWireMsg(adapterMsgType, func() wireMsg { return &adapterMsg{} })
+
+	// gob is only used to read messages of older gateways in compatibility mode
 	gob.Register(&keepAliveMsg{})
 	gob.Register(&handshakeRequestMsg{})
 	gob.Register(&handshakeResponseMsg{})
 	gob.Register(&hiddenPathRequestMsg{})
+	gob.Register(&rekeyRequestMsg{})
+	gob.Register(&rekeyResponseMsg{})
 }
 
 type Message interface{}
 
-type keepAliveMsg struct{}
+const (
+	keepAliveEchoFlag uint8 = 1 << iota
+	keepAliveBackupFlag
+)
+
+// keepAliveMsg probes a path, the remote answers with an echo carrying the same Seq and Timestamp
+type keepAliveMsg struct {
+	Seq uint32
+	// Timestamp is the time in unix nanoseconds at which the probe was sent
+	Timestamp int64
+	Echo      bool
+	// Backup is set on the probes of paths that are not in use, which don't count as keepalives
+	Backup bool
+}
+
+func (m *keepAliveMsg) encode(e *MsgEncoder) error {
+	var flags uint8
+	if m.Echo {
+		flags |= keepAliveEchoFlag
+	}
+	if m.Backup {
+		flags |= keepAliveBackupFlag
+	}
+	e.PutUint32(m.Seq)
+	e.PutUint64(uint64(m.Timestamp))
+	e.PutUint8(flags)
+	return nil
+}
+
+func (m *keepAliveMsg) decode(version uint8, d *MsgDecoder) error {
+	if version < 2 {
+		// Keepalives of older gateways are empty, they are not echoed
+		return nil
+	}
+	m.Seq = d.GetUint32()
+	m.Timestamp = int64(d.GetUint64())
+	flags := d.GetUint8()
+	m.Echo = flags&keepAliveEchoFlag != 0
+	m.Backup = flags&keepAliveBackupFlag != 0
+	return d.Err()
+}
 
 type handshakeRequestMsg struct {
 	PubKey    []byte
 	PubKeyTag []byte
+	// SessionID identifies the session of the sender, it grows every time the sender starts a new session
+	SessionID uint64
 	CtrlPort  int
 	DataPort  int
+	// AcceptPort is the port at which the sender accepts handshakes, used to reach inbound remotes
+	AcceptPort int
+	// Version and MinVersion are the newest and oldest protocol versions spoken by the sender
+	Version    uint8
+	MinVersion uint8
+	// Caps lists the features supported by the sender
+	Caps capabilities
+	// CertChain is the certificate chain of the AS of the sender, used to verify PubKeyTag with cert authentication
+	CertChain []byte
+}
+
+// writeTranscript writes the fields of the request to the handshake transcript
+func (m *handshakeRequestMsg) writeTranscript(w io.Writer) {
+	writeTranscriptField(w, m.PubKey)
+	writeTranscriptField(w, m.PubKeyTag)
+	writeTranscriptUint(w, m.SessionID)
+	writeTranscriptUint(w, uint64(m.CtrlPort))
+	writeTranscriptUint(w, uint64(m.DataPort))
+	writeTranscriptUint(w, uint64(m.AcceptPort))
+	writeTranscriptUint(w, uint64(m.Version))
+	writeTranscriptUint(w, uint64(m.MinVersion))
+	writeTranscriptUint(w, uint64(len(m.Caps.CipherSuites)))
+	for _, suite := range m.Caps.CipherSuites {
+		writeTranscriptUint(w, uint64(suite))
+	}
+	writeTranscriptUint(w, uint64(len(m.Caps.Compressions)))
+	for _, c := range m.Caps.Compressions {
+		writeTranscriptUint(w, uint64(c))
+	}
+	if m.Caps.Multipath {
+		writeTranscriptUint(w, 1)
+	} else {
+		writeTranscriptUint(w, 0)
+	}
+	writeTranscriptUint(w, uint64(len(m.Caps.AdapterTypes)))
+	for _, adapterType := range m.Caps.AdapterTypes {
+		writeTranscriptField(w, []byte(adapterType))
+	}
+	writeTranscriptField(w, m.CertChain)
+}
+
+func (m *handshakeRequestMsg) encode(e *MsgEncoder) error {
+	e.PutBytes(m.PubKey)
+	e.PutBytes(m.PubKeyTag)
+	e.PutUint64(m.SessionID)
+	e.PutUint16(uint16(m.CtrlPort))
+	e.PutUint16(uint16(m.DataPort))
+	e.PutUint16(uint16(m.AcceptPort))
+	e.PutUint8(m.Version)
+	e.PutUint8(m.MinVersion)
+	e.PutUint8(uint8(len(m.Caps.CipherSuites)))
+	for _, suite := range m.Caps.CipherSuites {
+		e.PutUint8(uint8(suite))
+	}
+	e.PutUint8(uint8(len(m.Caps.Compressions)))
+	for _, c := range m.Caps.Compressions {
+		e.PutUint8(uint8(c))
+	}
+	if m.Caps.Multipath {
+		e.PutUint8(1)
+	} else {
+		e.PutUint8(0)
+	}
+	e.PutUint8(uint8(len(m.Caps.AdapterTypes)))
+	for _, adapterType := range m.Caps.AdapterTypes {
+		e.PutString(adapterType)
+	}
+	e.PutBytes(m.CertChain)
+	return nil
+}
+
+func (m *handshakeRequestMsg) decode(version uint8, d *MsgDecoder) error {
+	m.PubKey = d.GetBytes()
+	m.PubKeyTag = d.GetBytes()
+	m.SessionID = d.GetUint64()
+	m.CtrlPort = int(d.GetUint16())
+	m.DataPort = int(d.GetUint16())
+	m.AcceptPort = int(d.GetUint16())
+	m.Version = d.GetUint8()
+	m.MinVersion = d.GetUint8()
+	m.Caps.CipherSuites = make([]cipherSuite, d.GetUint8())
+	for i := range m.Caps.CipherSuites {
+		m.Caps.CipherSuites[i] = cipherSuite(d.GetUint8())
+	}
+	m.Caps.Compressions = make([]compression, d.GetUint8())
+	for i := range m.Caps.Compressions {
+		m.Caps.Compressions[i] = compression(d.GetUint8())
+	}
+	m.Caps.Multipath = d.GetUint8() != 0
+	m.Caps.AdapterTypes = make([]string, d.GetUint8())
+	for i := range m.Caps.AdapterTypes {
+		m.Caps.AdapterTypes[i] = d.GetString()
+	}
+	m.CertChain = d.GetBytes()
+	return d.Err()
+}
+
+type handshakeResponseMsg struct {
+	Status handshakeStatus
+	// Reason describes why a request was rejected, it is not authenticated and only meant for diagnostics
+	Reason string
+	// Confirm proves that the sender authenticated our request and derived the same keys
+	Confirm []byte
 }
 
-type handshakeResponseMsg struct{}
+func (m *handshakeResponseMsg) encode(e *MsgEncoder) error {
+	e.PutUint8(uint8(m.Status))
+	e.PutString(m.Reason)
+	e.PutBytes(m.Confirm)
+	return nil
+}
+
+func (m *handshakeResponseMsg) decode(version uint8, d *MsgDecoder) error {
+	m.Status = handshakeStatus(d.GetUint8())
+	m.Reason = d.GetString()
+	m.Confirm = d.GetBytes()
+	return d.Err()
+}
 
 type hiddenPathRequestMsg struct {
 	PathSegment seg.PathSegment
 }
 
-func writeMsg(msg Message, writer io.Writer) error {
-	var buf bytes.Buffer
-	err := gob.NewEncoder(&buf).Encode(&msg)
+func (m *hiddenPathRequestMsg) encode(e *MsgEncoder) error {
+	raw, err := m.PathSegment.Pack()
+	if err != nil {
+		return err
+	}
+	e.PutBytes(raw)
+	return nil
+}
+
+func (m *hiddenPathRequestMsg) decode(version uint8, d *MsgDecoder) error {
+	raw := d.GetBytes()
+	if d.Err() != nil {
+		return d.Err()
+	}
+	pathSegment, err := seg.NewSegFromRaw(common.RawBytes(raw))
 	if err != nil {
 		return err
 	}
-	n, err := writer.Write(buf.Bytes())
+	m.PathSegment = *pathSegment
+	return nil
+}
+
+// rekeyRequestMsg initiates a new key epoch, it is sent over the ctrl channel
+type rekeyRequestMsg struct {
+	Epoch  uint8
+	PubKey []byte
+}
+
+func (m *rekeyRequestMsg) encode(e *MsgEncoder) error {
+	e.PutUint8(m.Epoch)
+	e.PutBytes(m.PubKey)
+	return nil
+}
+
+func (m *rekeyRequestMsg) decode(version uint8, d *MsgDecoder) error {
+	m.Epoch = d.GetUint8()
+	m.PubKey = d.GetBytes()
+	return d.Err()
+}
+
+// rekeyResponseMsg completes the DH exchange of a new key epoch
+type rekeyResponseMsg struct {
+	Epoch  uint8
+	PubKey []byte
+}
+
+func (m *rekeyResponseMsg) encode(e *MsgEncoder) error {
+	e.PutUint8(m.Epoch)
+	e.PutBytes(m.PubKey)
+	return nil
+}
+
+func (m *rekeyResponseMsg) decode(version uint8, d *MsgDecoder) error {
+	m.Epoch = d.GetUint8()
+	m.PubKey = d.GetBytes()
+	return d.Err()
+}
+
+func writeMsg(msg Message, writer io.Writer) error {
+	maxLen := defaultMaxMsgLen
+	if l, ok := writer.(msgLenLimiter); ok {
+		maxLen = l.maxMsgLen()
+	}
+	return writeMsgWithLimit(msg, writer, maxLen)
+}
+
+// writeMsgWithLimit writes a message, fragmenting it if longer than maxLen
+func writeMsgWithLimit(msg Message, writer io.Writer, maxLen int) error {
+	frame, err := encodeMsg(msg)
 	if err != nil {
 		return err
-	} else if n < len(buf.Bytes()) {
-		log.Error("Buffer too long", "required", len(buf.Bytes()), "sent", n)
 	}
-	return err
+	return writeFrame(frame, writer, maxLen)
 }
 
 func WriteMsg(msg Message, writer io.Writer) error {
@@ -76,15 +325,27 @@ func WriteMsg(msg Message, writer io.Writer) error {
 }
 
 func ReadMsg(reader readerFromAddr) (Message, *snet.UDPAddr, error) {
-	var msg Message
 	buf := make([]byte, common.MaxMTU)
 	n, raddr, err := reader.ReadFrom(buf)
 	if err != nil {
 		return nil, nil, err
 	}
-	err = gob.NewDecoder(bytes.NewReader(buf[:n])).Decode(&msg)
+	msg, err := decodeMsg(buf[:n])
 	if err != nil {
 		return nil, nil, err
 	}
 	return msg, raddr.(*snet.UDPAddr), nil
 }
+
+// writeTranscriptField writes a length-prefixed field to a transcript
+func writeTranscriptField(w io.Writer, b []byte) {
+	writeTranscriptUint(w, uint64(len(b)))
+	_, _ = w.Write(b)
+}
+
+// writeTranscriptUint writes a fixed size integer to a transcript
+func writeTranscriptUint(w io.Writer, v uint64) {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], v)
+	_, _ = w.Write(buf[:])
+}
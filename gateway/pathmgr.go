@@ -23,13 +23,14 @@ SOFTWARE.
 package gateway
 
 import (
+	"bytes"
 	"context"
 	"github.com/scionproto/scion/go/lib/common"
 	"github.com/scionproto/scion/go/lib/log"
 	"github.com/scionproto/scion/go/lib/sciond"
 	"github.com/scionproto/scion/go/lib/snet"
+	"io"
 	"net"
-	"sort"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -40,6 +41,9 @@ const (
 	defaultKeepAliveInterval        = 50 * time.Millisecond
 	defaultKeepAliveTimeoutInterval = 30 * time.Millisecond
 	defaultMigrateGraceTimeout      = 500 * time.Millisecond
+	defaultBackupPaths              = 2
+	defaultBackupProbeInterval      = 1 * time.Second
+	defaultFailbackHoldDown         = 30 * time.Second
 )
 
 var (
@@ -48,22 +52,13 @@ var (
 		KeepAliveInterval:        defaultKeepAliveInterval,
 		KeepAliveTimeoutInterval: defaultKeepAliveTimeoutInterval,
 		MigrateGraceTimeout:      defaultMigrateGraceTimeout,
+		BackupPaths:              defaultBackupPaths,
+		BackupProbeInterval:      defaultBackupProbeInterval,
+		FailbackHoldDown:         defaultFailbackHoldDown,
+		Sorter:                   leastHopsSorterName,
 	}
 )
 
-type PathSorter interface {
-	SortPaths([]snet.Path) []snet.Path
-}
-type leastHopsPathSorter struct{}
-
-func (s leastHopsPathSorter) SortPaths(paths []snet.Path) []snet.Path {
-	sort.Slice(paths, func(i, j int) bool {
-		a, b := paths[i].(sciond.Path), paths[j].(sciond.Path)
-		return len(a.Interfaces()) < len(b.Interfaces())
-	})
-	return paths
-}
-
 type pathingConf struct {
 	// KeepAliveInterval is the interval at which keep-alive messages are sent
 	KeepAliveInterval time.Duration `yaml:"keepAliveInterval"`
@@ -73,12 +68,76 @@ type pathingConf struct {
 	KeepAliveTimeout time.Duration `yaml:"keepAliveTimeout"`
 	// MigrateGraceTimeout is the first KeepAliveTimeout after a path migration
 	MigrateGraceTimeout time.Duration `yaml:"migrateGraceTimeout"`
+	// BackupPaths is the number of alternative paths probed in the background, 0 disables it
+	BackupPaths int `yaml:"backupPaths"`
+	// BackupProbeInterval is the interval at which the alternative paths are probed
+	BackupProbeInterval time.Duration `yaml:"backupProbeInterval"`
+	// FailbackHoldDown is the time a better ranked path must be alive, and the path in use must have been in use,
+	// before switching back to the better ranked path, 0 disables it
+	FailbackHoldDown time.Duration `yaml:"failbackHoldDown"`
+	// Sorter is the name of the sorter ranking the paths toward the remote
+	Sorter string `yaml:"sorter"`
+	// Policy is the name of the path policy (see conf.PathPolicies) restricting the paths toward the remote, if any
+	Policy string `yaml:"policy"`
+
+	// sorter and policy are resolved from Sorter and Policy by conf.pathingFor
+	sorter PathSorter
+	policy *pathPolicy
+}
+
+// pathingOverrides overrides the global pathing configuration for a remote, missing values are inherited
+type pathingOverrides struct {
+	KeepAliveInterval        *time.Duration `yaml:"keepAliveInterval"`
+	KeepAliveTimeoutInterval *time.Duration `yaml:"keepAliveTimeoutInterval"`
+	KeepAliveTimeout         *time.Duration `yaml:"keepAliveTimeout"`
+	MigrateGraceTimeout      *time.Duration `yaml:"migrateGraceTimeout"`
+	BackupPaths              *int           `yaml:"backupPaths"`
+	BackupProbeInterval      *time.Duration `yaml:"backupProbeInterval"`
+	FailbackHoldDown         *time.Duration `yaml:"failbackHoldDown"`
+	Sorter                   *string        `yaml:"sorter"`
+	Policy                   *string        `yaml:"policy"`
+}
+
+// apply overrides the values of conf that are set
+func (o *pathingOverrides) apply(conf *pathingConf) {
+	if o == nil {
+		return
+	}
+	if o.KeepAliveInterval != nil {
+		conf.KeepAliveInterval = *o.KeepAliveInterval
+	}
+	if o.KeepAliveTimeoutInterval != nil {
+		conf.KeepAliveTimeoutInterval = *o.KeepAliveTimeoutInterval
+	}
+	if o.KeepAliveTimeout != nil {
+		conf.KeepAliveTimeout = *o.KeepAliveTimeout
+	}
+	if o.MigrateGraceTimeout != nil {
+		conf.MigrateGraceTimeout = *o.MigrateGraceTimeout
+	}
+	if o.BackupPaths != nil {
+		conf.BackupPaths = *o.BackupPaths
+	}
+	if o.BackupProbeInterval != nil {
+		conf.BackupProbeInterval = *o.BackupProbeInterval
+	}
+	if o.FailbackHoldDown != nil {
+		conf.FailbackHoldDown = *o.FailbackHoldDown
+	}
+	if o.Sorter != nil {
+		conf.Sorter = *o.Sorter
+	}
+	if o.Policy != nil {
+		conf.Policy = *o.Policy
+	}
 }
 
 type pathMgr struct {
+	// conf is replaced upon reloads, confUpdated is closed when it happens
+	confMutex        sync.RWMutex
 	conf             *pathingConf
+	confUpdated      chan struct{}
 	peer             *peer
-	pathSorter       PathSorter
 	pathsUpdateMutex sync.Mutex
 
 	currPath       snet.Path
@@ -87,37 +146,94 @@ type pathMgr struct {
 	hiddenPaths    []snet.Path
 	hiddenPathsIdx int
 
+	// metrics and health are measured on the paths toward the remote
+	metricsMutex sync.RWMutex
+	metrics      map[snet.PathFingerprint]PathMetrics
+	health       map[snet.PathFingerprint]pathHealth
+
+	// noCompliantPath is set while no path complies with the path policy, it is accessed atomically
+	noCompliantPath int32
+
 	// Probing
-	isMigrating   int32
+	probesMutex  sync.Mutex
+	probes       [probeWindow]probe
+	nextProbeSeq uint32
+	isMigrating  int32
+	// lastMigration and lastKeepAlive are protected by pathsUpdateMutex
 	lastMigration time.Time
 	lastKeepAlive time.Time
 }
 
 func newPathMgr(conf *pathingConf, peer *peer) *pathMgr {
-	pathMgr := &pathMgr{conf: conf, peer: peer, pathSorter: &leastHopsPathSorter{}}
+	pathMgr := &pathMgr{
+		conf:        conf,
+		confUpdated: make(chan struct{}),
+		peer:        peer,
+		metrics:     make(map[snet.PathFingerprint]PathMetrics),
+		health:      make(map[snet.PathFingerprint]pathHealth),
+	}
 	return pathMgr
 }
 
-// start is in charge of providing fresh paths to the peer
-func (m *pathMgr) start() {
+// getConf returns the current pathing configuration
+func (m *pathMgr) getConf() *pathingConf {
+	conf, _ := m.watchConf()
+	return conf
+}
+
+// watchConf returns the current pathing configuration and a channel closed when it is replaced
+func (m *pathMgr) watchConf() (*pathingConf, <-chan struct{}) {
+	m.confMutex.RLock()
+	defer m.confMutex.RUnlock()
+	return m.conf, m.confUpdated
+}
+
+// setConf replaces the pathing configuration, the keepalive loops of a running session pick it up right away
+func (m *pathMgr) setConf(conf *pathingConf) {
+	m.confMutex.Lock()
+	defer m.confMutex.Unlock()
+	m.conf = conf
+	close(m.confUpdated)
+	m.confUpdated = make(chan struct{})
+}
+
+// start is in charge of providing fresh paths to the peer until stop is closed
+func (m *pathMgr) start(stop <-chan struct{}) {
 	m.resetTimeouts()
 	if m.peer.remote.RendezvousAddr != nil {
-		if err := m.sendHiddenPath(); err != nil {
-			log.Error("Error sending paths to remote", "err", err)
-		}
+		go func() {
+			if err := m.sendHiddenPath(); err != nil {
+				log.Error("Error sending paths to remote", "err", err)
+			}
+		}()
 	}
-	go m.keepAliveSender()
-	go m.keepAliveChecker()
-	go m.pathRefresher()
+	go m.keepAliveSender(stop)
+	go m.keepAliveChecker(stop)
+	go m.pathRefresher(stop)
+	go m.backupProber(stop)
 }
 
 // pathRefresher periodically calls updatePathsToRemote
-func (m *pathMgr) pathRefresher() {
+func (m *pathMgr) pathRefresher(stop <-chan struct{}) {
 	t := time.NewTicker(pathRefreshInterval)
 	for {
 		select {
+		case <-stop:
+			t.Stop()
+			return
 		case <-t.C:
-			_ = m.updatePathsToRemote()
+			inUse := m.getCurrPath()
+			if err := m.updatePathsToRemote(); err != nil {
+				log.Debug("Error refreshing paths", "remote", m.peer.remote.Address.IA, "err", err)
+				continue
+			}
+			if inUse == nil || !m.hasPath(inUse) {
+				// The path in use expired or is excluded by the path policy
+				log.Info("Path in use is no longer available, reconnecting", "remote", m.peer.remote.Address.IA)
+				if err := m.reconnect(); err != nil {
+					log.Error("Error reconnecting", "remote", m.peer.remote.Address.IA, "err", err)
+				}
+			}
 		}
 	}
 }
@@ -134,28 +250,54 @@ func (m *pathMgr) updatePathsToRemote() error {
 		return err
 	}
 
-	// get unique paths by fingerprint
-	pathsSet := make(map[snet.PathFingerprint]snet.Path)
+	// get unique paths by fingerprint, keeping the order of sciond
+	pathsSet := make(map[snet.PathFingerprint]struct{})
+	var uniquePaths []snet.Path
 	for _, path := range paths {
 		f := path.Fingerprint()
 		if _, ok := pathsSet[f]; ok {
 			// Preferred first occurrences of same path
 			continue
 		}
-		pathsSet[f] = path
-	}
-	var uniquePaths []snet.Path
-	for _, path := range pathsSet {
+		pathsSet[f] = struct{}{}
 		uniquePaths = append(uniquePaths, path)
 	}
 
-	uniquePaths = m.pathSorter.SortPaths(uniquePaths)
+	if len(uniquePaths) == 0 {
+		return noPathError
+	}
+	conf := m.getConf()
+	if conf.policy != nil {
+		uniquePaths = conf.policy.filter(uniquePaths)
+	}
+	if len(uniquePaths) == 0 {
+		// Traffic is blocked rather than sent over paths violating the policy
+		m.pathsUpdateMutex.Lock()
+		m.paths, m.pathIdx, m.currPath, m.hiddenPaths = nil, 0, nil, nil
+		m.pathsUpdateMutex.Unlock()
+		if atomic.SwapInt32(&m.noCompliantPath, 1) == 0 {
+			log.Error("No path complies with the path policy, blocking traffic to remote",
+				"remote", m.peer.remote.Address.IA, "policy", conf.Policy)
+		}
+		return noCompliantPathError
+	}
+	if atomic.SwapInt32(&m.noCompliantPath, 0) == 1 {
+		log.Info("Found paths complying with the path policy", "remote", m.peer.remote.Address.IA)
+	}
+	uniquePaths = sortPaths(conf.sorter, uniquePaths, m.pathMetrics)
 	log.Debug("Updated paths", "remote", remoteIA, "paths", uniquePaths)
 
 	m.pathsUpdateMutex.Lock()
 	defer m.pathsUpdateMutex.Unlock()
 	m.paths = uniquePaths
+	// Keep the path in use if it is still available, switching back to better ranked paths is up to failback
 	m.pathIdx = 0
+	for i, path := range m.paths {
+		if m.currPath != nil && path.Fingerprint() == m.currPath.Fingerprint() {
+			m.pathIdx = i
+			break
+		}
+	}
 	m.currPath = m.paths[m.pathIdx]
 	return nil
 }
@@ -163,6 +305,9 @@ func (m *pathMgr) updatePathsToRemote() error {
 func (m *pathMgr) nextPath(hidden bool) snet.Path {
 	m.pathsUpdateMutex.Lock()
 	defer m.pathsUpdateMutex.Unlock()
+	if len(m.paths) == 0 {
+		return nil
+	}
 	if hidden && len(m.hiddenPaths) > 0 {
 		if m.currPath == m.hiddenPaths[m.hiddenPathsIdx] && m.hiddenPathsIdx == len(m.hiddenPaths)-1 {
 			// We tried all hidden paths, switch to trying public paths
@@ -173,30 +318,59 @@ func (m *pathMgr) nextPath(hidden bool) snet.Path {
 			return m.hiddenPaths[m.hiddenPathsIdx]
 		}
 	} else {
-		m.pathIdx = (m.pathIdx + 1) % len(m.paths)
+		m.pathIdx = m.failoverPathIdx()
 		return m.paths[m.pathIdx]
 	}
 }
 
+// failoverPathIdx returns the index of the path to migrate to: the best ranked path recently confirmed alive,
+// otherwise the next path that is not backing off, otherwise the next path. pathsUpdateMutex must be held.
+func (m *pathMgr) failoverPathIdx() int {
+	conf := m.getConf()
+	aliveWithin := 2*conf.BackupProbeInterval + conf.KeepAliveTimeout
+	for i, path := range m.paths {
+		if i != m.pathIdx && m.pathHealth(path).aliveWithin(aliveWithin) {
+			return i
+		}
+	}
+	for i := 1; i < len(m.paths); i++ {
+		idx := (m.pathIdx + i) % len(m.paths)
+		if !m.pathHealth(m.paths[idx]).backingOff() {
+			return idx
+		}
+	}
+	return (m.pathIdx + 1) % len(m.paths)
+}
+
 func (m *pathMgr) migrate() error {
 	if !atomic.CompareAndSwapInt32(&m.isMigrating, 0, 1) {
 		log.Debug("Another migrate operation is in progress")
 		return nil
 	}
-	m.currPath = m.nextPath(*hiddenFailover)
-	log.Info("Migrating connection", "path", ifacesToString(m.currPath.Interfaces()))
+	if failed := m.getCurrPath(); failed != nil {
+		m.markFailed(failed.Fingerprint())
+	}
+	path := m.nextPath(*hiddenFailover)
+	if path == nil {
+		atomic.StoreInt32(&m.isMigrating, 0)
+		return m.noPathError()
+	}
+	log.Info("Migrating connection", "path", ifacesToString(path.Interfaces()))
+	m.pathsUpdateMutex.Lock()
+	m.currPath, m.lastMigration = path, time.Now()
+	m.pathsUpdateMutex.Unlock()
 
 	err := m.peer.setupEgressConnections()
 	if err != nil {
-		m.isMigrating = 0
+		atomic.StoreInt32(&m.isMigrating, 0)
 		return err
 	}
 	//go connFailHandler(client, client.DataConn.conn)
 	//go connFailHandler(client, client.CtrlConn)
 	go func() {
 		// Wait KeepAliveTimeout before sending keepalive messages again to allow the other end to detect the failure
-		time.Sleep(m.conf.KeepAliveTimeout)
-		m.isMigrating = 0
+		time.Sleep(m.getConf().KeepAliveTimeout)
+		atomic.StoreInt32(&m.isMigrating, 0)
 		m.resetTimeouts()
 	}()
 	return nil
@@ -227,24 +401,49 @@ func (r *RevocationHandler) RevokeRaw(ctx context.Context, rawSRevInfo common.Ra
 
 func (m *pathMgr) resetTimeouts() {
 	// Give some time to set up things
-	m.lastKeepAlive = time.Now().Add(m.conf.MigrateGraceTimeout)
+	m.setLastKeepAlive(time.Now().Add(m.getConf().MigrateGraceTimeout))
+}
+
+func (m *pathMgr) setLastKeepAlive(t time.Time) {
+	m.pathsUpdateMutex.Lock()
+	defer m.pathsUpdateMutex.Unlock()
+	m.lastKeepAlive = t
 }
 
-func (m *pathMgr) keepAliveSender() {
-	keepAliveMsg := &keepAliveMsg{}
+// sinceLastKeepAlive returns the time elapsed since the last keepalive
+func (m *pathMgr) sinceLastKeepAlive() time.Duration {
+	m.pathsUpdateMutex.Lock()
+	defer m.pathsUpdateMutex.Unlock()
+	return time.Now().Sub(m.lastKeepAlive)
+}
+
+func (m *pathMgr) keepAliveSender(stop <-chan struct{}) {
 	log.Debug("Sending keep alive messages ...")
-	t := time.NewTicker(m.conf.KeepAliveInterval)
+	conf, confUpdated := m.watchConf()
+	t := time.NewTicker(conf.KeepAliveInterval)
 	for {
 		select {
+		case <-stop:
+			t.Stop()
+			return
+		case <-confUpdated:
+			t.Stop()
+			conf, confUpdated = m.watchConf()
+			t = time.NewTicker(conf.KeepAliveInterval)
 		case <-t.C:
-			if m.isMigrating == 1 {
+			if atomic.LoadInt32(&m.isMigrating) == 1 {
 				log.Trace("Skipping keepAliveSender message during migration")
 				continue
 			}
-			err := WriteMsg(keepAliveMsg, m.peer.egressCtrlEConn)
+			m.expireProbes(conf.KeepAliveTimeout)
+			path := m.getCurrPath()
+			if path == nil {
+				continue
+			}
+			err := WriteMsg(m.newProbe(path, false), m.peer.getEgressCtrlEConn())
 			switch err {
 			case nil:
-			case PeerIsMigratingError:
+			case PeerIsMigratingError, noCompliantPathError:
 				log.Debug("Skipped keepAlive msg", "err", err)
 			default:
 				log.Error("Couldn't write keepAlive msg", "err", err)
@@ -253,19 +452,31 @@ func (m *pathMgr) keepAliveSender() {
 	}
 }
 
-func (m *pathMgr) keepAliveChecker() {
+func (m *pathMgr) keepAliveChecker(stop <-chan struct{}) {
 	log.Debug("Checking keep alive messages ...")
-	t := time.NewTicker(m.conf.KeepAliveTimeoutInterval)
+	conf, confUpdated := m.watchConf()
+	t := time.NewTicker(conf.KeepAliveTimeoutInterval)
 	for {
 		select {
+		case <-stop:
+			t.Stop()
+			return
+		case <-confUpdated:
+			t.Stop()
+			conf, confUpdated = m.watchConf()
+			t = time.NewTicker(conf.KeepAliveTimeoutInterval)
 		case <-t.C:
-			if m.isMigrating == 1 {
+			if atomic.LoadInt32(&m.isMigrating) == 1 {
 				log.Trace("Skipping connProbing during migration")
 				continue
 			}
-			if time.Now().Sub(m.lastKeepAlive) > m.conf.KeepAliveTimeout {
+			if atomic.LoadInt32(&m.noCompliantPath) == 1 {
+				// There is no path to migrate to until the next refresh
+				continue
+			}
+			if elapsed := m.sinceLastKeepAlive(); elapsed > conf.KeepAliveTimeout {
 				log.Debug("Timeout expired, migrating to another path",
-					"time", time.Now().Sub(m.lastKeepAlive),
+					"time", elapsed,
 					"remote", m.peer.remote.Address.IA)
 				if err := m.migrate(); err != nil {
 					log.Error("Migration failed", "err", err)
@@ -275,13 +486,105 @@ func (m *pathMgr) keepAliveChecker() {
 	}
 }
 
+// pathMetrics returns the metrics measured on a path
+func (m *pathMgr) pathMetrics(path snet.Path) PathMetrics {
+	m.metricsMutex.RLock()
+	defer m.metricsMutex.RUnlock()
+	return m.metrics[path.Fingerprint()]
+}
+
 func (m *pathMgr) getCurrPath() snet.Path {
+	m.pathsUpdateMutex.Lock()
+	defer m.pathsUpdateMutex.Unlock()
 	return m.currPath
 }
 
-func (m *pathMgr) handleKeepAliveRequest(msg *keepAliveMsg) {
-	log.Trace("New keepalive", "elapsed", time.Now().Sub(m.lastKeepAlive))
-	m.lastKeepAlive = time.Now()
+// hasPath returns whether a path is among the paths toward the remote
+func (m *pathMgr) hasPath(path snet.Path) bool {
+	m.pathsUpdateMutex.Lock()
+	defer m.pathsUpdateMutex.Unlock()
+	for _, p := range m.paths {
+		if p.Fingerprint() == path.Fingerprint() {
+			return true
+		}
+	}
+	return false
+}
+
+// noPathError returns why there is no path toward the remote
+func (m *pathMgr) noPathError() error {
+	if atomic.LoadInt32(&m.noCompliantPath) == 1 {
+		return noCompliantPathError
+	}
+	return noPathError
+}
+
+// reconnect sets up the egress connections again over currPath, unless a migration is in progress
+func (m *pathMgr) reconnect() error {
+	if !atomic.CompareAndSwapInt32(&m.isMigrating, 0, 1) {
+		return nil
+	}
+	defer atomic.StoreInt32(&m.isMigrating, 0)
+	return m.peer.setupEgressConnections()
+}
+
+// handleKeepAliveRequest handles a keepalive or an echo, probes are echoed back over the reverse of their path if
+// raddr is known and the path policy allows it, so that echoes measure the probed path in both directions
+func (m *pathMgr) handleKeepAliveRequest(msg *keepAliveMsg, raddr *snet.UDPAddr) {
+	if !msg.Backup {
+		log.Trace("New keepalive", "elapsed", m.sinceLastKeepAlive())
+		m.setLastKeepAlive(time.Now())
+	}
+	if msg.Echo {
+		m.handleKeepAliveEcho(msg)
+		return
+	}
+	if msg.Timestamp == 0 {
+		// Keepalive of an older gateway
+		return
+	}
+	echo := &keepAliveMsg{Seq: msg.Seq, Timestamp: msg.Timestamp, Echo: true, Backup: msg.Backup}
+	if err := WriteMsg(echo, m.echoWriter(raddr)); err != nil {
+		log.Debug("Couldn't write keepAlive echo", "err", err)
+	}
+}
+
+// echoWriter returns the writer of the echo of a probe received from raddr: the reverse of the probed path,
+// unless the path policy does not allow it, in which case the echo is sent over the path in use
+func (m *pathMgr) echoWriter(raddr *snet.UDPAddr) io.Writer {
+	if raddr == nil || m.peer.ingressCtrlConn == nil {
+		return m.peer.getEgressCtrlEConn()
+	}
+	if policy := m.getConf().policy; policy != nil && !m.compliantReversePath(raddr, policy) {
+		log.Trace("Echoing over the path in use, the probed path does not comply with the path policy")
+		return m.peer.getEgressCtrlEConn()
+	}
+	// The probe came from an ephemeral port, the echo is for the ctrl port of the remote
+	echoAddr := raddr.Copy()
+	echoAddr.Host.Port = m.peer.remoteCtrlPort
+	return eConnTo{eConn: m.peer.ingressCtrlConn, raddr: echoAddr}
+}
+
+// compliantReversePath tells whether the path of raddr, which is the reverse of the path a packet came from,
+// is a known path toward the remote that complies with policy. Raw paths carry no IA, hence unknown paths are
+// not compliant.
+func (m *pathMgr) compliantReversePath(raddr *snet.UDPAddr, policy *pathPolicy) bool {
+	var raw common.RawBytes
+	if raddr.Path != nil {
+		raw = raddr.Path.Raw
+	}
+	m.pathsUpdateMutex.Lock()
+	defer m.pathsUpdateMutex.Unlock()
+	for _, path := range append(m.paths[:len(m.paths):len(m.paths)], m.hiddenPaths...) {
+		var known common.RawBytes
+		if p := path.Path(); p != nil {
+			known = p.Raw
+		}
+		if bytes.Equal(raw, known) {
+			return policy.compliant(path)
+		}
+	}
+	return false
 }
 
 // TODO: Find a better way to get the overlay next hop
@@ -32,70 +32,211 @@ import (
 	"io"
 	"net"
 	"sync"
-	"time"
+	"sync/atomic"
 )
 
-type connConf struct {
+// ConnConf configures the connection with a remote gateway
+type ConnConf struct {
 	Address        YUDPAddr
 	Description    string
 	RendezvousAddr *YIA `yaml:"rendezvousAddr"`
+	// Auth selects how the handshake with the remote is authenticated
+	Auth AuthConf
+	// Pathing overrides the global pathing configuration for the remote
+	Pathing *pathingOverrides
 }
 
 // peer keeps track of the connection with another Gateway
 type peer struct {
+	// counters is kept first for 64-bit alignment of its fields
+	counters peerCounters
 	gateway  *Gateway
-	remote   connConf
-	pathMgr  *pathMgr
-	keyMgr   *keyMgr
-	drkeyMgr *drkeyMgr
-	// Egress connections
+	remote   ConnConf
+	// inbound tells whether the peer was created upon the handshake of an unconfigured remote
+	inbound       bool
+	pathMgr       *pathMgr
+	keyMgr        *keyMgr
+	authenticator Authenticator
+	// Egress connections, replaced upon migrations under egressMutex
+	egressMutex                      sync.RWMutex
 	egressCtrlEConn, egressDataEConn *eConn
 	remoteCtrlPort, remoteDataPort   int
 	// Ingress connections
 	ingressCtrlConn, ingressDataConn *eConn
 	// Handshaking
-	handshakeRequestHandlerMutex sync.Mutex
-	handshakeCompletionMutex     sync.Mutex
-	cryptoHandshakeComplete      bool
-	checkHandshakeComplete       bool
-	handshakeCompleted           bool
+	handshakeRequestMutex sync.Mutex
+	localHandshakeReq     *handshakeRequestMsg
+	// lastSessionID is the ID of the latest local session, session IDs only grow
+	lastSessionID uint64
+	// handshakeState is accessed atomically, while transitions happen under handshakeMutex
+	handshakeState     int32
+	handshakeMutex     sync.Mutex
+	remoteHandshakeReq *handshakeRequestMsg
+	handshakeRes       *handshakeResponseMsg
+	// handshaking is set while initHandshaking sends requests, it is accessed atomically
+	handshaking int32
+	// adapterIDs is set when data packets carry the ID of their adapter (see adapterIDVersion), it is accessed atomically
+	adapterIDs int32
+	// sessionStop is closed when the session ends, to stop the goroutines started upon its handshake
+	sessionStop chan struct{}
+	// caps are the capabilities negotiated with the remote, they are set once keys are derived
+	caps *negotiatedCaps
+	// Reliable ctrl messages
+	reliableSender   *reliableSender
+	reliableReceiver *reliableReceiver
+	rpcClient        *rpcClient
+	// rpcSlots bounds the requests of the remote handled at the same time
+	rpcSlots chan struct{}
+	// reassembler collects the fragments of the ctrl messages of the remote, and handshakeReassembler
+	// the unauthenticated fragments of its handshake messages received on the accept connection
+	reassembler          *reassembler
+	handshakeReassembler *reassembler
+	// stop is closed once the peer is removed, to stop all its goroutines
+	stop     chan struct{}
+	stopOnce sync.Once
 }
 
 type PeerWriter interface {
 	CtrlWriter() io.Writer
 	DataWriter() io.Writer
+	// WriteMsgReliable sends a ctrl message and waits until the remote acknowledges it
+	WriteMsgReliable(context.Context, Message) error
+	// Call sends a request to the remote and waits for the response of its RPCHandler
+	Call(context.Context, Message) (Message, error)
+	// RemoteIA returns the IA of the remote gateway
+	RemoteIA() addr.IA
 }
 
 func (peer *peer) CtrlWriter() io.Writer {
-	return peer.egressCtrlEConn
+	return peer.getEgressCtrlEConn()
 }
 
 func (peer *peer) DataWriter() io.Writer {
-	return peer.egressDataEConn
+	return adapterDataWriter{peer: peer, id: DefaultAdapterID}
 }
 
-func newPeer(gateway *Gateway, remoteConf connConf, pathingConf *pathingConf) (*peer, error) {
-	peer := &peer{
-		gateway:                 gateway,
-		remote:                  remoteConf,
-		cryptoHandshakeComplete: false,
-		checkHandshakeComplete:  false,
-		handshakeCompleted:      false,
+// writeData sends a data packet of an adapter, prefixed by its ID if the remote speaks a version with adapter IDs
+func (peer *peer) writeData(id AdapterID, b []byte) (int, error) {
+	econn := peer.getEgressDataEConn()
+	if econn == nil {
+		return -1, cryptoHandshakeError
 	}
-	peer.pathMgr = newPathMgr(pathingConf, peer)
-	peer.keyMgr = newKeyMgr(peer)
-	peer.drkeyMgr = newDRKeyMgr(peer)
+	if !peer.usesAdapterIDs() {
+		if id != DefaultAdapterID {
+			return -1, adapterIDsNotNegotiatedError
+		}
+		return econn.Write(b)
+	}
+	return econn.writeWithPrefix([]byte{byte(id)}, b, econn.conn.RemoteAddr())
+}
 
-	err := peer.startIngressCtrlHandler()
+// scopeToAdapter wraps a ctrl message of an adapter in an adapterMsg, unless the remote speaks a version without
+// adapter IDs, where only the messages of the default adapter can be exchanged
+func (peer *peer) scopeToAdapter(id AdapterID, msg Message) (Message, error) {
+	if !peer.usesAdapterIDs() {
+		if id != DefaultAdapterID {
+			return nil, adapterIDsNotNegotiatedError
+		}
+		return msg, nil
+	}
+	return &adapterMsg{ID: id, Msg: msg}, nil
+}
+
+// usesAdapterIDs returns whether data packets exchanged with the remote carry the ID of their adapter
+func (peer *peer) usesAdapterIDs() bool {
+	return atomic.LoadInt32(&peer.adapterIDs) == 1
+}
+
+func (peer *peer) setUsesAdapterIDs(b bool) {
+	var v int32
+	if b {
+		v = 1
+	}
+	atomic.StoreInt32(&peer.adapterIDs, v)
+}
+
+func (peer *peer) RemoteIA() addr.IA {
+	return peer.remote.Address.IA
+}
+
+func newPeer(gateway *Gateway, remoteConf ConnConf, pathingConf *pathingConf) (*peer, error) {
+	peer, err := newUnboundPeer(gateway, remoteConf, pathingConf)
 	if err != nil {
 		return nil, err
 	}
-	err = peer.startIngressDataHandler()
+	return peer, peer.startIngressHandlers()
+}
+
+// newUnboundPeer returns a peer that has no connections yet, e.g., to authenticate a remote before binding them
+func newUnboundPeer(gateway *Gateway, remoteConf ConnConf, pathingConf *pathingConf) (*peer, error) {
+	peer := &peer{
+		gateway:              gateway,
+		remote:               remoteConf,
+		handshakeState:       int32(handshakeIdle),
+		reliableSender:       newReliableSender(),
+		reliableReceiver:     newReliableReceiver(),
+		rpcClient:            newRPCClient(),
+		rpcSlots:             make(chan struct{}, rpcMaxConcurrentRequests),
+		reassembler:          newReassembler(reassemblyMemLimit),
+		handshakeReassembler: newReassembler(acceptReassemblyMemLimit),
+		stop:                 make(chan struct{}),
+	}
+	peer.touch()
+	peer.pathMgr = newPathMgr(pathingConf, peer)
+	peer.keyMgr = newKeyMgr(peer)
+	var err error
+	peer.authenticator, err = gateway.newAuthenticator(peer)
 	if err != nil {
 		return nil, err
 	}
+	return peer, nil
+}
 
-	return peer, err
+// startIngressHandlers binds the ingress connections of the peer, it is closed if binding fails
+func (peer *peer) startIngressHandlers() error {
+	if err := peer.startIngressCtrlHandler(); err != nil {
+		peer.close()
+		return err
+	}
+	if err := peer.startIngressDataHandler(); err != nil {
+		peer.close()
+		return err
+	}
+	return nil
+}
+
+// close stops the goroutines of the peer, closes its connections and wipes its keys
+func (peer *peer) close() {
+	peer.stopOnce.Do(func() {
+		close(peer.stop)
+		peer.handshakeMutex.Lock()
+		peer.endSession()
+		peer.setHandshakeState(handshakeIdle)
+		peer.handshakeMutex.Unlock()
+		peer.egressMutex.RLock()
+		econns := []*eConn{peer.ingressCtrlConn, peer.ingressDataConn, peer.egressCtrlEConn, peer.egressDataEConn}
+		peer.egressMutex.RUnlock()
+		for _, econn := range econns {
+			if econn == nil {
+				continue
+			}
+			if err := econn.conn.Close(); err != nil {
+				log.Debug("Error closing connection", "remote", peer.remote.Address.IA, "err", err)
+			}
+		}
+		peer.keyMgr.wipe()
+		log.Info("Closed peer", "remote", peer.remote.Address.IA)
+	})
+}
+
+// closed returns whether the peer was closed
+func (peer *peer) closed() bool {
+	select {
+	case <-peer.stop:
+		return true
+	default:
+		return false
+	}
 }
 
 func (peer *peer) startIngressCtrlHandler() error {
@@ -106,12 +247,20 @@ func (peer *peer) startIngressCtrlHandler() error {
 	if err != nil {
 		return err
 	}
-	econn := newEConn(conn, peer)
+	econn := newEConn(conn, peer, ctrlChannel)
 	log.Debug("Listening for ctrl messages", "addr", econn.conn.LocalAddr())
 	go func() {
 		for {
 			msg, raddr, err := ReadMsg(econn)
-			if err != nil {
+			if err != nil && peer.closed() {
+				return
+			}
+			switch err {
+			case nil:
+			case replayedPktError:
+				log.Debug("Dropped replayed controller message", "remote", peer.remote.Address.IA)
+				continue
+			default:
 				log.Error("Error reading controller message", "err", err)
 				continue
 			}
@@ -119,28 +268,77 @@ func (peer *peer) startIngressCtrlHandler() error {
 				log.Warn("Received messaged from unexpected AS", "expected", peer.remote.Address.IA, "received", raddr.IA)
 				continue
 			}
-			log.Trace("Received new control message", "type", fmt.Sprintf("%T", msg))
-			switch reqMsg := msg.(type) {
-			case *keepAliveMsg:
-				peer.pathMgr.handleKeepAliveRequest(reqMsg)
-			case *hiddenPathRequestMsg:
-				if peer.remote.RendezvousAddr == nil {
-					log.Warn("Ignoring hidden path request, rendezvous not set")
-					continue
-				}
-				err := peer.pathMgr.handleHiddenPathRequest(reqMsg)
-				if err != nil {
-					log.Error("Error handling hidden path establishment request")
-				}
-			default:
-				peer.gateway.adapter.ProcessCtrlMsg(msg, raddr.IA)
+			peer.touch()
+			if keepAlive, ok := msg.(*keepAliveMsg); ok {
+				// Echoes go back over the path the probe came from
+				peer.pathMgr.handleKeepAliveRequest(keepAlive, raddr)
+				continue
 			}
+			peer.handleCtrlMsg(msg)
 		}
 	}()
 	peer.ingressCtrlConn = econn
 	return nil
 }
 
+// handleCtrlMsg dispatches a ctrl message of the remote to the component in charge of it
+func (peer *peer) handleCtrlMsg(msg Message) {
+	log.Trace("Received new control message", "type", fmt.Sprintf("%T", msg))
+	switch reqMsg := msg.(type) {
+	case *keepAliveMsg:
+		peer.pathMgr.handleKeepAliveRequest(reqMsg, nil)
+	case *hiddenPathRequestMsg:
+		if peer.remote.RendezvousAddr == nil {
+			log.Warn("Ignoring hidden path request, rendezvous not set")
+			return
+		}
+		err := peer.pathMgr.handleHiddenPathRequest(reqMsg)
+		if err != nil {
+			log.Error("Error handling hidden path establishment request")
+		}
+	case *rekeyRequestMsg:
+		if err := peer.keyMgr.handleRekeyRequest(reqMsg); err != nil {
+			log.Error("Error handling rekey request", "err", err)
+		}
+	case *rekeyResponseMsg:
+		if err := peer.keyMgr.handleRekeyResponse(reqMsg); err != nil {
+			log.Error("Error handling rekey response", "err", err)
+		}
+	case *reliableMsg:
+		peer.handleReliableMsg(reqMsg)
+	case *ackMsg:
+		peer.reliableSender.handleAck(reqMsg)
+	case *rpcRequestMsg:
+		peer.dispatchRPCRequest(reqMsg)
+	case *rpcResponseMsg:
+		peer.rpcClient.handleResponse(reqMsg)
+	case *goodbyeMsg:
+		peer.handleGoodbye(reqMsg)
+	case *fragmentMsg:
+		msg, err := peer.reassemble(reqMsg)
+		if err != nil {
+			log.Debug("Dropped fragment", "remote", peer.remote.Address.IA, "err", err)
+			return
+		}
+		if msg != nil {
+			peer.handleCtrlMsg(msg)
+		}
+	case *adapterMsg:
+		entry := peer.gateway.adapterByID(reqMsg.ID)
+		if entry == nil {
+			log.Debug("Dropped ctrl message of unknown adapter", "remote", peer.remote.Address.IA,
+				"adapter", reqMsg.ID)
+			return
+		}
+		entry.adapter.ProcessCtrlMsg(reqMsg.Msg, peer.remote.Address.IA)
+	default:
+		// Messages without adapter ID are for the default adapter, which ignores the messages it does not know
+		if entry := peer.gateway.adapterByID(DefaultAdapterID); entry != nil {
+			entry.adapter.ProcessCtrlMsg(msg, peer.remote.Address.IA)
+		}
+	}
+}
+
 func (peer *peer) startIngressDataHandler() error {
 	var err error
 	network := peer.gateway.network
@@ -149,27 +347,50 @@ func (peer *peer) startIngressDataHandler() error {
 	if err != nil {
 		return err
 	}
-	econn := newEConn(conn, peer)
+	econn := newEConn(conn, peer, dataChannel)
 	log.Debug("Listening for incoming data", "addr", econn.conn.LocalAddr())
 	go func() {
 		buf := make([]byte, common.MaxMTU)
 		for {
 			n, _, err := econn.ReadFrom(buf)
-			if err != nil {
+			if err != nil && peer.closed() {
+				return
+			}
+			switch err {
+			case nil:
+			case replayedPktError:
+				log.Debug("Dropped replayed packet", "remote", peer.remote.Address.IA)
+				continue
+			default:
 				log.Error("Unable to read from network", "err", err)
 				continue
 			}
 
+			peer.touch()
+
+			id := DefaultAdapterID
+			if peer.usesAdapterIDs() {
+				if n < 1 {
+					continue
+				}
+				id = AdapterID(buf[0])
+				n = copy(buf, buf[1:n])
+			}
+			entry := peer.gateway.adapterByID(id)
+			if entry == nil {
+				log.Debug("Dropped packet of unknown adapter", "remote", peer.remote.Address.IA, "adapter", id)
+				continue
+			}
 			if useWorkerMemPool {
-				freeBuf := peer.gateway.ingressWorker.pktsPool.get()
+				freeBuf := entry.ingressWorker.pktsPool.get()
 				if freeBuf == nil {
 					log.Debug("Couldn't retrieve free buf")
 					continue
 				}
-				peer.gateway.ProcessIngressPkt(buf[:n])
+				peer.gateway.enqueuePkt(entry.ingressWorker.pktsChannel, buf[:n])
 				buf = freeBuf
 			} else {
-				peer.gateway.ProcessIngressPkt(buf[:n])
+				peer.gateway.enqueuePkt(entry.ingressWorker.pktsChannel, buf[:n])
 				buf = make([]byte, common.MaxMTU)
 			}
 		}
@@ -178,113 +399,7 @@ func (peer *peer) startIngressDataHandler() error {
 	return nil
 }
 
-// initHandshaking initiates a handshake process with a remote peer until it succeeds
-func (peer *peer) initHandshaking() {
-	log.Debug("Initiating handshake with", "addr", peer.remoteAddr())
-	hostKey, err := peer.drkeyMgr.clientHostKey()
-	if err != nil {
-		log.Error("Error retrieving DRKey", "err", err)
-		return
-	}
-	pubKey, pubTag, err := peer.keyMgr.getAuthdPubKey(hostKey)
-	if err != nil {
-		log.Error("Error getting authenticated public key", "err", err)
-	}
-	reqMsg := &handshakeRequestMsg{PubKey: pubKey,
-		PubKeyTag: pubTag,
-		CtrlPort:  getConnLocalPort(peer.ingressCtrlConn.conn),
-		DataPort:  getConnLocalPort(peer.ingressDataConn.conn)}
-	for !peer.handshakeCompleted {
-		err = peer.gateway.WriteMsgOneOff(reqMsg, peer.remoteAddr())
-		if err != nil {
-			log.Error("Error sending handshake request", "err", err)
-			return
-		}
-		log.Trace("Sent handshake request", "remote", peer.remoteAddr())
-		time.Sleep(handshakeRetryInterval)
-	}
-}
-
-// handleHandshakeRequest sets up connections with the other peer
-func (peer *peer) handleHandshakeRequest(reqMsg *handshakeRequestMsg) {
-	peer.handshakeRequestHandlerMutex.Lock()
-	defer peer.handshakeRequestHandlerMutex.Unlock()
-	log.Debug("Handling handshake request", "remote", peer.remoteAddr())
-	if peer.cryptoHandshakeComplete {
-		log.Warn("Ignoring handshake request, already completed")
-		return
-	}
-
-	hostKey, err := peer.drkeyMgr.serverHostKey()
-	if err != nil {
-		log.Error("Error retrieving server host key", "err", err)
-		return
-	}
-	tagMatch, err := peer.keyMgr.verifyRemotePubKey(reqMsg.PubKeyTag, reqMsg.PubKey, hostKey)
-	if err != nil {
-		log.Error("Error checking remote public key", "err", err)
-	} else if !tagMatch {
-		log.Error("Received public key authentication tag is not as expected")
-	}
-
-	// Setup egress connections
-	peer.remoteCtrlPort, peer.remoteDataPort = reqMsg.CtrlPort, reqMsg.DataPort
-	// manually update paths to setup initial connection
-	err = peer.pathMgr.updatePathsToRemote()
-	if err != nil {
-		log.Error("Error updating paths to remote", "err", err)
-		return
-	}
-	err = peer.setupEgressConnections()
-	if err != nil {
-		log.Error("Error setting up egress connections")
-		return
-	}
-
-	// Setup data plane crypto
-	err = peer.keyMgr.initDataCrypto(reqMsg.PubKey)
-	if err != nil {
-		log.Error("Error computing shared key", "err", err)
-		return
-	}
-	peer.cryptoHandshakeComplete = true
-
-	// Send ACK to remote gateway to check everything was successful
-	err = peer.gateway.WriteMsgOneOff(handshakeResponseMsg{}, peer.remoteAddr())
-	if err != nil {
-		log.Error("Error sending handshake response msg", "err", err)
-		return
-	}
-	peer.completeHandshake()
-}
-
-// handleHandshakeResponse confirms that the remote peer successfully initiated a connection with us
-func (peer *peer) handleHandshakeResponse(resMsg *handshakeResponseMsg) {
-	log.Debug("Handling handshake response", "remote", peer.remoteAddr())
-	peer.checkHandshakeComplete = true
-	peer.completeHandshake()
-}
-
-// completeHandshake completes handshake process (e.g., starting the pathMgr)
-func (peer *peer) completeHandshake() {
-	peer.handshakeCompletionMutex.Lock()
-	defer peer.handshakeCompletionMutex.Unlock()
-	if peer.handshakeCompleted {
-		// Handshake already completed, no need to do anything
-		assert(peer.cryptoHandshakeComplete && peer.handshakeCompleted, "")
-		return
-	}
-	if !peer.cryptoHandshakeComplete || !peer.checkHandshakeComplete {
-		// Handshake not complete yet, missing other part
-		return
-	}
-	log.Info("Completed handshake", "remote", peer.remote.Address.IA)
-	peer.pathMgr.start()
-	go peer.gateway.adapter.HandshakeComplete(peer)
-	peer.handshakeCompleted = true
-}
-
-func (peer *peer) getNewEConn(remoteIA addr.IA, remoteHost *net.UDPAddr, path snet.Path) (*eConn, error) {
+func (peer *peer) getNewEConn(remoteIA addr.IA, remoteHost *net.UDPAddr, path snet.Path, channel pktChannel) (*eConn, error) {
 	remoteAddr := &snet.UDPAddr{IA: remoteIA, Host: remoteHost}
 	remoteAddr.Path = path.Path()
 	remoteAddr.NextHop = path.OverlayNextHop()
@@ -292,29 +407,53 @@ func (peer *peer) getNewEConn(remoteIA addr.IA, remoteHost *net.UDPAddr, path sn
 	if err != nil {
 		return nil, err
 	}
-	return newEConn(conn, peer), nil
+	econn := newEConn(conn, peer, channel)
+	econn.maxLen = maxMsgLenForPath(path, pktHdrLen)
+	return econn, nil
 }
 
 // setupEgressConnections sets up new egressConnections (ctrl and data) toward the remote peer using pathMgr's currPath
 func (peer *peer) setupEgressConnections() error {
-	var err error
 	remoteAddr, remoteCtrlPort, remoteDataPort := peer.remoteAddr(), peer.remoteCtrlPort, peer.remoteDataPort
 	path := peer.pathMgr.getCurrPath()
+	if path == nil {
+		return peer.pathMgr.noPathError()
+	}
 
 	remoteCtrlHost := &net.UDPAddr{IP: remoteAddr.Host.IP, Port: remoteCtrlPort}
-	peer.egressCtrlEConn, err = peer.getNewEConn(remoteAddr.IA, remoteCtrlHost, path)
+	ctrlEConn, err := peer.getNewEConn(remoteAddr.IA, remoteCtrlHost, path, ctrlChannel)
 	if err != nil {
 		return err
 	}
 	log.Info("Ctrl", "path", ifacesToString(path.Interfaces()))
 
 	remoteDataHost := &net.UDPAddr{IP: remoteAddr.Host.IP, Port: remoteDataPort}
-	peer.egressDataEConn, err = peer.getNewEConn(remoteAddr.IA, remoteDataHost, path)
+	dataEConn, err := peer.getNewEConn(remoteAddr.IA, remoteDataHost, path, dataChannel)
 	if err != nil {
+		ctrlEConn.conn.Close()
 		return err
 	}
 	log.Info("Data", "path", ifacesToString(path.Interfaces()))
 
+	// Writers still holding the old connections fail, as if their packets were lost during the migration
+	peer.egressMutex.Lock()
+	old := []*eConn{peer.egressCtrlEConn, peer.egressDataEConn}
+	if peer.closed() {
+		// close already released the connections of the peer
+		old = []*eConn{ctrlEConn, dataEConn}
+	} else {
+		peer.egressCtrlEConn, peer.egressDataEConn = ctrlEConn, dataEConn
+	}
+	peer.egressMutex.Unlock()
+	for _, econn := range old {
+		if econn == nil {
+			continue
+		}
+		if err := econn.conn.Close(); err != nil {
+			log.Debug("Error closing connection", "remote", peer.remote.Address.IA, "err", err)
+		}
+	}
+
 	//go connFailHandler(client, peer.DataConn.conn)
 	//go connFailHandler(client, peer.CtrlConn)
 	return nil
@@ -327,5 +466,17 @@ func (peer *peer) String() string {
 }
 
 func (peer *peer) WriteMsg(msg Message) error {
-	return WriteMsg(msg, peer.egressCtrlEConn)
+	return WriteMsg(msg, peer.getEgressCtrlEConn())
+}
+
+func (peer *peer) getEgressCtrlEConn() *eConn {
+	peer.egressMutex.RLock()
+	defer peer.egressMutex.RUnlock()
+	return peer.egressCtrlEConn
+}
+
+func (peer *peer) getEgressDataEConn() *eConn {
+	peer.egressMutex.RLock()
+	defer peer.egressMutex.RUnlock()
+	return peer.egressDataEConn
 }
@@ -0,0 +1,90 @@
+/*
+Copyright (c) 2020, ETH and Andrea Tulimiero
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package gateway
+
+import (
+	"testing"
+)
+
+func TestRemovePeerWhileTrafficFlows(t *testing.T) {
+	d, sd := newTestTestbed()
+	a, b := newTestPair(t, d, sd)
+	p, err := a.getPeer(b.conf.Address.IA.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop := make(chan struct{})
+	doneA, doneB := sendTraffic(a, stop), sendTraffic(b, stop)
+	b.adapter.waitReceived(t)
+	a.adapter.waitReceived(t)
+
+	if err := a.RemovePeer(b.conf.Address.IA); err != nil {
+		t.Fatal(err)
+	}
+	close(stop)
+	<-doneA
+	<-doneB
+	if !p.closed() {
+		t.Error("removed peer not closed")
+	}
+	if p.keyMgr.sendSession() != nil {
+		t.Error("session keys of removed peer not wiped")
+	}
+	if _, err := p.DataWriter().Write([]byte("late")); err == nil {
+		t.Error("write to removed peer succeeded")
+	}
+	if _, err := a.getPeer(b.conf.Address.IA.String()); err == nil {
+		t.Error("removed peer still reachable")
+	}
+	if err := a.RemovePeer(b.conf.Address.IA); err == nil {
+		t.Error("removed peer removed twice")
+	}
+}
+
+func TestSetupEgressConnectionsClosesOld(t *testing.T) {
+	d, sd := newTestTestbed()
+	a, b := newTestPair(t, d, sd)
+	p, err := a.getPeer(b.conf.Address.IA.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := p.getEgressDataEConn()
+	conns := d.numConns()
+	for i := 0; i < 3; i++ {
+		if err := p.setupEgressConnections(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if actual := d.numConns(); actual != conns {
+		t.Errorf("expected = %d open connections, actual = %d", conns, actual)
+	}
+	if _, err := old.Write([]byte("stale")); err == nil {
+		t.Error("write on replaced connection succeeded")
+	}
+	a.ProcessEgressPkt([]byte("after"))
+	for {
+		if string(b.adapter.waitReceived(t)) == "after" {
+			break
+		}
+	}
+}
@@ -0,0 +1,280 @@
+/*
+Copyright (c) 2020, ETH and Andrea Tulimiero
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package gateway
+
+import (
+	"errors"
+	"fmt"
+	"github.com/scionproto/scion/go/lib/addr"
+	"github.com/scionproto/scion/go/lib/common"
+	"github.com/scionproto/scion/go/lib/snet"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// hopPatternChars are the characters of the hop patterns of sequences
+const hopPatternChars = "0123456789abcdefABCDEF:#,-"
+
+var (
+	noPathError          = errors.New("no path to remote")
+	noCompliantPathError = errors.New("no path complies with the path policy")
+)
+
+// pathPolicyConf restricts the paths used toward the remotes selecting it (see pathingConf.Policy).
+// Hops are matched by patterns like 1-ff00:0:110#2,3: 0 matches any ISD, AS, or interface,
+// the AS and the interfaces can be omitted, and a single interface matches either the ingress or the egress one.
+type pathPolicyConf struct {
+	// ACL lists entries like "+ 1-ff00:0:110" or "- 2", the first entry matching a hop of a path decides whether
+	// the hop can be crossed. A bare "+" or "-" matches all hops, and unmatched hops are denied.
+	// All hops are allowed if the ACL is empty.
+	ACL []string `yaml:"acl"`
+	// Sequence is a regular expression over the hops of a path (e.g., "1-ff00:0:110 0* 2-0"),
+	// patterns can be grouped with parentheses and combined with |, ?, +, and *
+	Sequence string `yaml:"sequence"`
+}
+
+// pathPolicy is a parsed pathPolicyConf
+type pathPolicy struct {
+	acl      []aclEntry
+	sequence *regexp.Regexp
+}
+
+type aclEntry struct {
+	allow bool
+	hop   hopPredicate
+}
+
+// pathHop is an AS crossed by a path, with its ingress and egress interfaces (0 at the ends of the path)
+type pathHop struct {
+	ia      addr.IA
+	in, out common.IFIDType
+}
+
+func (h pathHop) String() string {
+	return fmt.Sprintf("%d-%s#%d,%d", h.ia.I, h.ia.A, h.in, h.out)
+}
+
+// pathHops returns the hops of a path, whose interfaces are listed in pairs except for the ones of its ends
+func pathHops(path snet.Path) []pathHop {
+	ifaces := path.Interfaces()
+	var hops []pathHop
+	for i := 0; i < len(ifaces); {
+		hop := pathHop{ia: ifaces[i].IA()}
+		switch {
+		case i == 0:
+			hop.out = ifaces[i].ID()
+			i++
+		case i == len(ifaces)-1:
+			hop.in = ifaces[i].ID()
+			i++
+		default:
+			hop.in, hop.out = ifaces[i].ID(), ifaces[i+1].ID()
+			i += 2
+		}
+		hops = append(hops, hop)
+	}
+	return hops
+}
+
+// hopPredicate matches the hops of a path, zero values match any ISD, AS, or interface
+type hopPredicate struct {
+	isd   addr.ISD
+	as    addr.AS
+	ifIDs []common.IFIDType
+}
+
+func (p hopPredicate) matches(hop pathHop) bool {
+	if (p.isd != 0 && p.isd != hop.ia.I) || (p.as != 0 && p.as != hop.ia.A) {
+		return false
+	}
+	switch len(p.ifIDs) {
+	case 1:
+		return p.ifIDs[0] == 0 || p.ifIDs[0] == hop.in || p.ifIDs[0] == hop.out
+	case 2:
+		return (p.ifIDs[0] == 0 || p.ifIDs[0] == hop.in) && (p.ifIDs[1] == 0 || p.ifIDs[1] == hop.out)
+	}
+	return true
+}
+
+// regexp returns an expression matching the string of the hops matched by the predicate (see pathHop.String)
+func (p hopPredicate) regexp() string {
+	isd, as := `\d+`, `[^#]+`
+	if p.isd != 0 {
+		isd = strconv.FormatUint(uint64(p.isd), 10)
+	}
+	if p.as != 0 {
+		as = regexp.QuoteMeta(p.as.String())
+	}
+	ifID := func(id common.IFIDType) string {
+		if id == 0 {
+			return `\d+`
+		}
+		return strconv.FormatUint(uint64(id), 10)
+	}
+	ifIDs := `\d+,\d+`
+	switch len(p.ifIDs) {
+	case 1:
+		ifIDs = fmt.Sprintf(`(?:%s,\d+|\d+,%s)`, ifID(p.ifIDs[0]), ifID(p.ifIDs[0]))
+	case 2:
+		ifIDs = ifID(p.ifIDs[0]) + "," + ifID(p.ifIDs[1])
+	}
+	return fmt.Sprintf("%s-%s#%s ", isd, as, ifIDs)
+}
+
+// newHopPredicate parses a hop pattern (e.g., 1, 1-0, 1-ff00:0:110, 1-ff00:0:110#2, or 1-ff00:0:110#2,3)
+func newHopPredicate(s string) (hopPredicate, error) {
+	var p hopPredicate
+	iaPart, ifPart := s, ""
+	if i := strings.IndexByte(s, '#'); i >= 0 {
+		iaPart, ifPart = s[:i], s[i+1:]
+	}
+	parts := strings.SplitN(iaPart, "-", 2)
+	isd, err := addr.ISDFromString(parts[0])
+	if err != nil {
+		return p, fmt.Errorf("invalid ISD in hop pattern %s: %s", s, err)
+	}
+	p.isd = isd
+	if len(parts) == 2 {
+		as, err := addr.ASFromString(parts[1])
+		if err != nil {
+			return p, fmt.Errorf("invalid AS in hop pattern %s: %s", s, err)
+		}
+		p.as = as
+	}
+	if ifPart != "" {
+		if len(parts) != 2 {
+			return p, fmt.Errorf("hop pattern with interfaces but without AS: %s", s)
+		}
+		ifIDs := strings.Split(ifPart, ",")
+		if len(ifIDs) > 2 {
+			return p, fmt.Errorf("too many interfaces in hop pattern %s", s)
+		}
+		for _, ifID := range ifIDs {
+			id, err := strconv.ParseUint(ifID, 10, 64)
+			if err != nil {
+				return p, fmt.Errorf("invalid interface in hop pattern %s: %s", s, err)
+			}
+			p.ifIDs = append(p.ifIDs, common.IFIDType(id))
+		}
+	}
+	return p, nil
+}
+
+// newSequence compiles a sequence of hop patterns into a regular expression over the string of the hops of a path
+func newSequence(seq string) (*regexp.Regexp, error) {
+	var b strings.Builder
+	for i := 0; i < len(seq); {
+		switch c := seq[i]; c {
+		case ' ', '\t':
+			i++
+		case '(':
+			b.WriteString("(?:")
+			i++
+		case ')', '|', '?', '+', '*':
+			b.WriteByte(c)
+			i++
+		default:
+			j := i
+			for j < len(seq) && strings.IndexByte(hopPatternChars, seq[j]) >= 0 {
+				j++
+			}
+			if j == i {
+				return nil, fmt.Errorf("invalid character in sequence %q: %q", seq, c)
+			}
+			p, err := newHopPredicate(seq[i:j])
+			if err != nil {
+				return nil, err
+			}
+			b.WriteString("(?:" + p.regexp() + ")")
+			i = j
+		}
+	}
+	re, err := regexp.Compile("^(?:" + b.String() + ")$")
+	if err != nil {
+		return nil, fmt.Errorf("invalid sequence %q: %s", seq, err)
+	}
+	return re, nil
+}
+
+func newPathPolicy(conf pathPolicyConf) (*pathPolicy, error) {
+	policy := &pathPolicy{}
+	for _, entry := range conf.ACL {
+		fields := strings.Fields(entry)
+		if len(fields) == 0 || len(fields) > 2 || (fields[0] != "+" && fields[0] != "-") {
+			return nil, fmt.Errorf("invalid ACL entry: %q", entry)
+		}
+		e := aclEntry{allow: fields[0] == "+"}
+		if len(fields) == 2 {
+			var err error
+			if e.hop, err = newHopPredicate(fields[1]); err != nil {
+				return nil, err
+			}
+		}
+		policy.acl = append(policy.acl, e)
+	}
+	if conf.Sequence != "" {
+		var err error
+		if policy.sequence, err = newSequence(conf.Sequence); err != nil {
+			return nil, err
+		}
+	}
+	return policy, nil
+}
+
+// allows tells whether a hop can be crossed according to the ACL
+func (p *pathPolicy) allows(hop pathHop) bool {
+	if len(p.acl) == 0 {
+		return true
+	}
+	for _, e := range p.acl {
+		if e.hop.matches(hop) {
+			return e.allow
+		}
+	}
+	return false
+}
+
+// compliant tells whether all the hops of a path are allowed and match the sequence
+func (p *pathPolicy) compliant(path snet.Path) bool {
+	hops := pathHops(path)
+	var b strings.Builder
+	for _, hop := range hops {
+		if !p.allows(hop) {
+			return false
+		}
+		b.WriteString(hop.String() + " ")
+	}
+	return p.sequence == nil || p.sequence.MatchString(b.String())
+}
+
+// filter returns the paths complying with the policy
+func (p *pathPolicy) filter(paths []snet.Path) []snet.Path {
+	var compliant []snet.Path
+	for _, path := range paths {
+		if p.compliant(path) {
+			compliant = append(compliant, path)
+		}
+	}
+	return compliant
+}
@@ -0,0 +1,255 @@
+/*
+Copyright (c) 2020, ETH and Andrea Tulimiero
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package gateway
+
+import (
+	"github.com/scionproto/scion/go/lib/addr"
+	"github.com/scionproto/scion/go/lib/common"
+	"github.com/scionproto/scion/go/lib/snet"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// newTestPath returns a path crossing the interfaces ifaces, each like "1-ff00:0:110#2"
+func newTestPath(t *testing.T, name string, ifaces ...string) *testPath {
+	p := &testPath{name: name}
+	for _, iface := range ifaces {
+		parts := strings.Split(iface, "#")
+		ia, err := addr.IAFromString(parts[0])
+		if err != nil {
+			t.Fatalf("invalid interface %s: %s", iface, err)
+		}
+		id, err := strconv.ParseUint(parts[1], 10, 64)
+		if err != nil {
+			t.Fatalf("invalid interface %s: %s", iface, err)
+		}
+		p.ifaces = append(p.ifaces, testIface{ia: ia, id: common.IFIDType(id)})
+	}
+	return p
+}
+
+// Paths from 1-ff00:0:110 to 1-ff00:0:112 via 1-ff00:0:111, and from 1-ff00:0:110 to 2-ff00:0:210 via 1-ff00:0:111
+var (
+	testPathVia111  = []string{"1-ff00:0:110#1", "1-ff00:0:111#2", "1-ff00:0:111#3", "1-ff00:0:112#4"}
+	testPathToISD2  = []string{"1-ff00:0:110#1", "1-ff00:0:111#2", "1-ff00:0:111#5", "2-ff00:0:210#6"}
+	testPathDirect  = []string{"1-ff00:0:110#7", "1-ff00:0:112#8"}
+	testPathsPolicy = map[string][]string{"via111": testPathVia111, "toISD2": testPathToISD2, "direct": testPathDirect}
+)
+
+func TestPathHops(t *testing.T) {
+	tests := []struct {
+		name     string
+		ifaces   []string
+		expected []string
+	}{
+		{name: "local", expected: nil},
+		{name: "direct", ifaces: testPathDirect, expected: []string{"1-ff00:0:110#0,7", "1-ff00:0:112#8,0"}},
+		{
+			name:     "transit",
+			ifaces:   testPathVia111,
+			expected: []string{"1-ff00:0:110#0,1", "1-ff00:0:111#2,3", "1-ff00:0:112#4,0"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var hops []string
+			for _, hop := range pathHops(newTestPath(t, test.name, test.ifaces...)) {
+				hops = append(hops, hop.String())
+			}
+			if !reflect.DeepEqual(hops, test.expected) {
+				t.Errorf("expected = %v, actual = %v", test.expected, hops)
+			}
+		})
+	}
+}
+
+func TestNewHopPredicate(t *testing.T) {
+	tests := []struct {
+		pattern   string
+		expectErr bool
+		// matches and mismatches are hops like 1-ff00:0:111#2,3
+		matches, mismatches []string
+	}{
+		{pattern: "0", matches: []string{"1-ff00:0:111#2,3", "2-ff00:0:210#0,6"}},
+		{pattern: "1", matches: []string{"1-ff00:0:111#2,3"}, mismatches: []string{"2-ff00:0:210#0,6"}},
+		{pattern: "1-0", matches: []string{"1-ff00:0:111#2,3"}, mismatches: []string{"2-ff00:0:210#0,6"}},
+		{pattern: "1-ff00:0:111", matches: []string{"1-ff00:0:111#2,3"}, mismatches: []string{"1-ff00:0:112#4,0"}},
+		{pattern: "0-ff00:0:111", matches: []string{"1-ff00:0:111#2,3"}, mismatches: []string{"1-ff00:0:110#0,1"}},
+		{
+			pattern:    "1-ff00:0:111#3",
+			matches:    []string{"1-ff00:0:111#2,3", "1-ff00:0:111#3,5"},
+			mismatches: []string{"1-ff00:0:111#2,5"},
+		},
+		{
+			pattern:    "1-ff00:0:111#2,3",
+			matches:    []string{"1-ff00:0:111#2,3"},
+			mismatches: []string{"1-ff00:0:111#3,2", "1-ff00:0:111#2,5"},
+		},
+		{pattern: "1-ff00:0:111#0,3", matches: []string{"1-ff00:0:111#2,3"}, mismatches: []string{"1-ff00:0:111#3,2"}},
+		{pattern: "", expectErr: true},
+		{pattern: "x", expectErr: true},
+		{pattern: "1-zz", expectErr: true},
+		{pattern: "1#2", expectErr: true},
+		{pattern: "1-ff00:0:111#1,2,3", expectErr: true},
+		{pattern: "1-ff00:0:111#a", expectErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.pattern, func(t *testing.T) {
+			p, err := newHopPredicate(test.pattern)
+			if test.expectErr {
+				if err == nil {
+					t.Errorf("expected error, parsed %+v", p)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, s := range test.matches {
+				if hop := parseTestHop(t, s); !p.matches(hop) {
+					t.Errorf("expected %s to match", s)
+				}
+			}
+			for _, s := range test.mismatches {
+				if hop := parseTestHop(t, s); p.matches(hop) {
+					t.Errorf("expected %s not to match", s)
+				}
+			}
+		})
+	}
+}
+
+// parseTestHop parses a hop like 1-ff00:0:111#2,3
+func parseTestHop(t *testing.T, s string) pathHop {
+	parts := strings.Split(s, "#")
+	ia, err := addr.IAFromString(parts[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	ifIDs := strings.Split(parts[1], ",")
+	in, _ := strconv.ParseUint(ifIDs[0], 10, 64)
+	out, _ := strconv.ParseUint(ifIDs[1], 10, 64)
+	return pathHop{ia: ia, in: common.IFIDType(in), out: common.IFIDType(out)}
+}
+
+func TestNewSequence(t *testing.T) {
+	tests := []struct {
+		sequence  string
+		expectErr bool
+		// compliant lists the names of testPathsPolicy matched by the sequence
+		compliant []string
+	}{
+		{sequence: "0*", compliant: []string{"direct", "toISD2", "via111"}},
+		{sequence: "0 0", compliant: []string{"direct"}},
+		{sequence: "0 0 0", compliant: []string{"toISD2", "via111"}},
+		{sequence: "0* 1-ff00:0:111 0*", compliant: []string{"toISD2", "via111"}},
+		{sequence: "0* 1-ff00:0:111#2,3 0*", compliant: []string{"via111"}},
+		{sequence: "1+ 2", compliant: []string{"toISD2"}},
+		{sequence: "1-ff00:0:110 (1-ff00:0:111 | 1-ff00:0:113)? 1-ff00:0:112", compliant: []string{"direct", "via111"}},
+		{sequence: "1-ff00:0:110#7 0*", compliant: []string{"direct"}},
+		{sequence: "2*"},
+		{sequence: "0 (0", expectErr: true},
+		{sequence: "0 [0]", expectErr: true},
+		{sequence: "1-zz", expectErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.sequence, func(t *testing.T) {
+			policy, err := newPathPolicy(pathPolicyConf{Sequence: test.sequence})
+			if test.expectErr {
+				if err == nil {
+					t.Errorf("expected error, compiled %s", policy.sequence)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkCompliantTestPaths(t, policy, test.compliant)
+		})
+	}
+}
+
+func TestNewPathPolicy(t *testing.T) {
+	tests := []struct {
+		name      string
+		conf      pathPolicyConf
+		expectErr bool
+		compliant []string
+	}{
+		{name: "empty", compliant: []string{"direct", "toISD2", "via111"}},
+		{name: "deny ISD", conf: pathPolicyConf{ACL: []string{"- 2", "+"}}, compliant: []string{"direct", "via111"}},
+		{
+			name:      "deny interface",
+			conf:      pathPolicyConf{ACL: []string{"- 1-ff00:0:111#3", "+ 0"}},
+			compliant: []string{"direct", "toISD2"},
+		},
+		{
+			name:      "first match decides",
+			conf:      pathPolicyConf{ACL: []string{"+ 1-ff00:0:111", "- 1-ff00:0:111", "+"}},
+			compliant: []string{"direct", "toISD2", "via111"},
+		},
+		{name: "unmatched hops are denied", conf: pathPolicyConf{ACL: []string{"+ 1"}}, compliant: []string{"direct", "via111"}},
+		{
+			name:      "ACL and sequence",
+			conf:      pathPolicyConf{ACL: []string{"- 2", "+"}, Sequence: "0 0 0"},
+			compliant: []string{"via111"},
+		},
+		{name: "empty entry", conf: pathPolicyConf{ACL: []string{""}}, expectErr: true},
+		{name: "invalid action", conf: pathPolicyConf{ACL: []string{"? 1"}}, expectErr: true},
+		{name: "too many fields", conf: pathPolicyConf{ACL: []string{"+ 1 2"}}, expectErr: true},
+		{name: "invalid hop", conf: pathPolicyConf{ACL: []string{"+ 1-zz"}}, expectErr: true},
+		{name: "invalid sequence", conf: pathPolicyConf{Sequence: "("}, expectErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			policy, err := newPathPolicy(test.conf)
+			if test.expectErr {
+				if err == nil {
+					t.Errorf("expected error, parsed %+v", policy)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkCompliantTestPaths(t, policy, test.compliant)
+		})
+	}
+}
+
+// checkCompliantTestPaths checks that the policy filters testPathsPolicy down to the paths named in expected
+func checkCompliantTestPaths(t *testing.T, policy *pathPolicy, expected []string) {
+	var paths []snet.Path
+	for _, name := range []string{"direct", "toISD2", "via111"} {
+		paths = append(paths, newTestPath(t, name, testPathsPolicy[name]...))
+	}
+	var compliant []string
+	for _, path := range policy.filter(paths) {
+		compliant = append(compliant, string(path.Fingerprint()))
+	}
+	if !reflect.DeepEqual(compliant, expected) {
+		t.Errorf("expected = %v, actual = %v", expected, compliant)
+	}
+}
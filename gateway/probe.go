@@ -0,0 +1,349 @@
+/*
+Copyright (c) 2020, ETH and Andrea Tulimiero
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package gateway
+
+import (
+	"github.com/scionproto/scion/go/lib/log"
+	"github.com/scionproto/scion/go/lib/snet"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// probeWindow is the number of keepalive probes tracked to attribute their echoes to paths
+	probeWindow = 256
+	// rttGain and jitterGain are the gains of the smoothed RTT and jitter estimators (see RFC 6298)
+	rttGain    = 0.125
+	jitterGain = 0.25
+	// lossGain is the weight of the last probe in the loss estimate
+	lossGain = 0.1
+	// probeLossThreshold is the number of consecutive probes a backup path loses before it is considered failed
+	probeLossThreshold = 3
+	// minPathBackoff and maxPathBackoff bound the time a failed path is not probed nor migrated to
+	minPathBackoff = 1 * time.Second
+	maxPathBackoff = 1 * time.Minute
+)
+
+// probe is a keepalive sent over a path, it is done once echoed or accounted as lost
+type probe struct {
+	seq    uint32
+	path   snet.PathFingerprint
+	sentAt time.Time
+	done   bool
+}
+
+// pathHealth tracks the failures of a path, failed paths back off exponentially before being tried again
+type pathHealth struct {
+	failures  int
+	retryAt   time.Time
+	lastAlive time.Time
+	// aliveSince is the time of the first echo since the last failure
+	aliveSince time.Time
+	// losses is the number of consecutive probes lost since the last echo or failure
+	losses int
+}
+
+func (h pathHealth) backingOff() bool {
+	return time.Now().Before(h.retryAt)
+}
+
+// aliveWithin returns whether the path was confirmed alive within d and did not fail since
+func (h pathHealth) aliveWithin(d time.Duration) bool {
+	return h.failures == 0 && !h.lastAlive.IsZero() && time.Since(h.lastAlive) <= d
+}
+
+// newProbe returns a keepalive probing path, backup is set if the path is not in use
+func (m *pathMgr) newProbe(path snet.Path, backup bool) *keepAliveMsg {
+	m.probesMutex.Lock()
+	defer m.probesMutex.Unlock()
+	m.nextProbeSeq++
+	p := probe{seq: m.nextProbeSeq, path: path.Fingerprint(), sentAt: time.Now()}
+	m.probes[p.seq%probeWindow] = p
+	return &keepAliveMsg{Seq: p.seq, Timestamp: p.sentAt.UnixNano(), Backup: backup}
+}
+
+// handleKeepAliveEcho updates the metrics of the path of an echoed probe
+func (m *pathMgr) handleKeepAliveEcho(msg *keepAliveMsg) {
+	m.probesMutex.Lock()
+	p := &m.probes[msg.Seq%probeWindow]
+	if p.seq != msg.Seq || p.done || p.sentAt.UnixNano() != msg.Timestamp {
+		// Echo of a probe already accounted as lost, or forged
+		m.probesMutex.Unlock()
+		return
+	}
+	p.done = true
+	path := p.path
+	m.probesMutex.Unlock()
+	rtt := time.Since(time.Unix(0, msg.Timestamp))
+	log.Trace("Keepalive echo", "remote", m.peer.remote.Address.IA, "rtt", rtt, "backup", msg.Backup)
+	m.updateMetrics(path, rtt, false)
+	m.markAlive(path)
+}
+
+// expireProbes accounts the probes that were not echoed within timeout as lost. Backup paths fail after
+// probeLossThreshold consecutive losses, while the path in use is left to the keepalive timeout.
+func (m *pathMgr) expireProbes(timeout time.Duration) {
+	var lost []snet.PathFingerprint
+	m.probesMutex.Lock()
+	for i := range m.probes {
+		p := &m.probes[i]
+		if p.seq != 0 && !p.done && time.Since(p.sentAt) > timeout {
+			p.done = true
+			lost = append(lost, p.path)
+		}
+	}
+	m.probesMutex.Unlock()
+	curr := m.getCurrPath()
+	for _, path := range lost {
+		m.updateMetrics(path, 0, true)
+		if curr != nil && path == curr.Fingerprint() {
+			continue
+		}
+		if m.countLoss(path) >= probeLossThreshold {
+			m.markFailed(path)
+		}
+	}
+}
+
+// countLoss records a lost probe of a path, it returns the number of consecutive losses
+func (m *pathMgr) countLoss(path snet.PathFingerprint) int {
+	m.metricsMutex.Lock()
+	defer m.metricsMutex.Unlock()
+	health := m.health[path]
+	health.losses++
+	m.health[path] = health
+	return health.losses
+}
+
+// pathHealth returns the health of a path
+func (m *pathMgr) pathHealth(path snet.Path) pathHealth {
+	m.metricsMutex.RLock()
+	defer m.metricsMutex.RUnlock()
+	return m.health[path.Fingerprint()]
+}
+
+// markAlive records that a path was confirmed alive, ending its backoff
+func (m *pathMgr) markAlive(path snet.PathFingerprint) {
+	m.metricsMutex.Lock()
+	defer m.metricsMutex.Unlock()
+	health, now := m.health[path], time.Now()
+	if health.failures > 0 || health.aliveSince.IsZero() {
+		health = pathHealth{aliveSince: now}
+	}
+	health.lastAlive, health.losses = now, 0
+	m.health[path] = health
+}
+
+// markFailed records a failure of a path, which backs off twice as long as after its previous failure.
+// Failures while the path is backing off are not counted.
+func (m *pathMgr) markFailed(path snet.PathFingerprint) {
+	m.metricsMutex.Lock()
+	defer m.metricsMutex.Unlock()
+	health := m.health[path]
+	if health.backingOff() {
+		return
+	}
+	backoff := maxPathBackoff
+	if health.failures < 6 {
+		backoff = minPathBackoff << uint(health.failures)
+	}
+	if backoff > maxPathBackoff {
+		backoff = maxPathBackoff
+	}
+	health.failures, health.losses = health.failures+1, 0
+	health.retryAt = time.Now().Add(backoff)
+	m.health[path] = health
+	log.Debug("Path failed, backing off", "remote", m.peer.remote.Address.IA, "failures", health.failures,
+		"backoff", backoff)
+}
+
+// backupProber probes the best ranked alternatives to the path in use every BackupProbeInterval,
+// skipping the paths that are backing off, so that migrations pick paths known to be alive
+func (m *pathMgr) backupProber(stop <-chan struct{}) {
+	conns := make(map[snet.PathFingerprint]*eConn)
+	defer func() {
+		for _, econn := range conns {
+			econn.conn.Close()
+		}
+	}()
+	conf, confUpdated := m.watchConf()
+	t := time.NewTicker(conf.BackupProbeInterval)
+	for {
+		select {
+		case <-stop:
+			t.Stop()
+			return
+		case <-confUpdated:
+			t.Stop()
+			conf, confUpdated = m.watchConf()
+			t = time.NewTicker(conf.BackupProbeInterval)
+		case <-t.C:
+			if atomic.LoadInt32(&m.isMigrating) == 1 {
+				continue
+			}
+			backups := m.backupPaths(conf.BackupPaths)
+			inUse := make(map[snet.PathFingerprint]struct{})
+			for _, path := range backups {
+				f := path.Fingerprint()
+				inUse[f] = struct{}{}
+				econn, ok := conns[f]
+				if !ok {
+					var err error
+					econn, err = m.peer.getNewEConn(m.peer.remoteAddr().IA,
+						&net.UDPAddr{IP: m.peer.remoteAddr().Host.IP, Port: m.peer.remoteCtrlPort}, path, ctrlChannel)
+					if err != nil {
+						log.Debug("Error connecting over backup path", "path", ifacesToString(path.Interfaces()),
+							"err", err)
+						continue
+					}
+					conns[f] = econn
+				}
+				if err := WriteMsg(m.newProbe(path, true), econn); err != nil {
+					log.Debug("Couldn't write backup probe", "path", ifacesToString(path.Interfaces()), "err", err)
+				}
+			}
+			for f, econn := range conns {
+				if _, ok := inUse[f]; !ok {
+					econn.conn.Close()
+					delete(conns, f)
+				}
+			}
+			if conf.FailbackHoldDown > 0 {
+				if err := m.failback(conf); err != nil {
+					log.Error("Fail-back failed", "remote", m.peer.remote.Address.IA, "err", err)
+				}
+			}
+		}
+	}
+}
+
+// failback switches to the best ranked path that is better than the one in use and was alive for FailbackHoldDown.
+// The path in use must also have been in use for FailbackHoldDown, so that paths going up and down don't cause flapping.
+func (m *pathMgr) failback(conf *pathingConf) error {
+	m.pathsUpdateMutex.Lock()
+	if m.currPath == nil || len(m.paths) == 0 || m.currPath.Fingerprint() != m.paths[m.pathIdx].Fingerprint() ||
+		time.Since(m.lastMigration) < conf.FailbackHoldDown {
+		// Hidden paths are left alone, they are given up upon the next refresh
+		m.pathsUpdateMutex.Unlock()
+		return nil
+	}
+	var target snet.Path
+	aliveWithin := 2*conf.BackupProbeInterval + conf.KeepAliveTimeout
+	for i := 0; i < m.pathIdx; i++ {
+		health := m.pathHealth(m.paths[i])
+		if health.aliveWithin(aliveWithin) && time.Since(health.aliveSince) >= conf.FailbackHoldDown {
+			target = m.paths[i]
+			break
+		}
+	}
+	m.pathsUpdateMutex.Unlock()
+	if target == nil {
+		return nil
+	}
+	if !atomic.CompareAndSwapInt32(&m.isMigrating, 0, 1) {
+		return nil
+	}
+	defer atomic.StoreInt32(&m.isMigrating, 0)
+	m.pathsUpdateMutex.Lock()
+	idx := -1
+	for i, path := range m.paths {
+		if path.Fingerprint() == target.Fingerprint() {
+			idx = i
+			break
+		}
+	}
+	if idx == -1 {
+		// The path went away in a refresh meanwhile
+		m.pathsUpdateMutex.Unlock()
+		return nil
+	}
+	m.pathIdx, m.currPath = idx, m.paths[idx]
+	m.lastMigration = time.Now()
+	m.pathsUpdateMutex.Unlock()
+	log.Info("Failing back to better ranked path", "remote", m.peer.remote.Address.IA,
+		"path", ifacesToString(target.Interfaces()))
+	m.resetTimeouts()
+	return m.peer.setupEgressConnections()
+}
+
+// backupPaths returns the n best ranked paths other than the one in use that are not backing off
+func (m *pathMgr) backupPaths(n int) []snet.Path {
+	m.pathsUpdateMutex.Lock()
+	defer m.pathsUpdateMutex.Unlock()
+	var backups []snet.Path
+	for _, path := range m.paths {
+		if len(backups) == n {
+			break
+		}
+		if m.currPath != nil && path.Fingerprint() == m.currPath.Fingerprint() {
+			continue
+		}
+		if m.pathHealth(path).backingOff() {
+			continue
+		}
+		backups = append(backups, path)
+	}
+	return backups
+}
+
+// updateMetrics updates the metrics of a path with the outcome of a probe
+func (m *pathMgr) updateMetrics(path snet.PathFingerprint, rtt time.Duration, lost bool) {
+	m.metricsMutex.Lock()
+	defer m.metricsMutex.Unlock()
+	metrics := m.metrics[path]
+	if lost {
+		metrics.Loss += lossGain * (1 - metrics.Loss)
+		m.metrics[path] = metrics
+		return
+	}
+	metrics.Loss -= lossGain * metrics.Loss
+	if metrics.RTT == 0 {
+		metrics.RTT, metrics.Jitter = rtt, rtt/2
+	} else {
+		delta := metrics.RTT - rtt
+		if delta < 0 {
+			delta = -delta
+		}
+		metrics.Jitter += time.Duration(jitterGain * float64(delta-metrics.Jitter))
+		metrics.RTT += time.Duration(rttGain * float64(rtt-metrics.RTT))
+	}
+	m.metrics[path] = metrics
+}
+
+// pathStats returns the metrics of the paths toward the remote
+func (m *pathMgr) pathStats() []PathStats {
+	m.pathsUpdateMutex.Lock()
+	paths, curr := m.paths, m.currPath
+	m.pathsUpdateMutex.Unlock()
+	stats := make([]PathStats, 0, len(paths))
+	for _, path := range paths {
+		stats = append(stats, PathStats{
+			Path:        ifacesToString(path.Interfaces()),
+			PathMetrics: m.pathMetrics(path),
+			Current:     curr != nil && curr.Fingerprint() == path.Fingerprint(),
+			Healthy:     !m.pathHealth(path).backingOff(),
+		})
+	}
+	return stats
+}
@@ -0,0 +1,452 @@
+/*
+Copyright (c) 2020, ETH and Andrea Tulimiero
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package gateway
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/scionproto/scion/go/lib/addr"
+	"github.com/scionproto/scion/go/lib/common"
+	"github.com/scionproto/scion/go/lib/snet"
+	"github.com/scionproto/scion/go/lib/spath"
+	"math"
+	"net"
+	"testing"
+	"time"
+)
+
+// testPathingConf probes backup paths every second with a keepalive timeout of 300ms,
+// paths are thus alive if they were echoed within the last 2.3s
+var testPathingConf = pathingConf{KeepAliveTimeout: 300 * time.Millisecond, BackupProbeInterval: 1 * time.Second,
+	FailbackHoldDown: 30 * time.Second}
+
+// Health of the paths in tests, relative to the time tests run
+func healthAlive() pathHealth {
+	return pathHealth{lastAlive: time.Now(), aliveSince: time.Now().Add(-time.Hour)}
+}
+
+func healthStale() pathHealth {
+	return pathHealth{lastAlive: time.Now().Add(-10 * time.Second), aliveSince: time.Now().Add(-time.Hour)}
+}
+
+func healthFailed() pathHealth {
+	return pathHealth{failures: 1, retryAt: time.Now().Add(time.Hour), lastAlive: time.Now()}
+}
+
+// healthRecovered is a path that failed, backed off, and was not confirmed alive since
+func healthRecovered() pathHealth {
+	return pathHealth{failures: 1, retryAt: time.Now().Add(-time.Second), lastAlive: time.Now()}
+}
+
+var testDialError = errors.New("dial disabled in tests")
+
+// testNetwork fails to set up connections, so that tests can migrate paths without network
+type testNetwork struct{}
+
+func (testNetwork) Listen(context.Context, string, *net.UDPAddr, addr.HostSVC) (*snet.Conn, error) {
+	return nil, testDialError
+}
+
+func (testNetwork) Dial(context.Context, string, *net.UDPAddr, *snet.UDPAddr, addr.HostSVC) (*snet.Conn, error) {
+	return nil, testDialError
+}
+
+// newTestPathMgr returns a pathMgr using the paths named after their index (see testPathsByHops)
+func newTestPathMgr(n, pathIdx int, health map[snet.PathFingerprint]pathHealth) *pathMgr {
+	pathing := testPathingConf
+	gateway := &Gateway{conf: conf{Address: YUDPAddr{&snet.UDPAddr{Host: &net.UDPAddr{}}}}, network: testNetwork{}}
+	peer := &peer{gateway: gateway, remote: ConnConf{Address: YUDPAddr{&snet.UDPAddr{Host: &net.UDPAddr{}}}}}
+	m := newPathMgr(&pathing, peer)
+	peer.pathMgr = m
+	m.paths = testPathsByHops(make([]int, n)...)
+	m.pathIdx, m.currPath = pathIdx, m.paths[pathIdx]
+	for path, h := range health {
+		m.health[path] = h
+	}
+	return m
+}
+
+func TestFailoverPathIdx(t *testing.T) {
+	tests := []struct {
+		name     string
+		paths    int
+		pathIdx  int
+		health   map[snet.PathFingerprint]pathHealth
+		expected int
+	}{
+		{name: "unknown paths", paths: 4, pathIdx: 0, expected: 1},
+		{name: "unknown paths after middle", paths: 4, pathIdx: 2, expected: 3},
+		{name: "unknown paths wrap around", paths: 4, pathIdx: 3, expected: 0},
+		{name: "single path", paths: 1, pathIdx: 0, expected: 0},
+		{
+			name: "best ranked alive", paths: 4, pathIdx: 0, expected: 2,
+			health: map[snet.PathFingerprint]pathHealth{"c": healthAlive(), "d": healthAlive()},
+		},
+		{
+			name: "better ranked alive", paths: 4, pathIdx: 2, expected: 0,
+			health: map[snet.PathFingerprint]pathHealth{"a": healthAlive(), "d": healthAlive()},
+		},
+		{
+			name: "path in use alive", paths: 3, pathIdx: 0, expected: 1,
+			health: map[snet.PathFingerprint]pathHealth{"a": healthAlive()},
+		},
+		{
+			name: "stale path", paths: 3, pathIdx: 0, expected: 2,
+			health: map[snet.PathFingerprint]pathHealth{"b": healthStale(), "c": healthAlive()},
+		},
+		{
+			name: "failed since alive", paths: 3, pathIdx: 0, expected: 2,
+			health: map[snet.PathFingerprint]pathHealth{"b": healthRecovered(), "c": healthAlive()},
+		},
+		{
+			name: "skip backing off", paths: 4, pathIdx: 0, expected: 3,
+			health: map[snet.PathFingerprint]pathHealth{"b": healthFailed(), "c": healthFailed()},
+		},
+		{
+			name: "retry recovered", paths: 3, pathIdx: 0, expected: 1,
+			health: map[snet.PathFingerprint]pathHealth{"b": healthRecovered()},
+		},
+		{
+			name: "all backing off", paths: 3, pathIdx: 1, expected: 2,
+			health: map[snet.PathFingerprint]pathHealth{"a": healthFailed(), "c": healthFailed()},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m := newTestPathMgr(test.paths, test.pathIdx, test.health)
+			if idx := m.failoverPathIdx(); idx != test.expected {
+				t.Errorf("expected = %d, actual = %d", test.expected, idx)
+			}
+		})
+	}
+}
+
+func TestPathBackoff(t *testing.T) {
+	m := newTestPathMgr(1, 0, nil)
+	path := m.currPath.Fingerprint()
+	backoffs := []time.Duration{1 * time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second,
+		16 * time.Second, 32 * time.Second, time.Minute, time.Minute}
+	for i, expected := range backoffs {
+		before := time.Now()
+		m.markFailed(path)
+		health := m.pathHealth(m.currPath)
+		if health.failures != i+1 {
+			t.Fatalf("failure %d: expected failures = %d, actual = %d", i, i+1, health.failures)
+		}
+		if backoff := health.retryAt.Sub(before); backoff < expected || backoff > expected+time.Second {
+			t.Errorf("failure %d: expected backoff = %s, actual = %s", i, expected, backoff)
+		}
+		// Failures while backing off are not counted
+		m.markFailed(path)
+		if failures := m.pathHealth(m.currPath).failures; failures != i+1 {
+			t.Errorf("failure %d while backing off: expected failures = %d, actual = %d", i, i+1, failures)
+		}
+		// End the backoff
+		health = m.health[path]
+		health.retryAt = time.Now()
+		m.health[path] = health
+	}
+	m.markAlive(path)
+	health := m.pathHealth(m.currPath)
+	if health.failures != 0 || health.backingOff() || !health.aliveWithin(time.Second) {
+		t.Errorf("expected path to be alive, health = %+v", health)
+	}
+	m.markFailed(path)
+	if backoff := time.Until(m.pathHealth(m.currPath).retryAt); backoff > minPathBackoff {
+		t.Errorf("expected backoff to restart after an echo, backoff = %s", backoff)
+	}
+}
+
+func TestFailback(t *testing.T) {
+	alive := func(since time.Duration) pathHealth {
+		return pathHealth{lastAlive: time.Now(), aliveSince: time.Now().Add(-since)}
+	}
+	tests := []struct {
+		name    string
+		pathIdx int
+		health  map[snet.PathFingerprint]pathHealth
+		// sinceMigration is the time since the path in use was migrated to
+		sinceMigration time.Duration
+		// hidden is set if a hidden path is in use, refreshed if the path in use was replaced by a refresh
+		hidden, refreshed bool
+		expected          int
+	}{
+		{
+			name: "best ranked path in use", pathIdx: 0, sinceMigration: time.Hour, expected: 0,
+			health: map[snet.PathFingerprint]pathHealth{"a": alive(time.Hour), "b": alive(time.Hour)},
+		},
+		{
+			name: "fail back", pathIdx: 2, sinceMigration: time.Hour, expected: 0,
+			health: map[snet.PathFingerprint]pathHealth{"a": alive(time.Hour), "b": alive(time.Hour)},
+		},
+		{
+			name: "fail back from refreshed path", pathIdx: 2, sinceMigration: time.Hour, refreshed: true, expected: 0,
+			health: map[snet.PathFingerprint]pathHealth{"a": alive(time.Hour)},
+		},
+		{
+			name: "fail back to second best", pathIdx: 2, sinceMigration: time.Hour, expected: 1,
+			health: map[snet.PathFingerprint]pathHealth{"a": alive(time.Second), "b": alive(time.Hour)},
+		},
+		{
+			name: "better paths alive shortly", pathIdx: 2, sinceMigration: time.Hour, expected: 2,
+			health: map[snet.PathFingerprint]pathHealth{"a": alive(time.Second), "b": alive(10 * time.Second)},
+		},
+		{
+			name: "better paths stale", pathIdx: 2, sinceMigration: time.Hour, expected: 2,
+			health: map[snet.PathFingerprint]pathHealth{"a": healthStale(), "b": healthRecovered()},
+		},
+		{
+			name: "worse path alive", pathIdx: 1, sinceMigration: time.Hour, expected: 1,
+			health: map[snet.PathFingerprint]pathHealth{"c": alive(time.Hour)},
+		},
+		{
+			name: "path in use recently", pathIdx: 2, sinceMigration: 10 * time.Second, expected: 2,
+			health: map[snet.PathFingerprint]pathHealth{"a": alive(time.Hour)},
+		},
+		{
+			name: "hidden path in use", pathIdx: 2, sinceMigration: time.Hour, hidden: true, expected: 2,
+			health: map[snet.PathFingerprint]pathHealth{"a": alive(time.Hour)},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m := newTestPathMgr(3, test.pathIdx, test.health)
+			if test.hidden {
+				m.currPath = &testPath{name: "hidden"}
+			} else if test.refreshed {
+				m.currPath = m.currPath.Copy()
+			}
+			currPath := m.currPath
+			m.lastMigration = time.Now().Add(-test.sinceMigration)
+			err := m.failback(m.getConf())
+			if m.pathIdx != test.expected {
+				t.Fatalf("expected = %d, actual = %d", test.expected, m.pathIdx)
+			}
+			if test.expected == test.pathIdx {
+				if err != nil {
+					t.Errorf("unexpected error: %s", err)
+				}
+				if m.currPath != currPath {
+					t.Errorf("expected path in use to be kept, actual = %s", m.currPath.Fingerprint())
+				}
+				return
+			}
+			// Egress connections are set up over the new path, which fails without network
+			if err != testDialError {
+				t.Errorf("expected error = %v, actual = %v", testDialError, err)
+			}
+			if m.currPath != m.paths[test.expected] {
+				t.Errorf("expected path in use = %s, actual = %s", m.paths[test.expected].Fingerprint(),
+					m.currPath.Fingerprint())
+			}
+			if time.Since(m.lastMigration) > time.Second {
+				t.Errorf("expected migration time to be updated, actual = %s", m.lastMigration)
+			}
+			if m.isMigrating != 0 {
+				t.Errorf("expected migration to be over")
+			}
+		})
+	}
+}
+
+func TestUpdateMetrics(t *testing.T) {
+	const ms = time.Millisecond
+	type sample struct {
+		rtt  time.Duration
+		lost bool
+	}
+	tests := []struct {
+		name     string
+		samples  []sample
+		expected PathMetrics
+	}{
+		{name: "first echo", samples: []sample{{rtt: 100 * ms}}, expected: PathMetrics{RTT: 100 * ms, Jitter: 50 * ms}},
+		{
+			name:     "smoothed",
+			samples:  []sample{{rtt: 100 * ms}, {rtt: 200 * ms}},
+			expected: PathMetrics{RTT: 112500 * time.Microsecond, Jitter: 62500 * time.Microsecond},
+		},
+		{name: "lost", samples: []sample{{lost: true}}, expected: PathMetrics{Loss: 0.1}},
+		{
+			name:     "lost then echoed",
+			samples:  []sample{{lost: true}, {lost: true}, {rtt: 100 * ms}},
+			expected: PathMetrics{RTT: 100 * ms, Jitter: 50 * ms, Loss: 0.171},
+		},
+		{
+			name:     "loss keeps the RTT",
+			samples:  []sample{{rtt: 100 * ms}, {lost: true}},
+			expected: PathMetrics{RTT: 100 * ms, Jitter: 50 * ms, Loss: 0.1},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m := newTestPathMgr(1, 0, nil)
+			path := m.currPath
+			for _, s := range test.samples {
+				m.updateMetrics(path.Fingerprint(), s.rtt, s.lost)
+			}
+			actual := m.pathMetrics(path)
+			if actual.RTT != test.expected.RTT || actual.Jitter != test.expected.Jitter ||
+				math.Abs(actual.Loss-test.expected.Loss) > 1e-9 {
+				t.Errorf("expected = %+v, actual = %+v", test.expected, actual)
+			}
+		})
+	}
+}
+
+func TestHandleKeepAliveEcho(t *testing.T) {
+	m := newTestPathMgr(2, 0, nil)
+	echo := func(probe *keepAliveMsg) *keepAliveMsg {
+		return &keepAliveMsg{Seq: probe.Seq, Timestamp: probe.Timestamp, Echo: true, Backup: probe.Backup}
+	}
+
+	probe := m.newProbe(m.paths[1], true)
+	forged := echo(probe)
+	forged.Timestamp--
+	m.handleKeepAliveEcho(forged)
+	if metrics := m.pathMetrics(m.paths[1]); metrics != (PathMetrics{}) {
+		t.Errorf("forged echo accounted: %+v", metrics)
+	}
+	m.handleKeepAliveEcho(echo(probe))
+	metrics := m.pathMetrics(m.paths[1])
+	if metrics.RTT <= 0 || metrics.RTT > time.Second {
+		t.Errorf("unexpected RTT: %s", metrics.RTT)
+	}
+	if !m.pathHealth(m.paths[1]).aliveWithin(time.Second) {
+		t.Error("echoed path not alive")
+	}
+	m.handleKeepAliveEcho(echo(probe))
+	if actual := m.pathMetrics(m.paths[1]); actual != metrics {
+		t.Errorf("duplicate echo accounted: %+v", actual)
+	}
+	if metrics := m.pathMetrics(m.paths[0]); metrics != (PathMetrics{}) {
+		t.Errorf("echo accounted to another path: %+v", metrics)
+	}
+}
+
+func TestEchoWriter(t *testing.T) {
+	hop := func(ia string, id common.IFIDType) snet.PathInterface { return testIface{ia: mustIA(t, ia), id: id} }
+	direct := &testPath{name: "a", raw: spath.New(common.RawBytes{1}),
+		ifaces: []snet.PathInterface{hop("1-ff00:0:1", 1), hop("1-ff00:0:2", 1)}}
+	transit := &testPath{name: "b", raw: spath.New(common.RawBytes{2}),
+		ifaces: []snet.PathInterface{hop("1-ff00:0:1", 2), hop("1-ff00:0:3", 1), hop("1-ff00:0:3", 2),
+			hop("1-ff00:0:2", 2)}}
+	noTransit, err := newPathPolicy(pathPolicyConf{ACL: []string{"- 1-ff00:0:3", "+"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		policy *pathPolicy
+		raw    common.RawBytes
+		// reversed tells whether the echo goes over the reverse of the probed path
+		reversed bool
+	}{
+		{name: "no policy", raw: common.RawBytes{2}, reversed: true},
+		{name: "no policy, unknown path", raw: common.RawBytes{3}, reversed: true},
+		{name: "compliant path", policy: noTransit, raw: common.RawBytes{1}, reversed: true},
+		{name: "path not compliant", policy: noTransit, raw: common.RawBytes{2}},
+		{name: "unknown path", policy: noTransit, raw: common.RawBytes{3}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m := newTestPathMgr(1, 0, nil)
+			// The probed path is reversed by the remote, and known even if not compliant (e.g., probed before a reload)
+			m.paths, m.currPath = []snet.Path{direct, transit}, direct
+			pathing := *m.getConf()
+			pathing.policy = test.policy
+			m.setConf(&pathing)
+			egress, ingress := &eConn{}, &eConn{}
+			m.peer.egressCtrlEConn, m.peer.ingressCtrlConn = egress, ingress
+			raddr := &snet.UDPAddr{IA: mustIA(t, "1-ff00:0:2"), Path: spath.New(test.raw),
+				Host: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 2), Port: 40000}}
+
+			w := m.echoWriter(raddr)
+			if !test.reversed {
+				if w != egress {
+					t.Errorf("expected echo over the path in use, actual = %#v", w)
+				}
+				return
+			}
+			to, ok := w.(eConnTo)
+			if !ok || to.eConn != ingress {
+				t.Fatalf("expected echo over the probed path, actual = %#v", w)
+			}
+			if !bytes.Equal(to.raddr.(*snet.UDPAddr).Path.Raw, test.raw) {
+				t.Errorf("expected path = %v, actual = %v", test.raw, to.raddr.(*snet.UDPAddr).Path.Raw)
+			}
+		})
+	}
+	m := newTestPathMgr(1, 0, nil)
+	m.peer.egressCtrlEConn, m.peer.ingressCtrlConn = &eConn{}, &eConn{}
+	if w := m.echoWriter(nil); w != m.peer.egressCtrlEConn {
+		t.Errorf("expected echo over the path in use without the address of the probe, actual = %#v", w)
+	}
+}
+
+func TestExpireProbes(t *testing.T) {
+	type event int
+	const (
+		lost event = iota
+		echoed
+	)
+	tests := []struct {
+		name string
+		// path is the index of the probed path, path 0 is in use
+		path     int
+		events   []event
+		failed   bool
+		expected int
+	}{
+		{name: "single loss", path: 1, events: []event{lost}, expected: 1},
+		{name: "consecutive losses", path: 1, events: []event{lost, lost, lost}, failed: true},
+		{name: "losses interrupted by an echo", path: 1, events: []event{lost, lost, echoed, lost, lost}, expected: 2},
+		{name: "path in use", path: 0, events: []event{lost, lost, lost, lost}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m := newTestPathMgr(2, 0, nil)
+			path := m.paths[test.path]
+			for _, e := range test.events {
+				probe := m.newProbe(path, test.path != 0)
+				if e == echoed {
+					m.handleKeepAliveEcho(&keepAliveMsg{Seq: probe.Seq, Timestamp: probe.Timestamp, Echo: true})
+					continue
+				}
+				m.probes[probe.Seq%probeWindow].sentAt = time.Now().Add(-time.Second)
+				m.expireProbes(testPathingConf.KeepAliveTimeout)
+			}
+			health := m.pathHealth(path)
+			if failed := health.failures > 0; failed != test.failed {
+				t.Errorf("expected failed = %t, actual = %t", test.failed, failed)
+			}
+			if health.losses != test.expected {
+				t.Errorf("expected = %d consecutive losses, actual = %d", test.expected, health.losses)
+			}
+			if m.pathMetrics(path).Loss == 0 {
+				t.Error("losses not accounted in the metrics")
+			}
+		})
+	}
+}
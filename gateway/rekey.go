@@ -0,0 +1,223 @@
+/*
+Copyright (c) 2020, ETH and Andrea Tulimiero
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package gateway
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/scionproto/scion/go/lib/log"
+	"time"
+)
+
+const (
+	defaultRekeyInterval = 1 * time.Hour
+	defaultRekeyBytes    = 1 << 36
+	defaultRekeyOverlap  = 5 * time.Second
+)
+
+var (
+	defaultRekeyConf = rekeyConf{
+		Interval: defaultRekeyInterval,
+		Bytes:    defaultRekeyBytes,
+		Overlap:  defaultRekeyOverlap,
+	}
+)
+
+type rekeyConf struct {
+	// Interval is the maximum lifetime of a key epoch (0 disables time based rekeying)
+	Interval time.Duration `yaml:"interval"`
+	// Bytes is the maximum number of bytes sent with a key epoch (0 disables volume based rekeying)
+	Bytes uint64 `yaml:"bytes"`
+	// Overlap is the time during which the previous key epoch is still accepted after a switch
+	Overlap time.Duration `yaml:"overlap"`
+}
+
+// pendingRekey keeps track of a rekey initiated locally and not yet answered by the remote
+type pendingRekey struct {
+	epoch   uint8
+	priKey  []byte
+	pubKey  []byte
+	retries int
+}
+
+// rekeyer renews the session key when it gets too old or too used, and retransmits unanswered rekey requests.
+// A rekey is an X25519 exchange over the ctrl channel (hence authenticated by the current session key):
+// the responder starts accepting the new key epoch right away, the initiator switches to it upon the response,
+// and the responder switches as soon as it receives the first packet under the new key epoch.
+func (k *keyMgr) rekeyer(stop <-chan struct{}) {
+	t := time.NewTicker(rekeyRetryInterval)
+	for {
+		select {
+		case <-stop:
+			t.Stop()
+			return
+		case <-t.C:
+			k.expireNextSession()
+			if k.retryPendingRekey() {
+				continue
+			}
+			interval, session := k.peer.gateway.conf.Rekey.Interval, k.sendSession()
+			if interval > 0 && session != nil && time.Since(session.createdAt) > interval {
+				k.startRekey()
+			}
+		case <-k.rekeyTrigger:
+			k.startRekey()
+		}
+	}
+}
+
+// startRekey initiates a new key epoch, unless a rekey is already in progress
+func (k *keyMgr) startRekey() {
+	k.rekeyMutex.Lock()
+	defer k.rekeyMutex.Unlock()
+	k.sessionsMutex.RLock()
+	if k.currSession == nil {
+		// Keys were wiped
+		k.sessionsMutex.RUnlock()
+		return
+	}
+	inProgress := k.pendingRekey != nil || k.nextSession != nil
+	epoch := k.currSession.epoch + 1
+	k.sessionsMutex.RUnlock()
+	if inProgress {
+		return
+	}
+	priKey, pubKey, err := newX25519KeyPair()
+	if err != nil {
+		log.Error("Error computing rekey key pair", "err", err)
+		return
+	}
+	log.Debug("Initiating rekey", "remote", k.peer.remote.Address.IA, "epoch", epoch)
+	k.pendingRekey = &pendingRekey{epoch: epoch, priKey: priKey, pubKey: pubKey}
+	k.lastRekeyResponse = nil
+	k.lastRekeyRequest = &rekeyRequestMsg{Epoch: epoch, PubKey: pubKey}
+	if err := k.peer.WriteMsg(k.lastRekeyRequest); err != nil {
+		log.Debug("Error sending rekey request, will retry", "err", err)
+	}
+}
+
+// retryPendingRekey retransmits the pending rekey request, if any, and returns whether there was one
+func (k *keyMgr) retryPendingRekey() bool {
+	k.rekeyMutex.Lock()
+	defer k.rekeyMutex.Unlock()
+	if k.pendingRekey == nil {
+		return false
+	}
+	if k.pendingRekey.retries >= rekeyMaxRetries {
+		log.Error("Rekey timed out", "remote", k.peer.remote.Address.IA, "epoch", k.pendingRekey.epoch)
+		k.pendingRekey = nil
+		return true
+	}
+	k.pendingRekey.retries++
+	if err := k.peer.WriteMsg(k.lastRekeyRequest); err != nil {
+		log.Debug("Error resending rekey request", "err", err)
+	}
+	return true
+}
+
+// expireNextSession drops the next session key if the remote did not start using it in time,
+// e.g., because the rekey response got lost and the remote gave up on the rekey
+func (k *keyMgr) expireNextSession() {
+	k.rekeyMutex.Lock()
+	defer k.rekeyMutex.Unlock()
+	k.sessionsMutex.Lock()
+	defer k.sessionsMutex.Unlock()
+	if k.nextSession == nil || time.Now().Before(k.nextSessionExpiry) {
+		return
+	}
+	log.Debug("Dropping unused key epoch", "remote", k.peer.remote.Address.IA, "epoch", k.nextSession.epoch)
+	k.nextSession = nil
+	// Answering a late retransmission of the request would make the remote switch to the dropped key epoch
+	k.lastRekeyResponse = nil
+}
+
+// handleRekeyRequest answers a rekey request from the remote and starts accepting the new key epoch
+func (k *keyMgr) handleRekeyRequest(reqMsg *rekeyRequestMsg) error {
+	k.rekeyMutex.Lock()
+	defer k.rekeyMutex.Unlock()
+	if res := k.lastRekeyResponse; res != nil && res.Epoch == reqMsg.Epoch &&
+		bytes.Equal(k.lastRekeyRequest.PubKey, reqMsg.PubKey) {
+		// Our response got lost
+		return k.peer.WriteMsg(res)
+	}
+	curr := k.sendSession()
+	if curr == nil {
+		return cryptoHandshakeError
+	}
+	if reqMsg.Epoch != curr.epoch+1 {
+		return fmt.Errorf("unexpected rekey epoch: expected = %d, received = %d", curr.epoch+1, reqMsg.Epoch)
+	}
+	if k.pendingRekey != nil && k.pendingRekey.epoch == reqMsg.Epoch {
+		// Both ends initiated a rekey at the same time, the request of the low side wins
+		if k.lowSide {
+			log.Debug("Ignoring concurrent rekey request", "remote", k.peer.remote.Address.IA)
+			return nil
+		}
+		log.Debug("Yielding to concurrent rekey request", "remote", k.peer.remote.Address.IA)
+		k.pendingRekey = nil
+	}
+
+	priKey, pubKey, err := newX25519KeyPair()
+	if err != nil {
+		return err
+	}
+	sharedSecret, err := computeSharedSecret(priKey, reqMsg.PubKey)
+	if err != nil {
+		return err
+	}
+	transcript := rekeyTranscript(curr.transcript, reqMsg.Epoch, reqMsg.PubKey, pubKey)
+	session, err := newSessionKey(reqMsg.Epoch, k.suite, sharedSecret, transcript, k.lowSide)
+	if err != nil {
+		return err
+	}
+	k.sessionsMutex.Lock()
+	k.nextSession, k.nextSessionExpiry = session, time.Now().Add(nextSessionTimeout)
+	k.sessionsMutex.Unlock()
+	k.lastRekeyRequest = reqMsg
+	k.lastRekeyResponse = &rekeyResponseMsg{Epoch: reqMsg.Epoch, PubKey: pubKey}
+	return k.peer.WriteMsg(k.lastRekeyResponse)
+}
+
+// handleRekeyResponse completes a rekey initiated locally and switches to the new key epoch
+func (k *keyMgr) handleRekeyResponse(resMsg *rekeyResponseMsg) error {
+	k.rekeyMutex.Lock()
+	defer k.rekeyMutex.Unlock()
+	pending := k.pendingRekey
+	if pending == nil || pending.epoch != resMsg.Epoch {
+		log.Debug("Ignoring unexpected rekey response", "epoch", resMsg.Epoch)
+		return nil
+	}
+	sharedSecret, err := computeSharedSecret(pending.priKey, resMsg.PubKey)
+	if err != nil {
+		return err
+	}
+	transcript := rekeyTranscript(k.sendSession().transcript, resMsg.Epoch, pending.pubKey, resMsg.PubKey)
+	session, err := newSessionKey(resMsg.Epoch, k.suite, sharedSecret, transcript, k.lowSide)
+	if err != nil {
+		return err
+	}
+	k.pendingRekey = nil
+	k.lastRekeyResponse = nil
+	k.installSession(session)
+	return nil
+}
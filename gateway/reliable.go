@@ -0,0 +1,230 @@
+/*
+Copyright (c) 2020, ETH and Andrea Tulimiero
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package gateway
+
+import (
+	"context"
+	"errors"
+	"github.com/scionproto/scion/go/lib/log"
+	"sort"
+	"sync"
+	"time"
+)
+
+var reliableDeliveryError = errors.New("message not acknowledged by the remote")
+
+// reliableMsg carries a Message that is retransmitted until acknowledged and delivered in order.
+// Base is the lowest sequence number the sender still tries to deliver,
+// messages below it were either acknowledged or abandoned and must not be waited for.
+type reliableMsg struct {
+	Seq  uint64
+	Base uint64
+	Msg  Message
+}
+
+func (m *reliableMsg) encode(e *MsgEncoder) error {
+	frame, err := encodeMsg(m.Msg)
+	if err != nil {
+		return err
+	}
+	e.PutUint64(m.Seq)
+	e.PutUint64(m.Base)
+	e.PutBytes(frame)
+	return nil
+}
+
+func (m *reliableMsg) decode(version uint8, d *MsgDecoder) error {
+	m.Seq = d.GetUint64()
+	m.Base = d.GetUint64()
+	frame := d.GetBytes()
+	if d.Err() != nil {
+		return d.Err()
+	}
+	var err error
+	m.Msg, err = decodeFrame(frame)
+	return err
+}
+
+// ackMsg acknowledges all the reliableMsgs up to Seq
+type ackMsg struct {
+	Seq uint64
+}
+
+func (m *ackMsg) encode(e *MsgEncoder) error {
+	e.PutUint64(m.Seq)
+	return nil
+}
+
+func (m *ackMsg) decode(version uint8, d *MsgDecoder) error {
+	m.Seq = d.GetUint64()
+	return d.Err()
+}
+
+// reliableSender keeps track of the reliableMsgs waiting for an acknowledgement
+type reliableSender struct {
+	mutex   sync.Mutex
+	nextSeq uint64
+	pending map[uint64]chan struct{}
+}
+
+func newReliableSender() *reliableSender {
+	return &reliableSender{nextSeq: 1, pending: make(map[uint64]chan struct{})}
+}
+
+// add assigns the next sequence number to a message and returns the channel closed upon its acknowledgement
+func (s *reliableSender) add() (uint64, chan struct{}) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	seq := s.nextSeq
+	s.nextSeq++
+	acked := make(chan struct{})
+	s.pending[seq] = acked
+	return seq, acked
+}
+
+func (s *reliableSender) remove(seq uint64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.pending, seq)
+}
+
+// base returns the lowest sequence number still waiting for an acknowledgement
+func (s *reliableSender) base() uint64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	base := s.nextSeq
+	for seq := range s.pending {
+		if seq < base {
+			base = seq
+		}
+	}
+	return base
+}
+
+func (s *reliableSender) handleAck(ack *ackMsg) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for seq, acked := range s.pending {
+		if seq <= ack.Seq {
+			close(acked)
+			delete(s.pending, seq)
+		}
+	}
+}
+
+// reliableReceiver reorders the reliableMsgs of the remote
+type reliableReceiver struct {
+	mutex    sync.Mutex
+	expected uint64
+	buffered map[uint64]Message
+}
+
+func newReliableReceiver() *reliableReceiver {
+	return &reliableReceiver{expected: 1, buffered: make(map[uint64]Message)}
+}
+
+// reset drops the buffered messages and waits again for the first sequence number
+func (r *reliableReceiver) reset() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.expected = 1
+	r.buffered = make(map[uint64]Message)
+}
+
+// receive returns the messages that can be delivered in order after relMsg,
+// and the sequence number up to which all messages were received
+func (r *reliableReceiver) receive(relMsg *reliableMsg) ([]Message, uint64) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	var delivered []Message
+	if relMsg.Seq >= r.expected && relMsg.Seq-r.expected < reliableReorderLimit {
+		r.buffered[relMsg.Seq] = relMsg.Msg
+	}
+	if relMsg.Base > r.expected {
+		// The sender gave up on the missing messages, deliver what was received before Base
+		var seqs []uint64
+		for seq := range r.buffered {
+			if seq < relMsg.Base {
+				seqs = append(seqs, seq)
+			}
+		}
+		sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+		for _, seq := range seqs {
+			delivered = append(delivered, r.buffered[seq])
+			delete(r.buffered, seq)
+		}
+		r.expected = relMsg.Base
+	}
+	for {
+		msg, ok := r.buffered[r.expected]
+		if !ok {
+			break
+		}
+		delivered = append(delivered, msg)
+		delete(r.buffered, r.expected)
+		r.expected++
+	}
+	return delivered, r.expected - 1
+}
+
+// WriteMsgReliable sends a message over the ctrl channel and waits until the remote acknowledges it.
+// The message is retransmitted with exponential backoff, and delivered to the remote in order with the
+// other reliable messages. It fails with reliableDeliveryError once retransmissions are exhausted.
+func (peer *peer) WriteMsgReliable(ctx context.Context, msg Message) error {
+	seq, acked := peer.reliableSender.add()
+	defer peer.reliableSender.remove(seq)
+	interval := reliableRetransmitInterval
+	for retries := 0; retries <= reliableMaxRetries; retries++ {
+		relMsg := &reliableMsg{Seq: seq, Base: peer.reliableSender.base(), Msg: msg}
+		if err := peer.WriteMsg(relMsg); err != nil {
+			// The ctrl channel may be temporarily unusable (e.g., while migrating), retry later
+			log.Debug("Error sending reliable message", "seq", seq, "err", err)
+		}
+		t := time.NewTimer(interval)
+		select {
+		case <-acked:
+			t.Stop()
+			return nil
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		case <-t.C:
+		}
+		interval *= 2
+		if interval > reliableMaxRetransmitInterval {
+			interval = reliableMaxRetransmitInterval
+		}
+	}
+	return reliableDeliveryError
+}
+
+// handleReliableMsg acknowledges a reliableMsg and dispatches the messages that can be delivered in order
+func (peer *peer) handleReliableMsg(relMsg *reliableMsg) {
+	delivered, ack := peer.reliableReceiver.receive(relMsg)
+	if err := peer.WriteMsg(&ackMsg{Seq: ack}); err != nil {
+		log.Debug("Error sending ack", "seq", ack, "err", err)
+	}
+	for _, msg := range delivered {
+		peer.handleCtrlMsg(msg)
+	}
+}
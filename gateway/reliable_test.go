@@ -0,0 +1,117 @@
+/*
+Copyright (c) 2020, ETH and Andrea Tulimiero
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package gateway
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestReliableReceiverReceive(t *testing.T) {
+	type step struct {
+		seq, base uint64
+		// delivered are the sequence numbers of the messages delivered after receiving seq
+		delivered []uint64
+		ack       uint64
+	}
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{
+			name: "in order",
+			steps: []step{
+				{seq: 1, base: 1, delivered: []uint64{1}, ack: 1},
+				{seq: 2, base: 1, delivered: []uint64{2}, ack: 2},
+			},
+		},
+		{
+			name: "duplicates",
+			steps: []step{
+				{seq: 1, base: 1, delivered: []uint64{1}, ack: 1},
+				{seq: 1, base: 1, ack: 1},
+				{seq: 3, base: 2, ack: 1},
+				{seq: 3, base: 2, ack: 1},
+				{seq: 2, base: 2, delivered: []uint64{2, 3}, ack: 3},
+				{seq: 2, base: 2, ack: 3},
+			},
+		},
+		{
+			name: "reordering",
+			steps: []step{
+				{seq: 3, base: 1, ack: 0},
+				{seq: 2, base: 1, ack: 0},
+				{seq: 1, base: 1, delivered: []uint64{1, 2, 3}, ack: 3},
+				{seq: 5, base: 4, ack: 3},
+				{seq: 4, base: 4, delivered: []uint64{4, 5}, ack: 5},
+			},
+		},
+		{
+			name: "abandoned messages",
+			steps: []step{
+				{seq: 2, base: 1, ack: 0},
+				{seq: 4, base: 1, ack: 0},
+				// The sender gave up on 1 and 3
+				{seq: 5, base: 5, delivered: []uint64{2, 4, 5}, ack: 5},
+				{seq: 3, base: 5, ack: 5},
+			},
+		},
+		{
+			name: "beyond reorder limit",
+			steps: []step{
+				{seq: 1 + reliableReorderLimit, base: 1, ack: 0},
+				{seq: reliableReorderLimit, base: 1, ack: 0},
+				{seq: 1, base: 2, delivered: []uint64{1}, ack: 1},
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := newReliableReceiver()
+			for i, step := range test.steps {
+				delivered, ack := r.receive(&reliableMsg{Seq: step.seq, Base: step.base, Msg: &ackMsg{Seq: step.seq}})
+				var seqs []uint64
+				for _, msg := range delivered {
+					seqs = append(seqs, msg.(*ackMsg).Seq)
+				}
+				if !reflect.DeepEqual(seqs, step.delivered) {
+					t.Errorf("step %d: delivered: expected = %v, actual = %v", i, step.delivered, seqs)
+				}
+				if ack != step.ack {
+					t.Errorf("step %d: ack: expected = %d, actual = %d", i, step.ack, ack)
+				}
+			}
+		})
+	}
+}
+
+func TestReliableReceiverReset(t *testing.T) {
+	r := newReliableReceiver()
+	r.receive(&reliableMsg{Seq: 1, Base: 1, Msg: &ackMsg{Seq: 1}})
+	r.receive(&reliableMsg{Seq: 3, Base: 1, Msg: &ackMsg{Seq: 3}})
+	r.reset()
+	delivered, ack := r.receive(&reliableMsg{Seq: 1, Base: 1, Msg: &ackMsg{Seq: 1}})
+	if len(delivered) != 1 || ack != 1 {
+		t.Errorf("expected first message of the new session, delivered = %v, ack = %d", delivered, ack)
+	}
+}
@@ -0,0 +1,146 @@
+/*
+Copyright (c) 2020, ETH and Andrea Tulimiero
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package gateway
+
+import (
+	"fmt"
+	"github.com/scionproto/scion/go/lib/log"
+	"reflect"
+)
+
+// Reload applies a new configuration to the running gateway: remotes are added, removed, or reconnected if their
+// configuration changed, and the pathing configuration is applied to the live peers.
+// adapterConfBufs maps the IDs of adapters to their new configuration, which is passed to adapters
+// implementing Reconfigurable. Changes to the other settings require a restart and are only reported.
+func (gateway *Gateway) Reload(confBuf []byte, adapterConfBufs map[AdapterID][]byte) error {
+	newConf, err := parseConf(confBuf)
+	if err != nil {
+		return err
+	}
+	gateway.reloadMutex.Lock()
+	defer gateway.reloadMutex.Unlock()
+	gateway.confMutex.Lock()
+	oldConf := gateway.conf
+	gateway.conf.Remotes, gateway.conf.Pathing = newConf.Remotes, newConf.Pathing
+	gateway.conf.PathPolicies = newConf.PathPolicies
+	gateway.confMutex.Unlock()
+	log.Info("Reloading configuration", "conf", newConf)
+	warnRestartRequired(oldConf, newConf)
+
+	var errs []error
+	oldRemotes, newRemotes := remotesByIA(oldConf.Remotes), remotesByIA(newConf.Remotes)
+	for IA, oldRemote := range oldRemotes {
+		if newRemote, ok := newRemotes[IA]; ok && sameConnection(oldRemote, newRemote) {
+			continue
+		}
+		if err := gateway.RemovePeer(oldRemote.Address.IA); err != nil {
+			log.Debug("Error removing peer", "remote", IA, "err", err)
+		}
+	}
+	gateway.applyPathingConf(newRemotes)
+	for IA, newRemote := range newRemotes {
+		if _, err := gateway.getPeer(IA); err == nil {
+			continue
+		}
+		if err := gateway.AddPeer(newRemote); err != nil {
+			log.Error("Error adding peer", "remote", IA, "err", err)
+			errs = append(errs, err)
+		}
+	}
+
+	for id, adapterConfBuf := range adapterConfBufs {
+		entry := gateway.adapterByID(id)
+		if entry == nil {
+			errs = append(errs, fmt.Errorf("unknown adapter: %d", id))
+			continue
+		}
+		if r, ok := entry.adapter.(Reconfigurable); ok {
+			if err := r.Reconfigure(adapterConfBuf); err != nil {
+				log.Error("Error reconfiguring adapter", "adapter", id, "err", err)
+				errs = append(errs, err)
+			}
+		} else {
+			log.Warn("Adapter does not support reconfiguration, restart to apply its configuration", "adapter", id)
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("configuration partially applied: %v", errs)
+	}
+	return nil
+}
+
+// applyPathingConf replaces the pathing configuration of all peers, remotes holds the overrides of configured peers
+func (gateway *Gateway) applyPathingConf(remotes map[string]ConnConf) {
+	gateway.peersMutex.RLock()
+	defer gateway.peersMutex.RUnlock()
+	for IA, peer := range gateway.asClientMap {
+		remote, ok := remotes[IA]
+		if !ok {
+			// Inbound peers are not configured, they get the global pathing configuration
+			remote = peer.remote
+		}
+		conf, err := gateway.pathingFor(remote)
+		if err != nil {
+			log.Error("Error applying pathing configuration", "remote", IA, "err", err)
+			continue
+		}
+		peer.pathMgr.setConf(conf)
+	}
+}
+
+// sameConnection tells whether two configurations of a remote only differ by their pathing overrides
+func sameConnection(a, b ConnConf) bool {
+	a.Pathing, b.Pathing = nil, nil
+	return reflect.DeepEqual(a, b)
+}
+
+// remotesByIA indexes the configuration of remotes by their IA
+func remotesByIA(remotes []ConnConf) map[string]ConnConf {
+	m := make(map[string]ConnConf, len(remotes))
+	for _, remote := range remotes {
+		m[remote.Address.IA.String()] = remote
+	}
+	return m
+}
+
+// warnRestartRequired reports the changes of a reloaded configuration that cannot be applied to a running gateway
+func warnRestartRequired(oldConf, newConf conf) {
+	fields := []struct {
+		name     string
+		old, new interface{}
+	}{
+		{"address", oldConf.Address, newConf.Address},
+		{"adapterConfPath", oldConf.AdapterConfPath, newConf.AdapterConfPath},
+		{"adapters", oldConf.Adapters, newConf.Adapters},
+		{"cipherSuites", oldConf.CipherSuites, newConf.CipherSuites},
+		{"rekey", oldConf.Rekey, newConf.Rekey},
+		{"ed25519KeyPath", oldConf.Ed25519KeyPath, newConf.Ed25519KeyPath},
+		{"certificate", oldConf.Certificate, newConf.Certificate},
+		{"inbound", oldConf.Inbound, newConf.Inbound},
+	}
+	for _, f := range fields {
+		if !reflect.DeepEqual(f.old, f.new) {
+			log.Warn("Ignoring configuration change, a restart is required to apply it", "field", f.name)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+/*
+Copyright (c) 2020, ETH and Andrea Tulimiero
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package gateway
+
+import (
+	"testing"
+	"time"
+)
+
+// waitReceivedAfter drains the packets received so far, then waits for a new one
+func (a *testAdapter) waitReceivedAfter(t *testing.T) []byte {
+	t.Helper()
+	for {
+		select {
+		case <-a.received:
+		default:
+			return a.waitReceived(t)
+		}
+	}
+}
+
+func TestReloadWhileTrafficFlows(t *testing.T) {
+	const addrA, addrB = "1-ff00:0:1,[127.0.0.1]:30041", "1-ff00:0:2,[127.0.0.2]:30041"
+	d, sd := newTestTestbed()
+	a, b := newTestPair(t, d, sd)
+	p, err := a.getPeer("1-ff00:0:2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop := make(chan struct{})
+	done := sendTraffic(a, stop)
+	defer func() {
+		close(stop)
+		<-done
+	}()
+	b.adapter.waitReceived(t)
+
+	// Pathing changes are applied to the live peer
+	pathing := "pathing:\n  keepAliveInterval: 20ms\n"
+	if err := a.Reload([]byte(testGatewayConf(addrA, addrB)+pathing), nil); err != nil {
+		t.Fatal(err)
+	}
+	if actual, err := a.getPeer("1-ff00:0:2"); err != nil || actual != p {
+		t.Fatal("peer replaced by a pathing change")
+	}
+	if actual := p.pathMgr.getConf().KeepAliveInterval; actual != 20*time.Millisecond {
+		t.Errorf("expected = %s, actual = %s", 20*time.Millisecond, actual)
+	}
+	b.adapter.waitReceivedAfter(t)
+
+	// Invalid configurations are not applied
+	if err := a.Reload([]byte("address: invalid"), nil); err == nil {
+		t.Error("invalid configuration reloaded")
+	}
+	if _, err := a.getPeer("1-ff00:0:2"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Removed remotes are closed
+	if err := a.Reload([]byte(testGatewayConf(addrA)), nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.getPeer("1-ff00:0:2"); err == nil {
+		t.Fatal("removed remote still has a peer")
+	}
+	if !p.closed() {
+		t.Error("peer of removed remote not closed")
+	}
+
+	// Added remotes handshake
+	if err := a.Reload([]byte(testGatewayConf(addrA, addrB)), nil); err != nil {
+		t.Fatal(err)
+	}
+	a.adapter.waitHandshake(t, b.conf.Address.IA)
+	b.adapter.waitReceivedAfter(t)
+}
+
+func TestReloadWithInboundPeer(t *testing.T) {
+	d, sd := newTestTestbed()
+	b := newTestGateway(t, d, sd, testInboundConf(1), "1-ff00:0:1")
+	a := newTestGateway(t, d, sd, testGatewayConf("1-ff00:0:1,[127.0.0.1]:30041", testInboundAddr), "1-ff00:0:2")
+	a.adapter.waitHandshake(t, b.conf.Address.IA)
+	b.adapter.waitHandshake(t, a.conf.Address.IA)
+	p, err := b.getPeer("1-ff00:0:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pathing := "pathing:\n  keepAliveInterval: 20ms\n"
+	if err := b.Reload([]byte(testInboundConf(1)+pathing), nil); err != nil {
+		t.Fatal(err)
+	}
+	if actual, err := b.getPeer("1-ff00:0:1"); err != nil || actual != p {
+		t.Fatal("inbound peer removed by the reload")
+	}
+	if actual := p.pathMgr.getConf().KeepAliveInterval; actual != 20*time.Millisecond {
+		t.Errorf("expected = %s, actual = %s", 20*time.Millisecond, actual)
+	}
+	a.ProcessEgressPkt([]byte("after reload"))
+	if actual := string(b.adapter.waitReceivedAfter(t)); actual != "after reload" {
+		t.Errorf("expected = %q, actual = %q", "after reload", actual)
+	}
+}
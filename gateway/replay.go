@@ -0,0 +1,89 @@
+/*
+Copyright (c) 2020, ETH and Andrea Tulimiero
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package gateway
+
+import (
+	"sync"
+)
+
+const (
+	// replayWindowSize is the number of packet counters tracked behind the highest one received
+	replayWindowSize = 1024
+)
+
+// replayWindow is an IPsec-style (RFC 4303) sliding window used to drop replayed packets.
+// The window must only be updated with the counters of packets that were successfully authenticated.
+type replayWindow struct {
+	mutex sync.Mutex
+	// top is the highest packet counter accepted so far
+	top    uint64
+	bitmap [replayWindowSize / 64]uint64
+}
+
+// checkAndUpdate returns whether a packet counter was not seen before and is still within the window,
+// marking it as seen if that is the case
+func (w *replayWindow) checkAndUpdate(pktCounter uint64) bool {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if pktCounter == 0 {
+		// Packet counters start from 1
+		return false
+	}
+	if pktCounter > w.top {
+		// Slide the window forward, forgetting counters that fall out of it
+		if pktCounter-w.top >= replayWindowSize {
+			w.bitmap = [replayWindowSize / 64]uint64{}
+		} else {
+			for c := w.top + 1; c < pktCounter; c++ {
+				w.clear(c)
+			}
+		}
+		w.top = pktCounter
+		w.set(pktCounter)
+		return true
+	}
+	if w.top-pktCounter >= replayWindowSize {
+		// Too old to tell whether it is a replay
+		return false
+	}
+	if w.isSet(pktCounter) {
+		return false
+	}
+	w.set(pktCounter)
+	return true
+}
+
+func (w *replayWindow) set(pktCounter uint64) {
+	idx := pktCounter % replayWindowSize
+	w.bitmap[idx/64] |= 1 << (idx % 64)
+}
+
+func (w *replayWindow) clear(pktCounter uint64) {
+	idx := pktCounter % replayWindowSize
+	w.bitmap[idx/64] &^= 1 << (idx % 64)
+}
+
+func (w *replayWindow) isSet(pktCounter uint64) bool {
+	idx := pktCounter % replayWindowSize
+	return w.bitmap[idx/64]&(1<<(idx%64)) != 0
+}
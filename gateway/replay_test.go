@@ -0,0 +1,109 @@
+/*
+Copyright (c) 2020, ETH and Andrea Tulimiero
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package gateway
+
+import (
+	"math"
+	"testing"
+)
+
+func TestReplayWindowCheckAndUpdate(t *testing.T) {
+	tests := []struct {
+		name     string
+		counters []uint64
+		// accepted tells whether each counter is accepted
+		accepted []bool
+	}{
+		{
+			name:     "zero counter",
+			counters: []uint64{0},
+			accepted: []bool{false},
+		},
+		{
+			name:     "in order",
+			counters: []uint64{1, 2, 3},
+			accepted: []bool{true, true, true},
+		},
+		{
+			name:     "duplicate",
+			counters: []uint64{1, 2, 2, 1},
+			accepted: []bool{true, true, false, false},
+		},
+		{
+			name:     "out of order within window",
+			counters: []uint64{5, 3, 4, 1, 3},
+			accepted: []bool{true, true, true, true, false},
+		},
+		{
+			name:     "oldest counter in window",
+			counters: []uint64{replayWindowSize, 1, 1},
+			accepted: []bool{true, true, false},
+		},
+		{
+			name:     "too old",
+			counters: []uint64{replayWindowSize + 1, 1},
+			accepted: []bool{true, false},
+		},
+		{
+			name:     "jump within window forgets skipped counters",
+			counters: []uint64{1, replayWindowSize + 1, 2, replayWindowSize},
+			accepted: []bool{true, true, true, true},
+		},
+		{
+			name: "jump beyond window resets it",
+			counters: []uint64{1, 2, 3*replayWindowSize + 2, 2*replayWindowSize + 3, 2*replayWindowSize + 2,
+				3*replayWindowSize + 2},
+			accepted: []bool{true, true, true, true, false, false},
+		},
+		{
+			name:     "jump of exactly the window size resets it",
+			counters: []uint64{1, 1 + replayWindowSize, 1, 2},
+			accepted: []bool{true, true, false, true},
+		},
+		{
+			name:     "newest counter out of window",
+			counters: []uint64{2 * replayWindowSize, replayWindowSize, replayWindowSize + 1},
+			accepted: []bool{true, false, true},
+		},
+		{
+			name:     "highest counter",
+			counters: []uint64{math.MaxUint64, math.MaxUint64, math.MaxUint64 - 1},
+			accepted: []bool{true, false, true},
+		},
+		{
+			name:     "counters aliasing in the bitmap",
+			counters: []uint64{7, 7 + replayWindowSize, 7},
+			accepted: []bool{true, true, false},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := &replayWindow{}
+			for i, c := range test.counters {
+				if got := w.checkAndUpdate(c); got != test.accepted[i] {
+					t.Errorf("checkAndUpdate(%d) #%d = %t, expected %t", c, i, got, test.accepted[i])
+				}
+			}
+		})
+	}
+}
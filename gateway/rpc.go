@@ -0,0 +1,239 @@
+/*
+Copyright (c) 2020, ETH and Andrea Tulimiero
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package gateway
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/scionproto/scion/go/lib/addr"
+	"github.com/scionproto/scion/go/lib/log"
+	"reflect"
+	"sync"
+)
+
+var tooManyRPCRequestsError = errors.New("too many concurrent requests")
+
+// RPCHandler answers the request of a remote gateway, the returned error is reported to the caller
+type RPCHandler func(req Message, remoteIA addr.IA) (Message, error)
+
+// RemoteError is returned by Call when the handler of the remote gateway fails
+type RemoteError struct {
+	Reason string
+}
+
+func (e *RemoteError) Error() string {
+	return fmt.Sprintf("remote error: %s", e.Reason)
+}
+
+// rpcRequestMsg carries a request to be answered by the RPCHandler registered for the type of Msg
+type rpcRequestMsg struct {
+	ID  uint64
+	Msg Message
+}
+
+func (m *rpcRequestMsg) encode(e *MsgEncoder) error {
+	frame, err := encodeMsg(m.Msg)
+	if err != nil {
+		return err
+	}
+	e.PutUint64(m.ID)
+	e.PutBytes(frame)
+	return nil
+}
+
+func (m *rpcRequestMsg) decode(version uint8, d *MsgDecoder) error {
+	m.ID = d.GetUint64()
+	frame := d.GetBytes()
+	if d.Err() != nil {
+		return d.Err()
+	}
+	var err error
+	m.Msg, err = decodeFrame(frame)
+	return err
+}
+
+// rpcResponseMsg carries either the response or the error of the request with the same ID
+type rpcResponseMsg struct {
+	ID    uint64
+	Error string
+	Msg   Message
+}
+
+func (m *rpcResponseMsg) encode(e *MsgEncoder) error {
+	var frame []byte
+	if m.Msg != nil {
+		var err error
+		frame, err = encodeMsg(m.Msg)
+		if err != nil {
+			return err
+		}
+	}
+	e.PutUint64(m.ID)
+	e.PutString(m.Error)
+	e.PutBytes(frame)
+	return nil
+}
+
+func (m *rpcResponseMsg) decode(version uint8, d *MsgDecoder) error {
+	m.ID = d.GetUint64()
+	m.Error = d.GetString()
+	frame := d.GetBytes()
+	if d.Err() != nil || len(frame) == 0 {
+		return d.Err()
+	}
+	var err error
+	m.Msg, err = decodeFrame(frame)
+	return err
+}
+
+// rpcClient keeps track of the calls waiting for a response from the remote
+type rpcClient struct {
+	mutex  sync.Mutex
+	nextID uint64
+	calls  map[uint64]chan *rpcResponseMsg
+}
+
+func newRPCClient() *rpcClient {
+	return &rpcClient{calls: make(map[uint64]chan *rpcResponseMsg)}
+}
+
+func (c *rpcClient) add() (uint64, chan *rpcResponseMsg) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.nextID++
+	res := make(chan *rpcResponseMsg, 1)
+	c.calls[c.nextID] = res
+	return c.nextID, res
+}
+
+func (c *rpcClient) remove(id uint64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	delete(c.calls, id)
+}
+
+func (c *rpcClient) handleResponse(resMsg *rpcResponseMsg) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	res, ok := c.calls[resMsg.ID]
+	if !ok {
+		log.Debug("Ignoring response of unknown call", "id", resMsg.ID)
+		return
+	}
+	delete(c.calls, resMsg.ID)
+	res <- resMsg
+}
+
+// Call sends a request to the remote gateway and waits for its response.
+// Requests are delivered reliably, and the call fails when ctx is done, or after rpcDefaultTimeout
+// if ctx has no deadline. Errors of the remote handler are returned as *RemoteError.
+func (peer *peer) Call(ctx context.Context, req Message) (Message, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, rpcDefaultTimeout)
+		defer cancel()
+	}
+	id, res := peer.rpcClient.add()
+	defer peer.rpcClient.remove(id)
+	if err := peer.WriteMsgReliable(ctx, &rpcRequestMsg{ID: id, Msg: req}); err != nil {
+		return nil, err
+	}
+	select {
+	case resMsg := <-res:
+		if resMsg.Error != "" {
+			return nil, &RemoteError{Reason: resMsg.Error}
+		}
+		return resMsg.Msg, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// dispatchRPCRequest handles a request of the remote in the background, requests exceeding
+// rpcMaxConcurrentRequests are rejected right away
+func (peer *peer) dispatchRPCRequest(reqMsg *rpcRequestMsg) {
+	select {
+	case peer.rpcSlots <- struct{}{}:
+	default:
+		log.Debug("Rejecting rpc request, too many requests", "remote", peer.remote.Address.IA, "id", reqMsg.ID)
+		// The rejection is not retransmitted, the caller times out if it is lost
+		resMsg := &rpcResponseMsg{ID: reqMsg.ID, Error: tooManyRPCRequestsError.Error()}
+		if err := peer.WriteMsg(resMsg); err != nil {
+			log.Debug("Error sending rpc rejection", "id", reqMsg.ID, "err", err)
+		}
+		return
+	}
+	go func() {
+		defer func() { <-peer.rpcSlots }()
+		peer.handleRPCRequest(reqMsg)
+	}()
+}
+
+// handleRPCRequest answers a request of the remote with the RPCHandler registered for its type and adapter
+func (peer *peer) handleRPCRequest(reqMsg *rpcRequestMsg) {
+	resMsg := &rpcResponseMsg{ID: reqMsg.ID}
+	id, req := DefaultAdapterID, reqMsg.Msg
+	if scoped, ok := req.(*adapterMsg); ok {
+		id, req = scoped.ID, scoped.Msg
+	}
+	handler, ok := peer.gateway.getRPCHandler(id, req)
+	if !ok {
+		resMsg.Error = fmt.Sprintf("no handler for %T of adapter %d", req, id)
+	} else if res, err := handler(req, peer.remote.Address.IA); err != nil {
+		resMsg.Error = err.Error()
+	} else {
+		resMsg.Msg = res
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), rpcDefaultTimeout)
+	defer cancel()
+	if err := peer.WriteMsgReliable(ctx, resMsg); err != nil {
+		log.Error("Error sending rpc response", "id", reqMsg.ID, "err", err)
+	}
+}
+
+// rpcHandlerKey identifies the handler of the requests of a type sent to an adapter
+type rpcHandlerKey struct {
+	id      AdapterID
+	reqType reflect.Type
+}
+
+// HandleRPC registers the handler of the requests of the same type as req sent to the default adapter,
+// replacing any previous one
+func (gateway *Gateway) HandleRPC(req Message, handler RPCHandler) {
+	gateway.HandleAdapterRPC(DefaultAdapterID, req, handler)
+}
+
+// HandleAdapterRPC is like HandleRPC, for the requests sent to the adapter with the given ID
+func (gateway *Gateway) HandleAdapterRPC(id AdapterID, req Message, handler RPCHandler) {
+	gateway.rpcHandlersMutex.Lock()
+	defer gateway.rpcHandlersMutex.Unlock()
+	gateway.rpcHandlers[rpcHandlerKey{id: id, reqType: baseType(req)}] = handler
+}
+
+func (gateway *Gateway) getRPCHandler(id AdapterID, req Message) (RPCHandler, bool) {
+	gateway.rpcHandlersMutex.RLock()
+	defer gateway.rpcHandlersMutex.RUnlock()
+	handler, ok := gateway.rpcHandlers[rpcHandlerKey{id: id, reqType: baseType(req)}]
+	return handler, ok
+}
@@ -0,0 +1,180 @@
+/*
+Copyright (c) 2020, ETH and Andrea Tulimiero
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package gateway
+
+import (
+	"fmt"
+	"github.com/scionproto/scion/go/lib/snet"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	leastHopsSorterName      = "leastHops"
+	lowestRTTSorterName      = "lowestRTT"
+	highestMTUSorterName     = "highestMTU"
+	earliestExpirySorterName = "earliestExpiry"
+	latestExpirySorterName   = "latestExpiry"
+	randomSorterName         = "random"
+)
+
+var (
+	pathSortersMutex sync.RWMutex
+	// pathSorters maps the names of the sorters that can be selected in the pathing configuration
+	pathSorters = map[string]PathSorter{
+		leastHopsSorterName:      leastHopsPathSorter{},
+		lowestRTTSorterName:      lowestRTTPathSorter{},
+		highestMTUSorterName:     highestMTUPathSorter{},
+		earliestExpirySorterName: expiryPathSorter{},
+		latestExpirySorterName:   expiryPathSorter{latestFirst: true},
+		randomSorterName:         randomPathSorter{},
+	}
+)
+
+// PathSorter ranks the paths toward a remote, the first path being the preferred one
+type PathSorter interface {
+	SortPaths([]snet.Path) []snet.Path
+}
+
+// PathMetrics are the metrics measured on a path by keepalive probes, zero values are unknown
+type PathMetrics struct {
+	// RTT is the smoothed round trip time of the path
+	RTT time.Duration
+	// Jitter is the smoothed deviation of the round trip time of the path
+	Jitter time.Duration
+	// Loss is the smoothed fraction of probes lost on the path
+	Loss float64
+}
+
+// MetricsPathSorter is implemented by sorters ranking paths by their measured metrics,
+// the pathMgr calls SortPathsByMetrics in place of SortPaths
+type MetricsPathSorter interface {
+	PathSorter
+	SortPathsByMetrics([]snet.Path, func(snet.Path) PathMetrics) []snet.Path
+}
+
+// RegisterPathSorter makes a sorter selectable by name in the pathing configuration.
+// Like RegisterMsgCodec, it panics if the name is registered twice and is meant to be called from init functions.
+func RegisterPathSorter(name string, sorter PathSorter) {
+	pathSortersMutex.Lock()
+	defer pathSortersMutex.Unlock()
+	if _, ok := pathSorters[name]; ok {
+		panic(fmt.Sprintf("path sorter %s registered twice", name))
+	}
+	pathSorters[name] = sorter
+}
+
+func lookupPathSorter(name string) (PathSorter, error) {
+	pathSortersMutex.RLock()
+	defer pathSortersMutex.RUnlock()
+	s, ok := pathSorters[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown path sorter: %s", name)
+	}
+	return s, nil
+}
+
+// SetPathSorter overrides the sorter selected in the configuration of a remote gateway identified by IA,
+// it can be called while the gateway is running
+func (gateway *Gateway) SetPathSorter(IA string, sorter PathSorter) {
+	gateway.confMutex.Lock()
+	gateway.pathSorters[IA] = sorter
+	gateway.confMutex.Unlock()
+	peer, err := gateway.getPeer(IA)
+	if err != nil {
+		// The sorter is used once the peer is added
+		return
+	}
+	conf := *peer.pathMgr.getConf()
+	conf.sorter = sorter
+	peer.pathMgr.setConf(&conf)
+}
+
+// sortPaths ranks paths with sorter, passing the measured metrics to MetricsPathSorters
+func sortPaths(sorter PathSorter, paths []snet.Path, metrics func(snet.Path) PathMetrics) []snet.Path {
+	if s, ok := sorter.(MetricsPathSorter); ok {
+		return s.SortPathsByMetrics(paths, metrics)
+	}
+	return sorter.SortPaths(paths)
+}
+
+type leastHopsPathSorter struct{}
+
+func (s leastHopsPathSorter) SortPaths(paths []snet.Path) []snet.Path {
+	sort.SliceStable(paths, func(i, j int) bool {
+		return len(paths[i].Interfaces()) < len(paths[j].Interfaces())
+	})
+	return paths
+}
+
+// lowestRTTPathSorter prefers the paths with the lowest RTT, paths without measurements are ranked last by hops
+type lowestRTTPathSorter struct{}
+
+func (s lowestRTTPathSorter) SortPaths(paths []snet.Path) []snet.Path {
+	return leastHopsPathSorter{}.SortPaths(paths)
+}
+
+func (s lowestRTTPathSorter) SortPathsByMetrics(paths []snet.Path, metrics func(snet.Path) PathMetrics) []snet.Path {
+	paths = leastHopsPathSorter{}.SortPaths(paths)
+	sort.SliceStable(paths, func(i, j int) bool {
+		a, b := metrics(paths[i]).RTT, metrics(paths[j]).RTT
+		return a != 0 && (b == 0 || a < b)
+	})
+	return paths
+}
+
+type highestMTUPathSorter struct{}
+
+func (s highestMTUPathSorter) SortPaths(paths []snet.Path) []snet.Path {
+	sort.SliceStable(paths, func(i, j int) bool {
+		return paths[i].MTU() > paths[j].MTU()
+	})
+	return paths
+}
+
+// expiryPathSorter prefers the paths expiring first, or last with latestFirst
+type expiryPathSorter struct {
+	latestFirst bool
+}
+
+func (s expiryPathSorter) SortPaths(paths []snet.Path) []snet.Path {
+	sort.SliceStable(paths, func(i, j int) bool {
+		if s.latestFirst {
+			return paths[i].Expiry().After(paths[j].Expiry())
+		}
+		return paths[i].Expiry().Before(paths[j].Expiry())
+	})
+	return paths
+}
+
+// randomPathSorter shuffles the paths, spreading the peers over them
+type randomPathSorter struct{}
+
+func (s randomPathSorter) SortPaths(paths []snet.Path) []snet.Path {
+	rand.Shuffle(len(paths), func(i, j int) {
+		paths[i], paths[j] = paths[j], paths[i]
+	})
+	return paths
+}
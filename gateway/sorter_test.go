@@ -0,0 +1,202 @@
+/*
+Copyright (c) 2020, ETH and Andrea Tulimiero
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package gateway
+
+import (
+	"github.com/scionproto/scion/go/lib/addr"
+	"github.com/scionproto/scion/go/lib/common"
+	"github.com/scionproto/scion/go/lib/snet"
+	"github.com/scionproto/scion/go/lib/spath"
+	"net"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+// testIface is an interface of a testPath
+type testIface struct {
+	ia addr.IA
+	id common.IFIDType
+}
+
+func (i testIface) ID() common.IFIDType { return i.id }
+func (i testIface) IA() addr.IA         { return i.ia }
+
+// testPath is a snet.Path identified by its name, like sciond paths it is not comparable
+type testPath struct {
+	name   string
+	ifaces []snet.PathInterface
+	mtu    uint16
+	expiry time.Time
+	raw    *spath.Path
+}
+
+func (p *testPath) Fingerprint() snet.PathFingerprint { return snet.PathFingerprint(p.name) }
+func (p *testPath) OverlayNextHop() *net.UDPAddr      { return nil }
+func (p *testPath) Path() *spath.Path                 { return p.raw }
+func (p *testPath) Interfaces() []snet.PathInterface  { return p.ifaces }
+func (p *testPath) Destination() addr.IA              { return addr.IA{} }
+func (p *testPath) MTU() uint16                       { return p.mtu }
+func (p *testPath) Expiry() time.Time                 { return p.expiry }
+func (p *testPath) Copy() snet.Path                   { c := *p; return &c }
+
+// testPathsByHops returns paths named after their index, the i-th path having hops[i] interfaces
+func testPathsByHops(hops ...int) []snet.Path {
+	var paths []snet.Path
+	for i, n := range hops {
+		p := &testPath{name: string(rune('a' + i))}
+		for j := 0; j < n; j++ {
+			p.ifaces = append(p.ifaces, testIface{id: common.IFIDType(j + 1)})
+		}
+		paths = append(paths, p)
+	}
+	return paths
+}
+
+func pathNames(paths []snet.Path) string {
+	var names string
+	for _, p := range paths {
+		names += string(p.Fingerprint())
+	}
+	return names
+}
+
+func TestPathSorters(t *testing.T) {
+	now := time.Now()
+	withMTU := func(mtus ...uint16) []snet.Path {
+		paths := testPathsByHops(make([]int, len(mtus))...)
+		for i, mtu := range mtus {
+			paths[i].(*testPath).mtu = mtu
+		}
+		return paths
+	}
+	withExpiry := func(offsets ...time.Duration) []snet.Path {
+		paths := testPathsByHops(make([]int, len(offsets))...)
+		for i, offset := range offsets {
+			paths[i].(*testPath).expiry = now.Add(offset)
+		}
+		return paths
+	}
+	tests := []struct {
+		sorter   string
+		paths    []snet.Path
+		metrics  map[snet.PathFingerprint]PathMetrics
+		expected string
+	}{
+		{sorter: leastHopsSorterName, paths: testPathsByHops(4, 2, 6, 2), expected: "bdac"},
+		{sorter: leastHopsSorterName, paths: testPathsByHops(), expected: ""},
+		{
+			sorter: lowestRTTSorterName,
+			paths:  testPathsByHops(2, 4, 6, 2, 4),
+			metrics: map[snet.PathFingerprint]PathMetrics{
+				"b": {RTT: 30 * time.Millisecond},
+				"c": {RTT: 10 * time.Millisecond},
+				"e": {RTT: 20 * time.Millisecond},
+			},
+			// Paths without RTT are ranked last, by hops
+			expected: "cebad",
+		},
+		{sorter: lowestRTTSorterName, paths: testPathsByHops(4, 2), expected: "ba"},
+		{sorter: highestMTUSorterName, paths: withMTU(1280, 1472, 1350, 1472), expected: "bdca"},
+		{sorter: earliestExpirySorterName, paths: withExpiry(time.Hour, time.Minute, 2*time.Hour), expected: "bac"},
+		{sorter: latestExpirySorterName, paths: withExpiry(time.Hour, time.Minute, 2*time.Hour), expected: "cab"},
+	}
+	for _, test := range tests {
+		t.Run(test.sorter+"/"+pathNames(test.paths), func(t *testing.T) {
+			sorter, err := lookupPathSorter(test.sorter)
+			if err != nil {
+				t.Fatal(err)
+			}
+			metrics := func(p snet.Path) PathMetrics { return test.metrics[p.Fingerprint()] }
+			if actual := pathNames(sortPaths(sorter, test.paths, metrics)); actual != test.expected {
+				t.Errorf("expected = %s, actual = %s", test.expected, actual)
+			}
+		})
+	}
+}
+
+func TestRandomPathSorter(t *testing.T) {
+	sorter, err := lookupPathSorter(randomSorterName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	paths := sortPaths(sorter, testPathsByHops(1, 2, 3, 4, 5), nil)
+	names := []byte(pathNames(paths))
+	sort.Slice(names, func(i, j int) bool { return names[i] < names[j] })
+	if string(names) != "abcde" {
+		t.Errorf("expected a permutation of abcde, actual = %s", pathNames(paths))
+	}
+}
+
+func TestLookupPathSorter(t *testing.T) {
+	if _, err := lookupPathSorter("shortestQueue"); err == nil {
+		t.Error("expected error for unknown sorter")
+	}
+	if _, err := lookupPathSorter("testSorter"); err != nil {
+		// Registered once even if the test is run several times
+		RegisterPathSorter("testSorter", leastHopsPathSorter{})
+	}
+	sorter, err := lookupPathSorter("testSorter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(sorter, leastHopsPathSorter{}) {
+		t.Errorf("unexpected sorter %T", sorter)
+	}
+	defer func() {
+		if recover() == nil {
+			t.Error("expected panic registering a sorter twice")
+		}
+	}()
+	RegisterPathSorter("testSorter", leastHopsPathSorter{})
+}
+
+func TestGatewayPathingFor(t *testing.T) {
+	c, err := parseConf([]byte(testGatewayConf("1-ff00:0:1,[127.0.0.1]:30041", "1-ff00:0:2,[127.0.0.2]:30041")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	gateway := &Gateway{conf: c, pathSorters: make(map[string]PathSorter)}
+	gateway.SetPathSorter("1-ff00:0:2", randomPathSorter{})
+	tests := []struct {
+		name     string
+		remote   ConnConf
+		expected PathSorter
+	}{
+		{name: "overridden sorter", remote: c.Remotes[0], expected: randomPathSorter{}},
+		{name: "configured sorter", remote: ConnConf{Address: c.Address}, expected: leastHopsPathSorter{}},
+		{name: "remote without address", remote: ConnConf{}, expected: leastHopsPathSorter{}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pathing, err := gateway.pathingFor(test.remote)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(pathing.sorter, test.expected) {
+				t.Errorf("expected = %T, actual = %T", test.expected, pathing.sorter)
+			}
+		})
+	}
+}
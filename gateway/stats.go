@@ -0,0 +1,77 @@
+/*
+Copyright (c) 2020, ETH and Andrea Tulimiero
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package gateway
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// peerCounters keeps the counters of a peer, which are accessed atomically
+type peerCounters struct {
+	replayedPkts uint64
+	// lastActivity is the time in unix nanoseconds of the last packet received from the remote
+	lastActivity int64
+}
+
+// PeerStats is a snapshot of the counters of a peer
+type PeerStats struct {
+	// ReplayedPkts is the number of packets dropped because replayed or too old for the replay window
+	ReplayedPkts uint64
+	// LastActivity is the time of the last packet received from the remote
+	LastActivity time.Time
+	// NoCompliantPath tells whether traffic is blocked because no path complies with the path policy
+	NoCompliantPath bool
+	// Paths are the paths toward the remote, by rank
+	Paths []PathStats
+}
+
+// PathStats are the metrics of one of the paths toward a remote
+type PathStats struct {
+	// Path lists the interfaces crossed by the path
+	Path string
+	PathMetrics
+	// Current tells whether the path is in use
+	Current bool
+	// Healthy is unset while the path is backing off after failing
+	Healthy bool
+}
+
+// stats returns a snapshot of the counters of the peer
+func (peer *peer) stats() PeerStats {
+	return PeerStats{
+		ReplayedPkts:    atomic.LoadUint64(&peer.counters.replayedPkts),
+		LastActivity:    time.Unix(0, atomic.LoadInt64(&peer.counters.lastActivity)),
+		NoCompliantPath: atomic.LoadInt32(&peer.pathMgr.noCompliantPath) == 1,
+		Paths:           peer.pathMgr.pathStats(),
+	}
+}
+
+// GetPeerStats returns a snapshot of the counters of the peer with a remote gateway identified by IA
+func (gateway *Gateway) GetPeerStats(IA string) (PeerStats, error) {
+	peer, err := gateway.getPeer(IA)
+	if err != nil {
+		return PeerStats{}, err
+	}
+	return peer.stats(), nil
+}
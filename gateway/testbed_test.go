@@ -0,0 +1,372 @@
+/*
+Copyright (c) 2020, ETH and Andrea Tulimiero
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package gateway
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/scionproto/scion/go/lib/addr"
+	"github.com/scionproto/scion/go/lib/common"
+	"github.com/scionproto/scion/go/lib/l4"
+	"github.com/scionproto/scion/go/lib/sciond"
+	"github.com/scionproto/scion/go/lib/snet"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testEventTimeout bounds the time tests wait for gateways to react
+const testEventTimeout = 5 * time.Second
+
+var (
+	testClosedConnError = errors.New("use of closed connection")
+	testPSK             = base64.StdEncoding.EncodeToString([]byte("test psk"))
+)
+
+// testDispatcher is an in-memory dispatcher delivering the packets written on its connections,
+// so that gateways can be tested without a SCION network. Paths are ignored.
+type testDispatcher struct {
+	mutex    sync.Mutex
+	conns    map[string]*testPacketConn
+	lastPort int
+	// registrations counts the connections ever registered
+	registrations int
+	// drop tells whether a packet is lost, if set
+	drop func(pkt *snet.Packet) bool
+}
+
+func newTestDispatcher() *testDispatcher {
+	return &testDispatcher{conns: make(map[string]*testPacketConn), lastPort: 40000}
+}
+
+func testConnKey(ia addr.IA, ip net.IP, port int) string {
+	return fmt.Sprintf("%s,[%s]:%d", ia, ip, port)
+}
+
+func (d *testDispatcher) Register(ctx context.Context, ia addr.IA, registration *net.UDPAddr,
+	svc addr.HostSVC) (snet.PacketConn, uint16, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	port := registration.Port
+	if port == 0 {
+		d.lastPort++
+		port = d.lastPort
+	}
+	key := testConnKey(ia, registration.IP, port)
+	if _, ok := d.conns[key]; ok {
+		return nil, 0, fmt.Errorf("address already in use: %s", key)
+	}
+	c := &testPacketConn{d: d, key: key, pkts: make(chan *snet.Packet, chanLength), closed: make(chan struct{})}
+	d.conns[key] = c
+	d.registrations++
+	return c, uint16(port), nil
+}
+
+// numConns returns the number of open connections
+func (d *testDispatcher) numConns() int {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return len(d.conns)
+}
+
+func (d *testDispatcher) numRegistrations() int {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.registrations
+}
+
+func (d *testDispatcher) setDrop(drop func(pkt *snet.Packet) bool) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.drop = drop
+}
+
+// deliver queues a packet to the connection of its destination, if any, like UDP packets are dropped otherwise
+func (d *testDispatcher) deliver(pkt *snet.Packet) {
+	udp := pkt.L4Header.(*l4.UDP)
+	d.mutex.Lock()
+	c, ok := d.conns[testConnKey(pkt.Destination.IA, pkt.Destination.Host.IP(), int(udp.DstPort))]
+	drop := d.drop
+	d.mutex.Unlock()
+	if !ok || (drop != nil && drop(pkt)) {
+		return
+	}
+	select {
+	case c.pkts <- pkt:
+	default:
+	}
+}
+
+// testPacketConn is a connection of a testDispatcher
+type testPacketConn struct {
+	d         *testDispatcher
+	key       string
+	pkts      chan *snet.Packet
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (c *testPacketConn) WriteTo(pkt *snet.Packet, ov *net.UDPAddr) error {
+	select {
+	case <-c.closed:
+		return testClosedConnError
+	default:
+	}
+	udp := *pkt.L4Header.(*l4.UDP)
+	sent := &snet.Packet{PacketInfo: pkt.PacketInfo}
+	sent.L4Header = &udp
+	sent.Payload = append(common.RawBytes(nil), pkt.Payload.(common.RawBytes)...)
+	c.d.deliver(sent)
+	return nil
+}
+
+func (c *testPacketConn) ReadFrom(pkt *snet.Packet, ov *net.UDPAddr) error {
+	select {
+	case received := <-c.pkts:
+		pkt.PacketInfo = received.PacketInfo
+		return nil
+	case <-c.closed:
+		return testClosedConnError
+	}
+}
+
+func (c *testPacketConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *testPacketConn) SetWriteDeadline(t time.Time) error { return nil }
+func (c *testPacketConn) SetDeadline(t time.Time) error      { return nil }
+
+func (c *testPacketConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		c.d.mutex.Lock()
+		delete(c.d.conns, c.key)
+		c.d.mutex.Unlock()
+	})
+	return nil
+}
+
+// testSciond returns the same paths toward all remotes
+type testSciond struct {
+	sciond.Connector
+	mutex sync.Mutex
+	paths []snet.Path
+}
+
+func (s *testSciond) Paths(ctx context.Context, dst, src addr.IA, f sciond.PathReqFlags) ([]snet.Path, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.paths, nil
+}
+
+// testAdapter sends the packets passed to ProcessEgressPkt to remote, and collects the packets and ctrl messages
+// it receives
+type testAdapter struct {
+	remote     string
+	received   chan []byte
+	ctrlMsgs   chan Message
+	handshakes chan addr.IA
+	closed     chan struct{}
+	closeOnce  sync.Once
+}
+
+func newTestAdapter(remote string) *testAdapter {
+	return &testAdapter{remote: remote, received: make(chan []byte, chanLength), ctrlMsgs: make(chan Message, 16),
+		handshakes: make(chan addr.IA, 16), closed: make(chan struct{})}
+}
+
+func (a *testAdapter) ProcessCtrlMsg(msg Message, IA addr.IA) {
+	select {
+	case a.ctrlMsgs <- msg:
+	default:
+	}
+}
+
+func (a *testAdapter) HandshakeComplete(w PeerWriter) {
+	a.handshakes <- w.(adapterPeerWriter).remote.Address.IA
+}
+
+func (a *testAdapter) Read([]byte) (int, error) {
+	<-a.closed
+	return 0, testClosedConnError
+}
+
+func (a *testAdapter) ProcessIngressPkt(b []byte) {
+	select {
+	case a.received <- append([]byte(nil), b...):
+	default:
+	}
+}
+
+func (a *testAdapter) ProcessEgressPkt(b []byte, getPeerWriter func(string) (PeerWriter, error)) {
+	w, err := getPeerWriter(a.remote)
+	if err != nil {
+		return
+	}
+	w.DataWriter().Write(b)
+}
+
+func (a *testAdapter) Close() error {
+	a.closeOnce.Do(func() { close(a.closed) })
+	return nil
+}
+
+// waitHandshake waits for the completion of a handshake with remote
+func (a *testAdapter) waitHandshake(t *testing.T, remote addr.IA) {
+	t.Helper()
+	timeout := time.After(testEventTimeout)
+	for {
+		select {
+		case ia := <-a.handshakes:
+			if ia.Equal(remote) {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("handshake with %s not completed", remote)
+		}
+	}
+}
+
+// waitFor waits for cond to hold, failing the test on timeout
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	timeout := time.After(testEventTimeout)
+	for !cond() {
+		select {
+		case <-timeout:
+			t.Fatalf("timed out waiting for %s", what)
+		case <-time.After(5 * time.Millisecond):
+		}
+	}
+}
+
+// testGateway is a gateway of a testbed with its adapter
+type testGateway struct {
+	*Gateway
+	adapter *testAdapter
+}
+
+// testNetworkOf returns the network of a gateway at ia, connected through a dispatcher
+func testNetworkOf(d *testDispatcher, ia addr.IA) snet.Network {
+	return snet.NewCustomNetworkWithPR(ia, d)
+}
+
+// newTestGateway starts a gateway parsing confYAML, connected to the other gateways of the dispatcher
+func newTestGateway(t *testing.T, d *testDispatcher, sd *testSciond, confYAML, remote string) *testGateway {
+	t.Helper()
+	return newTestGatewayWithAdapters(t, d, sd, confYAML, remote, nil)
+}
+
+// newTestGatewayWithAdapters is like newTestGateway, but also adds the adapters of extra
+func newTestGatewayWithAdapters(t *testing.T, d *testDispatcher, sd *testSciond, confYAML, remote string,
+	extra map[AdapterID]Adapter) *testGateway {
+	t.Helper()
+	conf, err := parseConf([]byte(confYAML))
+	if err != nil {
+		t.Fatal(err)
+	}
+	gateway, err := newGatewayWithNetwork(conf, "", sd, testNetworkOf(d, conf.Address.IA))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tg := &testGateway{Gateway: gateway, adapter: newTestAdapter(remote)}
+	tg.SetAdapter(tg.adapter)
+	for id, adapter := range extra {
+		if err := tg.AddAdapter(id, adapter); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tg.Start()
+	t.Cleanup(func() { tg.Stop(context.Background()) })
+	return tg
+}
+
+// testGatewayConf returns the configuration of a gateway at local, with a remote authenticated with testPSK
+// for each of remotes
+func testGatewayConf(local string, remotes ...string) string {
+	c := fmt.Sprintf("address: %q\n", local)
+	if len(remotes) > 0 {
+		c += "remotes:\n"
+	}
+	for _, remote := range remotes {
+		c += fmt.Sprintf("  - address: %q\n    auth: {type: psk, psk: %q}\n", remote, testPSK)
+	}
+	return c
+}
+
+// newTestPair starts two gateways configured with each other, and waits for them to complete their handshake
+func newTestPair(t *testing.T, d *testDispatcher, sd *testSciond) (*testGateway, *testGateway) {
+	t.Helper()
+	const addrA, addrB = "1-ff00:0:1,[127.0.0.1]:30041", "1-ff00:0:2,[127.0.0.2]:30041"
+	a := newTestGateway(t, d, sd, testGatewayConf(addrA, addrB), "1-ff00:0:2")
+	b := newTestGateway(t, d, sd, testGatewayConf(addrB, addrA), "1-ff00:0:1")
+	a.adapter.waitHandshake(t, b.conf.Address.IA)
+	b.adapter.waitHandshake(t, a.conf.Address.IA)
+	return a, b
+}
+
+func newTestTestbed() (*testDispatcher, *testSciond) {
+	return newTestDispatcher(), &testSciond{paths: testPathsByHops(2, 4)}
+}
+
+// sendTraffic makes a send a packet to its remote every millisecond until stop is closed,
+// it returns a channel closed once it stopped
+func sendTraffic(a *testGateway, stop <-chan struct{}) <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		t := time.NewTicker(time.Millisecond)
+		defer t.Stop()
+		for seq := 0; ; seq++ {
+			select {
+			case <-stop:
+				return
+			case <-t.C:
+				a.ProcessEgressPkt([]byte(fmt.Sprintf("packet %d", seq)))
+			}
+		}
+	}()
+	return done
+}
+
+// waitReceived waits for an adapter to receive a packet, failing the test on timeout
+func (a *testAdapter) waitReceived(t *testing.T) []byte {
+	t.Helper()
+	select {
+	case b := <-a.received:
+		return b
+	case <-time.After(testEventTimeout):
+		t.Fatal("no packet received")
+		return nil
+	}
+}
+
+func TestTestbedHandshake(t *testing.T) {
+	d, sd := newTestTestbed()
+	a, b := newTestPair(t, d, sd)
+	a.ProcessEgressPkt([]byte("ping"))
+	if actual := string(b.adapter.waitReceived(t)); actual != "ping" {
+		t.Errorf("expected = %q, actual = %q", "ping", actual)
+	}
+}
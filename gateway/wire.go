@@ -0,0 +1,308 @@
+/*
+Copyright (c) 2020, ETH and Andrea Tulimiero
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package gateway
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+// Messages are encoded on the wire in a frame with the following format:
+//
+//	| type (1 byte) | version (1 byte) | length (2 bytes, big endian) | payload (length bytes) |
+//
+// The type identifies the Message and selects the MsgCodec in charge of the payload, while the version
+// allows a MsgCodec to evolve the payload encoding while still decoding the previous ones.
+// Payloads are made of the following primitives, as written by MsgEncoder:
+// fixed size big endian integers, and byte slices and strings prefixed by their uvarint encoded length.
+
+const (
+	msgHdrLen     = 4
+	maxMsgPayload = 1<<16 - 1
+)
+
+var (
+	unknownMsgTypeError = errors.New("unknown message type")
+	shortMsgError       = errors.New("message too short")
+)
+
+// MsgType identifies the type of a Message on the wire
+type MsgType uint8
+
+// MinAdapterMsgType is the first MsgType available to the messages of adapters,
+// lower values are reserved to the messages of the gateway
+const MinAdapterMsgType MsgType = 0x80
+
+// MsgCodec encodes and decodes the payload of a Message type
+type MsgCodec interface {
+	// Encode writes the payload of msg to e
+	Encode(msg Message, e *MsgEncoder) error
+	// Decode parses a payload encoded with the given version
+	Decode(version uint8, d *MsgDecoder) (Message, error)
+}
+
+type msgRegistration struct {
+	msgType MsgType
+	version uint8
+	codec   MsgCodec
+}
+
+var (
+	msgRegistryMutex sync.RWMutex
+	msgTypesByGoType = make(map[reflect.Type]*msgRegistration)
+	msgTypes         = make(map[MsgType]*msgRegistration)
+)
+
+// RegisterMsgCodec registers the codec of a Message type, msg being a sample of the type.
+// Messages are encoded with the given version, and can be passed either by value or by reference.
+// Like gob.Register, it panics if the type is registered twice and is meant to be called from init functions.
+func RegisterMsgCodec(msgType MsgType, version uint8, msg Message, codec MsgCodec) {
+	msgRegistryMutex.Lock()
+	defer msgRegistryMutex.Unlock()
+	goType := baseType(msg)
+	if _, ok := msgTypes[msgType]; ok {
+		panic(fmt.Sprintf("message type %d registered twice", msgType))
+	}
+	if _, ok := msgTypesByGoType[goType]; ok {
+		panic(fmt.Sprintf("message %s registered twice", goType))
+	}
+	reg := &msgRegistration{msgType: msgType, version: version, codec: codec}
+	msgTypes[msgType] = reg
+	msgTypesByGoType[goType] = reg
+}
+
+func baseType(msg Message) reflect.Type {
+	t := reflect.TypeOf(msg)
+	for t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t
+}
+
+// encodeMsg returns the frame of a Message
+func encodeMsg(msg Message) ([]byte, error) {
+	msgRegistryMutex.RLock()
+	reg, ok := msgTypesByGoType[baseType(msg)]
+	msgRegistryMutex.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("no codec registered for %T", msg)
+	}
+	e := &MsgEncoder{buf: make([]byte, msgHdrLen)}
+	if err := reg.codec.Encode(msg, e); err != nil {
+		return nil, err
+	}
+	payloadLen := len(e.buf) - msgHdrLen
+	if payloadLen > maxMsgPayload {
+		return nil, fmt.Errorf("message payload too long: %d", payloadLen)
+	}
+	e.buf[0], e.buf[1] = byte(reg.msgType), reg.version
+	binary.BigEndian.PutUint16(e.buf[2:], uint16(payloadLen))
+	return e.buf, nil
+}
+
+// decodeMsg parses a frame, falling back to gob in compatibility mode
+func decodeMsg(buf []byte) (Message, error) {
+	msg, err := decodeFrame(buf)
+	if err != nil && *gobCompat {
+		var gobMsg Message
+		if gobErr := gob.NewDecoder(bytes.NewReader(buf)).Decode(&gobMsg); gobErr == nil {
+			return gobMsg, nil
+		}
+	}
+	return msg, err
+}
+
+func decodeFrame(buf []byte) (Message, error) {
+	if len(buf) < msgHdrLen {
+		return nil, shortMsgError
+	}
+	msgType, version, payloadLen := MsgType(buf[0]), buf[1], int(binary.BigEndian.Uint16(buf[2:]))
+	if payloadLen != len(buf)-msgHdrLen {
+		return nil, fmt.Errorf("invalid message length: expected = %d, actual = %d", payloadLen, len(buf)-msgHdrLen)
+	}
+	msgRegistryMutex.RLock()
+	reg, ok := msgTypes[msgType]
+	msgRegistryMutex.RUnlock()
+	if !ok {
+		return nil, unknownMsgTypeError
+	}
+	d := &MsgDecoder{buf: buf[msgHdrLen:]}
+	msg, err := reg.codec.Decode(version, d)
+	if err != nil {
+		return nil, err
+	}
+	if d.Err() != nil {
+		return nil, d.Err()
+	}
+	return msg, nil
+}
+
+// MsgEncoder writes the primitives of a payload
+type MsgEncoder struct {
+	buf []byte
+}
+
+func (e *MsgEncoder) PutUint8(v uint8) {
+	e.buf = append(e.buf, v)
+}
+
+func (e *MsgEncoder) PutUint16(v uint16) {
+	e.buf = append(e.buf, 0, 0)
+	binary.BigEndian.PutUint16(e.buf[len(e.buf)-2:], v)
+}
+
+func (e *MsgEncoder) PutUint32(v uint32) {
+	e.buf = append(e.buf, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(e.buf[len(e.buf)-4:], v)
+}
+
+func (e *MsgEncoder) PutUint64(v uint64) {
+	e.buf = append(e.buf, 0, 0, 0, 0, 0, 0, 0, 0)
+	binary.BigEndian.PutUint64(e.buf[len(e.buf)-8:], v)
+}
+
+// PutBytes writes a byte slice prefixed by its length
+func (e *MsgEncoder) PutBytes(b []byte) {
+	var lenBuf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(lenBuf[:], uint64(len(b)))
+	e.buf = append(e.buf, lenBuf[:n]...)
+	e.buf = append(e.buf, b...)
+}
+
+// PutString writes a string prefixed by its length
+func (e *MsgEncoder) PutString(s string) {
+	e.PutBytes([]byte(s))
+}
+
+// MsgDecoder reads the primitives of a payload.
+// Reading past the end of the payload returns zero values, and the error is reported by Err.
+type MsgDecoder struct {
+	buf []byte
+	err error
+}
+
+func (d *MsgDecoder) next(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if len(d.buf) < n {
+		d.err = shortMsgError
+		return nil
+	}
+	b := d.buf[:n]
+	d.buf = d.buf[n:]
+	return b
+}
+
+func (d *MsgDecoder) GetUint8() uint8 {
+	if b := d.next(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (d *MsgDecoder) GetUint16() uint16 {
+	if b := d.next(2); b != nil {
+		return binary.BigEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (d *MsgDecoder) GetUint32() uint32 {
+	if b := d.next(4); b != nil {
+		return binary.BigEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (d *MsgDecoder) GetUint64() uint64 {
+	if b := d.next(8); b != nil {
+		return binary.BigEndian.Uint64(b)
+	}
+	return 0
+}
+
+// GetBytes reads a byte slice prefixed by its length, the returned slice is a copy
+func (d *MsgDecoder) GetBytes() []byte {
+	if d.err != nil {
+		return nil
+	}
+	l, n := binary.Uvarint(d.buf)
+	if n <= 0 || l > uint64(len(d.buf)-n) {
+		d.err = shortMsgError
+		return nil
+	}
+	d.buf = d.buf[n:]
+	return append([]byte(nil), d.next(int(l))...)
+}
+
+// GetString reads a string prefixed by its length
+func (d *MsgDecoder) GetString() string {
+	return string(d.GetBytes())
+}
+
+// Err returns the first error encountered while decoding
+func (d *MsgDecoder) Err() error {
+	return d.err
+}
+
+// wireMsg is implemented by the messages of the gateway, which encode themselves
+type wireMsg interface {
+	encode(e *MsgEncoder) error
+	decode(version uint8, d *MsgDecoder) error
+}
+
+// wireMsgCodec is the MsgCodec of a wireMsg
+type wireMsgCodec struct {
+	newMsg func() wireMsg
+}
+
+func (c wireMsgCodec) Encode(msg Message, e *MsgEncoder) error {
+	m, ok := msg.(wireMsg)
+	if !ok {
+		return fmt.Errorf("unexpected message %T", msg)
+	}
+	return m.encode(e)
+}
+
+func (c wireMsgCodec) Decode(version uint8, d *MsgDecoder) (Message, error) {
+	m := c.newMsg()
+	if err := m.decode(version, d); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func registerWireMsg(msgType MsgType, newMsg func() wireMsg) {
+	registerWireMsgVersion(msgType, 1, newMsg)
+}
+
+// registerWireMsgVersion is like registerWireMsg, for messages whose encoding changed since version 1
+func registerWireMsgVersion(msgType MsgType, version uint8, newMsg func() wireMsg) {
+	RegisterMsgCodec(msgType, version, newMsg(), wireMsgCodec{newMsg: newMsg})
+}
@@ -0,0 +1,161 @@
+/*
+Copyright (c) 2020, ETH and Andrea Tulimiero
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package gateway
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"testing"
+)
+
+// wireTestMsgs has a message of every type of the gateway, with all fields set
+var wireTestMsgs = []Message{
+	&keepAliveMsg{Seq: 7, Timestamp: 1590000000123456789, Echo: true, Backup: true},
+	&keepAliveMsg{Seq: 1 << 31, Timestamp: 42},
+	&handshakeRequestMsg{
+		PubKey:     []byte{1, 2, 3},
+		PubKeyTag:  bytes.Repeat([]byte{4}, 300),
+		SessionID:  1 << 40,
+		CtrlPort:   30000,
+		DataPort:   65535,
+		Version:    protocolVersion,
+		MinVersion: minProtocolVersion,
+		Caps: capabilities{
+			CipherSuites: []cipherSuite{cipherSuiteChaCha20Poly1305, cipherSuiteAES256GCM},
+			Compressions: []compression{compressionNone},
+			Multipath:    true,
+			AdapterTypes: []string{"ip", "eth"},
+		},
+		CertChain:  []byte("chain"),
+		AcceptPort: 30041,
+	},
+	&handshakeResponseMsg{Status: handshakeRejected, Reason: "no common cipher suite", Confirm: []byte{9}},
+	&rekeyRequestMsg{Epoch: 3, PubKey: bytes.Repeat([]byte{5}, 32)},
+	&rekeyResponseMsg{Epoch: 255, PubKey: bytes.Repeat([]byte{6}, 32)},
+	&reliableMsg{Seq: 10, Base: 8, Msg: &goodbyeMsg{Reason: goodbyeRestart}},
+	&ackMsg{Seq: 1<<64 - 1},
+	&rpcRequestMsg{ID: 1 << 50, Msg: &goodbyeMsg{Reason: goodbyeRestart}},
+	&rpcResponseMsg{ID: 1 << 50, Msg: &ackMsg{Seq: 3}},
+	&rpcResponseMsg{ID: 2, Error: "unknown request"},
+	&goodbyeMsg{Reason: goodbyeClose},
+	&fragmentMsg{ID: 1 << 30, Index: 2, Count: 3, Data: []byte("chunk")},
+	&adapterMsg{ID: 2, Msg: &ackMsg{Seq: 5}},
+}
+
+func TestWireRoundTrip(t *testing.T) {
+	for _, msg := range wireTestMsgs {
+		frame, err := encodeMsg(msg)
+		if err != nil {
+			t.Fatalf("encodeMsg(%T) failed: %s", msg, err)
+		}
+		decoded, err := decodeMsg(frame)
+		if err != nil {
+			t.Fatalf("decodeMsg(%T) failed: %s", msg, err)
+		}
+		if !reflect.DeepEqual(decoded, msg) {
+			t.Errorf("%T round trip: expected = %+v, actual = %+v", msg, msg, decoded)
+		}
+	}
+}
+
+// TestWireTruncated checks that payloads cut short are rejected, even when the frame header matches their length
+func TestWireTruncated(t *testing.T) {
+	for _, msg := range wireTestMsgs {
+		frame, err := encodeMsg(msg)
+		if err != nil {
+			t.Fatalf("encodeMsg(%T) failed: %s", msg, err)
+		}
+		for l := 0; l < len(frame); l++ {
+			truncated := append([]byte(nil), frame[:l]...)
+			if _, err := decodeFrame(truncated); err == nil {
+				t.Errorf("%T truncated to %d bytes: expected error", msg, l)
+			}
+			if l < msgHdrLen {
+				continue
+			}
+			binary.BigEndian.PutUint16(truncated[2:], uint16(l-msgHdrLen))
+			if _, err := decodeFrame(truncated); err == nil {
+				t.Errorf("%T with payload truncated to %d bytes: expected error", msg, l-msgHdrLen)
+			}
+		}
+	}
+}
+
+func TestWireInvalidFrames(t *testing.T) {
+	frame, err := encodeMsg(&rekeyRequestMsg{Epoch: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name  string
+		frame []byte
+	}{
+		{"empty", nil},
+		{"trailing bytes", append(append([]byte(nil), frame...), 0)},
+		{"length beyond frame", append([]byte{frame[0], frame[1], 0xff, 0xff}, frame[msgHdrLen:]...)},
+		{"unknown type", append([]byte{0x7f}, frame[1:]...)},
+		{"bytes length beyond payload", []byte{byte(rekeyRequestMsgType), 1, 0, 2, 1, 0xff}},
+		{"bytes length overflow", append([]byte{byte(rekeyRequestMsgType), 1, 0, 11, 1},
+			0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01)},
+		{"invalid path segment", []byte{byte(hiddenPathRequestMsgType), 1, 0, 3, 2, 0xff, 0xff}},
+		{"nested frame truncated", []byte{byte(reliableMsgType), 1, 0, 21,
+			0, 0, 0, 0, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0, 1, 4, byte(ackMsgType), 1, 0, 8}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if msg, err := decodeFrame(test.frame); err == nil {
+				t.Errorf("expected error, decoded %+v", msg)
+			}
+		})
+	}
+}
+
+func TestWireOversized(t *testing.T) {
+	tests := []struct {
+		name      string
+		msg       Message
+		expectErr bool
+	}{
+		{"max payload", &rekeyRequestMsg{PubKey: make([]byte, maxMsgPayload-1-3)}, false},
+		{"payload too long", &rekeyRequestMsg{PubKey: make([]byte, maxMsgPayload-1-2)}, true},
+		{"nested payload too long", &reliableMsg{Msg: &rekeyRequestMsg{PubKey: make([]byte, maxMsgPayload)}}, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			frame, err := encodeMsg(test.msg)
+			if test.expectErr {
+				if err == nil {
+					t.Errorf("expected error, encoded %d bytes", len(frame))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := decodeFrame(frame); err != nil {
+				t.Errorf("decodeFrame failed: %s", err)
+			}
+		})
+	}
+}
@@ -36,6 +36,8 @@ type worker struct {
 	pktsChannel chan []byte
 	pktsPool    *memPool
 	adapter     Adapter
+	// done is closed once the worker stopped and drained its channel
+	done chan struct{}
 }
 
 func newWorker(adapter Adapter, gateway *Gateway) *worker {
@@ -43,6 +45,7 @@ func newWorker(adapter Adapter, gateway *Gateway) *worker {
 		gateway:     gateway,
 		adapter:     adapter,
 		pktsChannel: make(chan []byte, chanLength),
+		done:        make(chan struct{}),
 		//pktsPool:sync.Pool{
 		//	New: func() interface{} {
 		//		return make([]byte, common.MaxMTU)
@@ -53,6 +56,32 @@ func newWorker(adapter Adapter, gateway *Gateway) *worker {
 	return w
 }
 
+// run processes packets until the gateway stops, then processes the packets still queued
+func (w *worker) run(process func([]byte)) {
+	defer close(w.done)
+	handle := func(buf []byte) {
+		process(buf)
+		if useWorkerMemPool {
+			w.pktsPool.put(buf[:cap(buf)])
+		}
+	}
+	for {
+		select {
+		case buf := <-w.pktsChannel:
+			handle(buf)
+		case <-w.gateway.stop:
+			for {
+				select {
+				case buf := <-w.pktsChannel:
+					handle(buf)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
 type ingressWorker struct {
 	worker
 }
@@ -63,28 +92,24 @@ func newIngressWorker(adapter Adapter, gateway *Gateway) *ingressWorker {
 
 func (w *ingressWorker) Run() {
 	log.Debug("Starting ingress worker", "adapter", w.adapter)
-	for buf := range w.pktsChannel {
-		w.adapter.ProcessIngressPkt(buf)
-		if useWorkerMemPool {
-			w.pktsPool.put(buf[:cap(buf)])
-		}
-	}
+	w.run(w.adapter.ProcessIngressPkt)
 }
 
 type egressWorker struct {
 	worker
+	id AdapterID
 }
 
-func newEgressWorker(adapter Adapter, gateway *Gateway) *egressWorker {
-	return &egressWorker{*newWorker(adapter, gateway)}
+func newEgressWorker(adapter Adapter, id AdapterID, gateway *Gateway) *egressWorker {
+	return &egressWorker{*newWorker(adapter, gateway), id}
 }
 
 func (w *egressWorker) Run() {
 	log.Debug("Starting egress worker", "adapter", w.adapter)
-	for buf := range w.pktsChannel {
-		w.adapter.ProcessEgressPkt(buf, w.gateway.getPeerWriter)
-		if useWorkerMemPool {
-			w.pktsPool.put(buf[:cap(buf)])
-		}
+	getPeerWriter := func(IA string) (PeerWriter, error) {
+		return w.gateway.getAdapterPeerWriter(IA, w.id)
 	}
+	w.run(func(buf []byte) {
+		w.adapter.ProcessEgressPkt(buf, getPeerWriter)
+	})
 }
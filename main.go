@@ -23,6 +23,7 @@ SOFTWARE.
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"github.com/andreatulimiero/seg/gateway"
@@ -53,7 +54,7 @@ func main() {
 	if err := log.Setup(logCfg); err != nil {
 		fmt.Fprintf(os.Stderr, "ERROR: %s", err)
 	}
-	setupSignalHandler()
+	ctx := setupSignalHandler()
 
 	gatewayConfBuf, err := ioutil.ReadFile(*confPath)
 	if err != nil {
@@ -64,26 +65,79 @@ func main() {
 		gateway.LogFatal("Cannot create Gateway", "err", err)
 	}
 
-	adapterConfBuf, err := ioutil.ReadFile(g.GetAdapterConfPath())
-	if err != nil {
-		gateway.LogFatal("Error loading conf file", "err", err)
+	for _, adapterConf := range g.GetAdapterConfs() {
+		adapterConfBuf, err := ioutil.ReadFile(adapterConf.ConfPath)
+		if err != nil {
+			gateway.LogFatal("Error loading conf file", "err", err)
+		}
+		a, err := newAdapter(g, adapterConf.ID, adapterConf.Type, adapterConfBuf)
+		if err != nil {
+			gateway.LogFatal("Cannot create adapter", "type", adapterConf.Type, "err", err)
+		}
+		if err := g.AddAdapter(adapterConf.ID, a); err != nil {
+			gateway.LogFatal("Cannot add adapter", "err", err)
+		}
 	}
-	a, err := ipAdapter.NewIPAdapter(adapterConfBuf)
-	if err != nil {
-		gateway.LogFatal("Cannot create IP adapter", "err", err)
+	reloadOnHangup(g)
+	if err := g.Run(ctx); err != nil {
+		log.Error("Error stopping gateway", "err", err)
 	}
+}
 
-	g.SetAdapter(a)
-	g.Start()
-	select {}
+// newAdapter creates an adapter of the given type (the IPAdapter by default)
+func newAdapter(g *gateway.Gateway, id gateway.AdapterID, adapterType string, confBuf []byte) (gateway.Adapter, error) {
+	switch adapterType {
+	case "", "ip":
+		a, err := ipAdapter.NewIPAdapter(confBuf)
+		if err != nil {
+			return nil, err
+		}
+		g.HandleAdapterRPC(id, &ipAdapter.SubnetsRequestMsg{}, a.HandleSubnetsRequest)
+		return a, nil
+	default:
+		return nil, fmt.Errorf("unknown adapter type: %s", adapterType)
+	}
 }
 
-func setupSignalHandler() {
+// setupSignalHandler returns a context that is canceled upon receiving a terminate signal
+func setupSignalHandler() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
 	go func() {
-		c := make(chan os.Signal)
+		c := make(chan os.Signal, 1)
 		signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 		<-c
 		log.Info("Received terminate signal ...")
-		os.Exit(0)
+		cancel()
+	}()
+	return ctx
+}
+
+// reloadOnHangup reloads the configuration files of the gateway and of the adapters upon receiving SIGHUP
+func reloadOnHangup(g *gateway.Gateway) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	go func() {
+		for range c {
+			log.Info("Received hangup signal, reloading configuration ...")
+			if err := reload(g); err != nil {
+				log.Error("Error reloading configuration", "err", err)
+			}
+		}
 	}()
 }
+
+func reload(g *gateway.Gateway) error {
+	gatewayConfBuf, err := ioutil.ReadFile(*confPath)
+	if err != nil {
+		return err
+	}
+	adapterConfBufs := make(map[gateway.AdapterID][]byte)
+	for _, adapterConf := range g.GetAdapterConfs() {
+		adapterConfBuf, err := ioutil.ReadFile(adapterConf.ConfPath)
+		if err != nil {
+			return err
+		}
+		adapterConfBufs[adapterConf.ID] = adapterConfBuf
+	}
+	return g.Reload(gatewayConfBuf, adapterConfBufs)
+}